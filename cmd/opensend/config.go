@@ -0,0 +1,70 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pelletier/go-toml"
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+)
+
+// Show path of the config in use, or its values after applying defaults
+func configCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addConfigFlags(fs, opts)
+	args = parseFlags(fs, args, 1)
+	// Get path of config in use
+	path := opts.configPath
+	if path == "" {
+		path = config.GetConfigPath()
+	}
+	action := "show"
+	if len(args) == 1 {
+		action = args[0]
+	}
+	switch action {
+	case "path":
+		// No config file is used if none is found
+		if path == "" {
+			exit(exitError, log.Error(), "No config found, using defaults")
+		}
+		if events != nil {
+			emit(configEvent{eventHeader: header("config"), Path: path})
+			return
+		}
+		fmt.Println(path)
+	case "show":
+		cfg := config.NewConfig(path)
+		if events != nil {
+			emit(configEvent{header("config"), path, cfg})
+			return
+		}
+		// Print config as TOML
+		data, err := toml.Marshal(cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error marshalling toml")
+		}
+		os.Stdout.Write(data)
+	default:
+		fs.Usage()
+		exit(exitUsage, log.Error().Str("action", action), "Unknown config action")
+	}
+}
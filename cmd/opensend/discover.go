@@ -0,0 +1,107 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// List or watch receivers on the network
+func discoverCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addConfigFlags(fs, opts)
+	fs.IntVar(&opts.beaconPort, "beacon-port", 0, "UDP port for beacon discovery (default from config)")
+	fs.BoolVar(&opts.watch, "watch", false, "Keep watching for receivers appearing and disappearing")
+	parseFlags(fs, args, 0)
+	cfg := opts.loadConfig(roleSender)
+	discover(newDiscoverer(cfg), opts.watch)
+}
+
+// Create discoverer using all discovery backends enabled in config
+func newDiscoverer(cfg *config.Config) transfer.Discoverer {
+	discoverers := transfer.MultiDiscoverer{transfer.ZeroconfDiscoverer{}}
+	if cfg.Discovery.Beacon {
+		discoverers = append(discoverers, transfer.BeaconDiscoverer{Port: cfg.Discovery.BeaconPort})
+	}
+	return discoverers
+}
+
+// List receivers on the network, or watch for changes if watch is true
+func discover(discoverer transfer.Discoverer, watch bool) {
+	// If not watching
+	if !watch {
+		// Take a single snapshot of receivers
+		for _, receiver := range transfer.DiscoverReceivers(discoverer) {
+			if events != nil {
+				emit(transfer.WatchEvent{Type: transfer.ReceiverUp, Time: time.Now(), Receiver: receiver})
+			} else {
+				fmt.Println(formatReceiver(receiver))
+			}
+		}
+		return
+	}
+	// Create context cancelled upon SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	// Notify user watching has started
+	log.Info().Msg("Watching for opensend receivers, press Ctrl+C to stop")
+	// Watch until cancelled, printing every event
+	transfer.Watch(ctx, discoverer, func(event transfer.WatchEvent) {
+		if events != nil {
+			emit(event)
+			return
+		}
+		switch event.Type {
+		case transfer.ReceiverUp:
+			fmt.Println("+", formatReceiver(event.Receiver))
+		case transfer.ReceiverUpdated:
+			fmt.Println("~", formatReceiver(event.Receiver))
+		case transfer.ReceiverDown:
+			fmt.Println("-", event.Receiver.Name)
+		}
+	})
+}
+
+// Format receiver as a single human-readable line
+func formatReceiver(receiver transfer.Receiver) string {
+	version := "?"
+	if receiver.Version != 0 {
+		version = strconv.Itoa(receiver.Version)
+	}
+	fingerprint := receiver.Fingerprint
+	if fingerprint == "" {
+		fingerprint = "?"
+	}
+	return receiver.Name + " (v" + version + ", " + fingerprint + ") " + strings.Join(receiver.Addrs, ", ")
+}
@@ -0,0 +1,258 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/history"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Session being recorded in history, nil outside of sessions or if
+// history is disabled
+var session *history.Record
+
+// Path of history file the session is recorded in
+var historyPath string
+
+// Event emitted by the history command for every record
+type historyEvent struct {
+	eventHeader
+	Record history.Record `json:"record"`
+}
+
+// Start recording session with peer after key exchange, unless history
+// is disabled in config
+func beginRecord(cfg *config.Config, direction string, peerAddr string, fingerprint string, sessionID string) {
+	if cfg.HistoryFile == "" {
+		return
+	}
+	historyPath = config.ExpandPath(cfg.HistoryFile)
+	session = &history.Record{
+		Time:            time.Now(),
+		Direction:       direction,
+		PeerAddr:        peerAddr,
+		PeerFingerprint: fingerprint,
+		Session:         sessionID,
+		Files:           []history.File{},
+	}
+}
+
+// Add action and files of offer to the session being recorded
+func recordOffer(offer offerEvent) {
+	if session == nil {
+		return
+	}
+	session.Action, session.Data, session.Size = offer.Action, offer.Data, offer.Size
+	for _, file := range offer.Files {
+		session.Files = append(session.Files, history.File{Name: file.Name, Size: file.Size, Hash: file.Hash})
+	}
+}
+
+// Replace files of the session being recorded with the files of manifest
+// transferred by sync plan and the files it deleted
+//
+// Nothing is transferred or deleted in dry runs.
+func recordSyncPlan(plan *serialization.SyncPlan, manifest *transfer.Manifest) {
+	if session == nil {
+		return
+	}
+	session.Files, session.Size = []history.File{}, 0
+	if plan.DryRun {
+		return
+	}
+	for _, entry := range manifest.Files {
+		if plan.Needs(entry) {
+			session.Files = append(session.Files, history.File{Name: entry.Name, Size: entry.Size, Hash: entry.Hash})
+			session.Size += entry.Size
+		}
+	}
+	for _, name := range plan.Delete {
+		session.Files = append(session.Files, history.File{Name: name, Deleted: true})
+	}
+}
+
+// Finish session being recorded with outcome, saving it in history
+func finishRecord(outcome string, errMsg string) {
+	if session == nil {
+		return
+	}
+	record := *session
+	session = nil
+	record.Duration = time.Since(record.Time).Seconds()
+	record.Outcome, record.Error = outcome, errMsg
+	err := history.Append(historyPath, record)
+	if err != nil {
+		// The transfer itself is done, so only warn
+		log.Warn().Err(err).Str("path", historyPath).Msg("Error saving transfer in history")
+	}
+}
+
+// Show transfers recorded in history, or export them
+func historyCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addConfigFlags(fs, opts)
+	filter := history.Filter{}
+	var since, until, export string
+	var limit int
+	fs.StringVar(&filter.Peer, "peer", "", "Only show transfers with peers whose address, host or fingerprint matches the given text or glob")
+	fs.StringVar(&filter.Direction, "direction", "", "Only show transfers in the given direction (send or receive)")
+	fs.StringVar(&filter.Action, "type", "", "Only show transfers with the given action type")
+	fs.StringVar(&filter.Outcome, "outcome", "", "Only show transfers with the given outcome (ok or failed)")
+	fs.StringVar(&since, "since", "", "Only show transfers started after a date (2006-01-02), time (RFC 3339) or duration ago (24h)")
+	fs.StringVar(&until, "until", "", "Only show transfers started before a date (2006-01-02), time (RFC 3339) or duration ago (24h)")
+	fs.IntVar(&limit, "limit", 0, "Only show the given number of most recent transfers (0 shows all)")
+	fs.StringVar(&export, "export", "", "Export transfers with all files and hashes for audits: csv or json")
+	parseFlags(fs, args, 0)
+	// Make sure direction and outcome can match
+	if filter.Direction != "" && filter.Direction != history.Send && filter.Direction != history.Receive {
+		exit(exitUsage, log.Error().Str("direction", filter.Direction), "Unknown direction, use send or receive")
+	}
+	if filter.Outcome != "" && filter.Outcome != history.OK && filter.Outcome != history.Failed {
+		exit(exitUsage, log.Error().Str("outcome", filter.Outcome), "Unknown outcome, use ok or failed")
+	}
+	filter.Since, filter.Until = parseHistoryTime(since), parseHistoryTime(until)
+	cfg := opts.loadConfig(roleReceiver)
+	if cfg.HistoryFile == "" {
+		exit(exitUsage, log.Error(), "History is disabled, set historyFile in the config")
+	}
+	records, err := history.Read(config.ExpandPath(cfg.HistoryFile))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error reading history")
+	}
+	// Keep matching records
+	var matches []history.Record
+	for _, record := range records {
+		if filter.Match(record) {
+			matches = append(matches, record)
+		}
+	}
+	// Keep most recent records
+	if limit > 0 && len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	switch {
+	case export == "csv":
+		exportCSV(matches)
+	case export == "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if matches == nil {
+			matches = []history.Record{}
+		}
+		_ = encoder.Encode(matches)
+	case export != "":
+		exit(exitUsage, log.Error().Str("export", export), "Unknown export format")
+	case events != nil:
+		for _, record := range matches {
+			emit(historyEvent{header("history"), record})
+		}
+	default:
+		for _, record := range matches {
+			fmt.Println(formatRecord(record))
+		}
+	}
+}
+
+// Parse time given to --since or --until, which is zero if empty
+func parseHistoryTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration)
+	}
+	if parsed, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return parsed
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		exit(exitUsage, log.Error().Str("time", value), "Invalid time, use a date, RFC 3339 time or duration")
+	}
+	return parsed
+}
+
+// Format record as a single human-readable line
+func formatRecord(record history.Record) string {
+	peer := record.PeerAddr
+	if record.PeerFingerprint != "" {
+		peer += " (" + record.PeerFingerprint + ")"
+	}
+	line := fmt.Sprintf("%s %-7s %-6s %s %s, %d files, %d bytes, %.1fs, %s",
+		record.Time.Local().Format("2006-01-02 15:04:05"),
+		record.Direction,
+		record.Outcome,
+		record.Action,
+		record.Data,
+		len(record.Files),
+		record.Size,
+		record.Duration,
+		peer,
+	)
+	if record.Error != "" {
+		line += ": " + record.Error
+	}
+	return line
+}
+
+// Write records as CSV with one row per file, so that every hash can be
+// checked
+//
+// Records without files have a single row with empty file columns.
+func exportCSV(records []history.Record) {
+	writer := csv.NewWriter(os.Stdout)
+	_ = writer.Write([]string{
+		"time", "direction", "peer_addr", "peer_fingerprint", "session", "action", "data",
+		"size", "duration", "outcome", "error", "file", "file_size", "sha256", "deleted",
+	})
+	for _, record := range records {
+		row := []string{
+			record.Time.Format(time.RFC3339),
+			record.Direction,
+			record.PeerAddr,
+			record.PeerFingerprint,
+			record.Session,
+			record.Action,
+			record.Data,
+			strconv.FormatInt(record.Size, 10),
+			strconv.FormatFloat(record.Duration, 'f', 3, 64),
+			record.Outcome,
+			record.Error,
+		}
+		if len(record.Files) == 0 {
+			_ = writer.Write(append(row, "", "", "", ""))
+			continue
+		}
+		for _, file := range record.Files {
+			_ = writer.Write(append(row[:len(row):len(row)], file.Name, strconv.FormatInt(file.Size, 10), file.Hash, strconv.FormatBool(file.Deleted)))
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Fatal().Err(err).Msg("Error writing CSV")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/history"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+func TestRecordSyncPlan(t *testing.T) {
+	manifest := &transfer.Manifest{Files: []transfer.ManifestEntry{
+		{Name: "new.txt", Size: 3, Hash: "aa"},
+		{Name: "changed.txt", Size: 5, Hash: "bb"},
+		{Name: "same.txt", Size: 7, Hash: "cc"},
+	}}
+	offer := offerEvent{Action: "sync", Data: "docs", Size: 15, Files: []offerFile{
+		{"new.txt", 3, "aa"},
+		{"changed.txt", 5, "bb"},
+		{"same.txt", 7, "cc"},
+	}}
+
+	tests := []struct {
+		name  string
+		plan  *serialization.SyncPlan
+		files []history.File
+		size  int64
+	}{
+		{
+			name: "transferred and deleted",
+			plan: &serialization.SyncPlan{New: []string{"new.txt"}, Changed: []string{"changed.txt"}, Unchanged: 1, Delete: []string{"old.txt"}},
+			files: []history.File{
+				{Name: "new.txt", Size: 3, Hash: "aa"},
+				{Name: "changed.txt", Size: 5, Hash: "bb"},
+				{Name: "old.txt", Deleted: true},
+			},
+			size: 8,
+		},
+		{
+			name:  "unchanged",
+			plan:  &serialization.SyncPlan{Unchanged: 3},
+			files: []history.File{},
+		},
+		{
+			name:  "dry run",
+			plan:  &serialization.SyncPlan{New: []string{"new.txt"}, Delete: []string{"old.txt"}, DryRun: true},
+			files: []history.File{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			beginRecord(&config.Config{HistoryFile: "history.jsonl"}, history.Receive, "192.168.1.2:9797", "", "")
+			defer func() { session = nil }()
+			recordOffer(offer)
+			recordSyncPlan(test.plan, manifest)
+			if !reflect.DeepEqual(session.Files, test.files) || session.Size != test.size {
+				t.Errorf("expected files %+v of size %d, got %+v of size %d", test.files, test.size, session.Files, session.Size)
+			}
+			if session.Action != "sync" || session.Data != "docs" {
+				t.Errorf("expected offer action to be kept, got %q %q", session.Action, session.Data)
+			}
+		})
+	}
+}
+
+func TestRecordSyncPlanDisabled(t *testing.T) {
+	// Without a session, nothing is recorded
+	beginRecord(&config.Config{}, history.Receive, "192.168.1.2:9797", "", "")
+	recordSyncPlan(&serialization.SyncPlan{New: []string{"new.txt"}}, &transfer.Manifest{})
+	if session != nil {
+		t.Errorf("expected no session, got %+v", session)
+	}
+}
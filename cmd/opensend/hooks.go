@@ -0,0 +1,200 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Event emitted when a hook finishes
+type hookEvent struct {
+	eventHeader
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Session passed to hooks after an action is executed
+type hookSession struct {
+	parameters *serialization.Parameters
+	// Address of the sender's key exchange connection
+	senderAddr string
+	// Whether the sender connected through a relay, so that senderAddr
+	// is the relay's address
+	relayed   bool
+	sessionID string
+	destDir   string
+	// Received files
+	files *transfer.Manifest
+	// Files deleted by a sync action
+	deleted []string
+}
+
+// Run hooks in config which apply to the action and sender of session, one
+// after the other
+//
+// Failing hooks are only logged, as the transfer is already complete.
+func runHooks(cfg *config.Config, session hookSession) {
+	env := session.environ()
+	for _, hook := range cfg.Hooks {
+		if !hookApplies(hook, session) {
+			continue
+		}
+		log.Info().Str("command", hook.Command).Msg("Running hook")
+		err := runHook(hook, env, session.destDir)
+		if err != nil {
+			log.Warn().Err(err).Str("command", hook.Command).Msg("Hook failed")
+			emit(hookEvent{header("hook"), hook.Command, false, err.Error()})
+			continue
+		}
+		emit(hookEvent{eventHeader: header("hook"), Command: hook.Command, OK: true})
+	}
+}
+
+// Check whether hook is scoped to the action type and sender of session
+//
+// Senders are only identified by their address, which is not
+// authenticated. Hooks scoped to senders never run for senders using a
+// relay, as their address is that of the relay.
+func hookApplies(hook config.Hook, session hookSession) bool {
+	if len(hook.Actions) != 0 && !containsString(hook.Actions, session.parameters.ActionType) {
+		return false
+	}
+	if len(hook.Senders) == 0 {
+		return true
+	}
+	if session.relayed {
+		log.Info().Str("command", hook.Command).Msg("Skipping hook scoped to senders, as the sender used a relay")
+		return false
+	}
+	host, _, err := net.SplitHostPort(session.senderAddr)
+	if err != nil {
+		host = session.senderAddr
+	}
+	for _, sender := range hook.Senders {
+		if matchSender(sender, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether sender address host matches pattern, which is an address,
+// a glob or a CIDR range
+func matchSender(pattern string, host string) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(strings.SplitN(host, "%", 2)[0])
+		return ip != nil && network.Contains(ip)
+	}
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return matched
+}
+
+// Run command of hook in the shell with env added to the environment,
+// killing it if it exceeds its timeout
+//
+// Output of the command goes to stderr, so that it does not mix with
+// JSON events.
+func runHook(hook config.Hook, env []string, dir string) error {
+	ctx := context.Background()
+	if hook.Timeout != "" {
+		timeout, err := time.ParseDuration(hook.Timeout)
+		if err != nil {
+			return err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// Expand home directory at the start of command
+	command := hook.Command
+	if strings.HasPrefix(command, "~") {
+		if home, err := os.UserHomeDir(); err == nil {
+			command = home + command[1:]
+		}
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// Get environment variables describing session
+//
+// Lists of files, paths and hashes are separated by newlines, in the
+// same order. Received names cannot contain newlines, as manifests with
+// control characters in names are refused.
+func (session hookSession) environ() []string {
+	var names, paths, hashes []string
+	var size int64
+	if session.files != nil {
+		for _, entry := range session.files.Files {
+			names = append(names, entry.Name)
+			paths = append(paths, filepath.Join(session.destDir, filepath.FromSlash(entry.Name)))
+			hashes = append(hashes, entry.Hash)
+			size += entry.Size
+		}
+	}
+	host, _, err := net.SplitHostPort(session.senderAddr)
+	if err != nil {
+		host = session.senderAddr
+	}
+	return []string{
+		"OPENSEND_ACTION=" + session.parameters.ActionType,
+		"OPENSEND_DATA=" + session.parameters.ActionData,
+		"OPENSEND_SENDER=" + session.senderAddr,
+		"OPENSEND_SENDER_HOST=" + host,
+		"OPENSEND_SESSION=" + session.sessionID,
+		"OPENSEND_DEST_DIR=" + session.destDir,
+		"OPENSEND_FILE_COUNT=" + strconv.Itoa(len(names)),
+		"OPENSEND_SIZE=" + strconv.FormatInt(size, 10),
+		"OPENSEND_FILES=" + strings.Join(names, "\n"),
+		"OPENSEND_PATHS=" + strings.Join(paths, "\n"),
+		"OPENSEND_HASHES=" + strings.Join(hashes, "\n"),
+		"OPENSEND_DELETED=" + strings.Join(session.deleted, "\n"),
+	}
+}
+
+// Check whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
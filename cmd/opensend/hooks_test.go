@@ -0,0 +1,200 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+func TestMatchSender(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"192.168.1.2", "192.168.1.2", true},
+		{"192.168.1.2", "192.168.1.20", false},
+		{"192.168.1.*", "192.168.1.20", true},
+		{"192.168.1.*", "192.168.2.1", false},
+		{"192.168.1.0/24", "192.168.1.20", true},
+		{"192.168.1.0/24", "192.168.2.1", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"fe80::/10", "fe80::1%eth0", true},
+		{"fe80::/10", "2001:db8::1", false},
+		{"192.168.1.0/24", "laptop.local", false},
+		{"*.LOCAL", "laptop.local", true},
+		{"laptop.local", "desktop.local", false},
+	}
+	for _, test := range tests {
+		if match := matchSender(test.pattern, test.host); match != test.match {
+			t.Errorf("matchSender(%q, %q) = %v, expected %v", test.pattern, test.host, match, test.match)
+		}
+	}
+}
+
+func TestHookApplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    config.Hook
+		action  string
+		addr    string
+		relayed bool
+		applies bool
+	}{
+		{"unscoped", config.Hook{}, "file", "192.168.1.2:9797", false, true},
+		{"unscoped relayed", config.Hook{}, "file", "203.0.113.1:9797", true, true},
+		{"action", config.Hook{Actions: []string{"file", "dir"}}, "dir", "192.168.1.2:9797", false, true},
+		{"other action", config.Hook{Actions: []string{"file"}}, "sync", "192.168.1.2:9797", false, false},
+		{"sender", config.Hook{Senders: []string{"10.0.0.0/8", "192.168.1.0/24"}}, "file", "192.168.1.2:9797", false, true},
+		{"sender without port", config.Hook{Senders: []string{"192.168.1.2"}}, "file", "192.168.1.2", false, true},
+		{"IPv6 sender", config.Hook{Senders: []string{"fe80::/10"}}, "file", "[fe80::1%eth0]:9797", false, true},
+		{"other sender", config.Hook{Senders: []string{"192.168.1.0/24"}}, "file", "192.168.2.1:9797", false, false},
+		{"sender relayed", config.Hook{Senders: []string{"203.0.113.1"}}, "file", "203.0.113.1:9797", true, false},
+		{"action and sender", config.Hook{Actions: []string{"url"}, Senders: []string{"192.168.1.*"}}, "file", "192.168.1.2:9797", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := hookSession{
+				parameters: &serialization.Parameters{ActionType: test.action},
+				senderAddr: test.addr,
+				relayed:    test.relayed,
+			}
+			if applies := hookApplies(test.hook, session); applies != test.applies {
+				t.Errorf("expected %v, got %v", test.applies, applies)
+			}
+		})
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	destDir := t.TempDir()
+	tests := []struct {
+		name    string
+		session hookSession
+		env     []string
+	}{
+		{
+			name: "files",
+			session: hookSession{
+				parameters: &serialization.Parameters{ActionType: "dir", ActionData: "photos"},
+				senderAddr: "192.168.1.2:9797",
+				sessionID:  "abcd",
+				destDir:    destDir,
+				files: &transfer.Manifest{Files: []transfer.ManifestEntry{
+					{Name: "photos/a.jpg", Size: 3, Hash: "aa"},
+					{Name: "photos/b.jpg", Size: 5, Hash: "bb"},
+				}},
+			},
+			env: []string{
+				"OPENSEND_ACTION=dir",
+				"OPENSEND_DATA=photos",
+				"OPENSEND_SENDER=192.168.1.2:9797",
+				"OPENSEND_SENDER_HOST=192.168.1.2",
+				"OPENSEND_SESSION=abcd",
+				"OPENSEND_DEST_DIR=" + destDir,
+				"OPENSEND_FILE_COUNT=2",
+				"OPENSEND_SIZE=8",
+				"OPENSEND_FILES=photos/a.jpg\nphotos/b.jpg",
+				"OPENSEND_PATHS=" + filepath.Join(destDir, "photos", "a.jpg") + "\n" + filepath.Join(destDir, "photos", "b.jpg"),
+				"OPENSEND_HASHES=aa\nbb",
+				"OPENSEND_DELETED=",
+			},
+		},
+		{
+			name: "deleted",
+			session: hookSession{
+				parameters: &serialization.Parameters{ActionType: "sync", ActionData: "docs"},
+				senderAddr: "[fe80::1%eth0]:9797",
+				destDir:    destDir,
+				files:      &transfer.Manifest{},
+				deleted:    []string{"docs/old.txt", "docs/older.txt"},
+			},
+			env: []string{
+				"OPENSEND_ACTION=sync",
+				"OPENSEND_DATA=docs",
+				"OPENSEND_SENDER=[fe80::1%eth0]:9797",
+				"OPENSEND_SENDER_HOST=fe80::1%eth0",
+				"OPENSEND_SESSION=",
+				"OPENSEND_DEST_DIR=" + destDir,
+				"OPENSEND_FILE_COUNT=0",
+				"OPENSEND_SIZE=0",
+				"OPENSEND_FILES=",
+				"OPENSEND_PATHS=",
+				"OPENSEND_HASHES=",
+				"OPENSEND_DELETED=docs/old.txt\ndocs/older.txt",
+			},
+		},
+		{
+			name: "no files",
+			session: hookSession{
+				parameters: &serialization.Parameters{ActionType: "url", ActionData: "https://example.com"},
+				senderAddr: "192.168.1.2",
+				destDir:    destDir,
+			},
+			env: []string{
+				"OPENSEND_ACTION=url",
+				"OPENSEND_DATA=https://example.com",
+				"OPENSEND_SENDER=192.168.1.2",
+				"OPENSEND_SENDER_HOST=192.168.1.2",
+				"OPENSEND_SESSION=",
+				"OPENSEND_DEST_DIR=" + destDir,
+				"OPENSEND_FILE_COUNT=0",
+				"OPENSEND_SIZE=0",
+				"OPENSEND_FILES=",
+				"OPENSEND_PATHS=",
+				"OPENSEND_HASHES=",
+				"OPENSEND_DELETED=",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if env := test.session.environ(); !reflect.DeepEqual(env, test.env) {
+				t.Errorf("expected %q, got %q", test.env, env)
+			}
+		})
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run in cmd on windows")
+	}
+	dir := t.TempDir()
+	env := []string{"OPENSEND_ACTION=file"}
+	// Command gets environment and runs in destination directory
+	err := runHook(config.Hook{Command: `test "$OPENSEND_ACTION" = file && test "$(pwd -P)" = "$(cd ` + dir + ` && pwd -P)"`}, env, dir)
+	if err != nil {
+		t.Errorf("expected hook to succeed, got %v", err)
+	}
+	if err := runHook(config.Hook{Command: "exit 3"}, env, dir); err == nil {
+		t.Error("expected failing hook to return error")
+	}
+	if err := runHook(config.Hook{Command: "exec sleep 5", Timeout: "50ms"}, env, dir); err == nil {
+		t.Error("expected hook exceeding timeout to return error")
+	}
+	if err := runHook(config.Hook{Command: "true", Timeout: "soon"}, env, dir); err == nil {
+		t.Error("expected invalid timeout to return error")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/crypto"
+)
+
+// Show fingerprint of this device's identity, or replace the identity
+// with a new one
+func keysCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addConfigFlags(fs, opts)
+	args = parseFlags(fs, args, 1)
+	cfg := opts.loadConfig(roleReceiver)
+	path := config.ExpandPath(cfg.IdentityFile)
+	action := "show"
+	if len(args) == 1 {
+		action = args[0]
+	}
+	switch action {
+	case "show":
+	case "reset":
+		// Remove identity, so that a new one is generated when loading it
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal().Err(err).Msg("Error removing identity")
+		}
+		log.Warn().Msg("Identity replaced, senders which paired with the old fingerprint will refuse this device")
+	default:
+		fs.Usage()
+		exit(exitUsage, log.Error().Str("action", action), "Unknown keys action")
+	}
+	// Load identity, generating it if needed, and print its fingerprint
+	identity := crypto.LoadIdentity(path)
+	if events != nil {
+		emit(identityEvent{header("identity"), identity.Fingerprint(), path})
+		return
+	}
+	fmt.Println(identity.Fingerprint(), path)
+}
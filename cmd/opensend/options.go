@@ -0,0 +1,327 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/crypto"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Roles deciding which config section listening flags apply to
+const (
+	roleSender = iota
+	roleReceiver
+	roleRelay
+)
+
+// Values of flags given to a command
+//
+// Each command only registers the flags it supports, so the others keep
+// their zero values.
+type options struct {
+	configPath  string
+	workDir     string
+	destDir     string
+	port        int
+	bind        string
+	randomPort  bool
+	limit       string
+	beaconPort  int
+	skipMdns    bool
+	relay       string
+	code        string
+	transport   string
+	listen      bool
+	connect     string
+	qr          bool
+	streams     int
+	delta       bool
+	compression string
+	pad         bool
+	web         bool
+	webUpload   bool
+	actionType  string
+	actionData  string
+	sendTo      string
+	target      string
+	to          string
+	first       bool
+	waitFor     string
+	timeout     time.Duration
+	fromQR      string
+	deleteFiles bool
+	dryRun      bool
+	watch       bool
+	// Whether --to may name a target from config, as for sync
+	toTarget bool
+
+	// Port of receiver's key exchange listener, set from target or --send-to
+	receiverPort int
+	// Pairing from --from-qr, if given
+	pairing *transfer.Pairing
+}
+
+// Add --config flag
+func addConfigFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.configPath, "config", "", "Opensend config to use")
+}
+
+// Add flags selecting the listening address
+func addListenFlags(fs *flag.FlagSet, opts *options) {
+	fs.IntVar(&opts.port, "port", 0, "Port to listen on (default from config)")
+	fs.StringVar(&opts.bind, "bind", "", "Address to listen on (default from config, all addresses if empty)")
+	fs.BoolVar(&opts.randomPort, "random-port", false, "Listen on a random free port")
+}
+
+// Add flags shared by commands transferring files
+func addTransferFlags(fs *flag.FlagSet, opts *options) {
+	addConfigFlags(fs, opts)
+	addListenFlags(fs, opts)
+	fs.StringVar(&opts.workDir, "work-dir", "", "Working directory for opensend")
+	fs.StringVar(&opts.limit, "limit", "", "Maximum transfer rate, such as 20MB/s or unlimited (default from config)")
+	fs.IntVar(&opts.beaconPort, "beacon-port", 0, "UDP port for beacon discovery (default from config)")
+	fs.StringVar(&opts.relay, "relay", "", "Address of relay server to connect through, such as relay.example.com:9900 (default from config)")
+	fs.StringVar(&opts.code, "code", "", "Session code shared by sender and receiver (generated by receiver if empty)")
+	fs.StringVar(&opts.connect, "connect", "", "Make all connections to the other side at the given address and optional port, instead of accepting any")
+	fs.BoolVar(&opts.qr, "qr", false, "Show a QR code containing address, port, session code and fingerprint, or the link in web modes")
+}
+
+// Read config file and override it with flags, applying listening flags
+// to the config section of role
+func (opts *options) loadConfig(role int) *config.Config {
+	// If config flag not provided, find config, otherwise read config at provided path
+	path := opts.configPath
+	if path == "" {
+		path = config.GetConfigPath()
+	}
+	cfg := config.NewConfig(path)
+
+	// If work directory flag not provided, use the one of role
+	if opts.workDir == "" {
+		opts.workDir = config.ExpandPath(cfg.Receiver.WorkDir)
+		if role == roleSender {
+			opts.workDir = config.ExpandPath(cfg.Sender.WorkDir)
+		}
+	}
+	// If destination directory flag not provided, use the one from config
+	if opts.destDir == "" {
+		opts.destDir = config.ExpandPath(cfg.Receiver.DestDir)
+	}
+
+	// If streams flag provided
+	if opts.streams != 0 {
+		// Override number of streams from config
+		cfg.Receiver.Streams = opts.streams
+	}
+	// If compression flag provided
+	if opts.compression != "" {
+		// Override compression from config
+		cfg.Sender.Compression = opts.compression
+	}
+	// If delta flag provided
+	if opts.delta {
+		// Override delta transfers from config
+		cfg.Receiver.Delta = true
+	}
+	// If pad flag provided
+	if opts.pad {
+		// Override padding from config
+		cfg.Sender.Padding = true
+	}
+	// If beacon port flag provided
+	if opts.beaconPort != 0 {
+		// Override beacon port from config
+		cfg.Discovery.BeaconPort = opts.beaconPort
+	}
+
+	// Make sure session code given by the user cannot be guessed
+	if opts.code != "" {
+		if err := transfer.CheckCode(opts.code); err != nil {
+			exit(exitUsage, log.Error().Err(err), "Session code too weak, use the code generated by the receiver")
+		}
+	}
+	// If relay flag provided
+	if opts.relay != "" {
+		// Override relay address from config
+		cfg.Relay.Address = opts.relay
+	}
+	// If pairing from QR code provided
+	if opts.fromQR != "" {
+		// Pairing replaces other ways to find the receiver
+		if opts.sendTo != "" || opts.target != "" || opts.relay != "" || opts.listen || opts.connect != "" {
+			exit(exitUsage, log.Error(), "--from-qr cannot be used with --send-to, --target, --relay, --listen or --connect")
+		}
+		// Parse pairing
+		pairing, err := transfer.ParsePairing(strings.TrimSpace(opts.fromQR))
+		if err != nil {
+			exit(exitUsage, log.Error().Err(err), "Invalid pairing")
+		}
+		opts.pairing = &pairing
+		// Use relay of pairing, if any, instead of the configured one
+		cfg.Relay.Address = ""
+		if pairing.Relay {
+			cfg.Relay.Address = transfer.JoinHostPort(pairing.Addrs[0], pairing.Port)
+		}
+		// Use session code of pairing unless one is given
+		if opts.code == "" {
+			opts.code = pairing.Code
+		}
+	}
+	// If a relay is used by a client
+	if cfg.Relay.Address != "" && role != roleRelay {
+		// Add default port to relay address if missing
+		cfg.Relay.Address = relayAddress(cfg.Relay.Address)
+		// Receivers are found using the session code, so do not advertise them
+		opts.skipMdns = true
+		cfg.Discovery.Beacon = false
+	}
+
+	// Make sure connection direction is not set twice
+	if opts.listen && opts.connect != "" {
+		exit(exitUsage, log.Error(), "--listen and --connect cannot be used together")
+	}
+	// Make sure a listening sender knows the session code, as the shared
+	// key would otherwise be sent to whoever connects first
+	if opts.listen && opts.code == "" {
+		exit(exitUsage, log.Error(), "Session code is required to listen for the receiver, use --code on both sides")
+	}
+	// Make sure connection direction is not set along with a relay, as both sides connect to it
+	if cfg.Relay.Address != "" && role != roleRelay && (opts.listen || opts.connect != "") {
+		exit(exitUsage, log.Error(), "--listen and --connect cannot be used with a relay")
+	}
+	// Pairings contain the address senders connect to
+	if opts.qr && role == roleReceiver && opts.connect != "" {
+		exit(exitUsage, log.Error(), "--qr cannot be used with --connect")
+	}
+	// If transport flag provided
+	if opts.transport != "" {
+		// Override transport from config
+		cfg.Sender.Transport = opts.transport
+	}
+	// Make sure transport is known
+	if cfg.Sender.Transport != transfer.TransportTCP && cfg.Sender.Transport != transfer.TransportQUIC {
+		exit(exitUsage, log.Error().Str("transport", cfg.Sender.Transport), "Unknown transport")
+	}
+	// QUIC needs the receiver to reach the sender directly
+	if role == roleSender && cfg.Sender.Transport == transfer.TransportQUIC && (cfg.Relay.Address != "" || opts.connect != "") {
+		exit(exitUsage, log.Error(), "QUIC transport cannot be used with a relay or --connect")
+	}
+
+	// Get listening settings of role
+	listenCfg, bindCfg := &cfg.Receiver.Port, &cfg.Receiver.Bind
+	switch role {
+	case roleSender:
+		listenCfg, bindCfg = &cfg.Sender.Port, &cfg.Sender.Bind
+	case roleRelay:
+		listenCfg, bindCfg = &cfg.Relay.Port, &cfg.Relay.Bind
+	}
+	// If port flag provided
+	if opts.port != 0 {
+		// Override port from config
+		*listenCfg = opts.port
+	}
+	// If random port flag provided
+	if opts.randomPort {
+		// Port 0 makes the OS pick a free port
+		*listenCfg = 0
+	}
+	// If bind flag provided
+	if opts.bind != "" {
+		// Override bind address from config
+		*bindCfg = opts.bind
+	}
+
+	// If --to names a target from config, use that target
+	if _, ok := cfg.Targets[opts.to]; opts.toTarget && ok {
+		opts.target, opts.to = opts.to, ""
+	}
+	// Set port of receiver's key exchange listener to default
+	opts.receiverPort = transfer.KeyExchangePort
+	// If target flag provided
+	if opts.target != "" {
+		// Get target from config
+		target, ok := cfg.Targets[opts.target]
+		if !ok {
+			exit(exitUsage, log.Error().Str("target", opts.target), "Unknown target")
+		}
+		// Set IP to target's IP
+		opts.sendTo = target.IP
+		// If target has a port, use it
+		if target.Port != 0 {
+			opts.receiverPort = target.Port
+		}
+		// If target has a rate limit, use it
+		if target.Limit != "" {
+			cfg.Limit.Rate = target.Limit
+		}
+	}
+	// If sender connects to receiver
+	if role == roleSender && opts.connect != "" {
+		// Connect to given receiver, skipping discovery
+		opts.sendTo = opts.connect
+	}
+	// If limit flag provided
+	if opts.limit != "" {
+		// Override rate limit from config
+		cfg.Limit.Rate = opts.limit
+	}
+	return cfg
+}
+
+// Get compression of sent files from config
+func compressionConfig(cfg *config.Config) crypto.Compression {
+	compression, err := crypto.ParseCompression(cfg.Sender.Compression)
+	if err != nil {
+		exit(exitUsage, log.Error().Err(err).Str("compression", cfg.Sender.Compression), "Invalid compression")
+	}
+	return compression
+}
+
+// Create work directory, removing it when SIGINT or SIGTERM is received
+func prepareWorkDir(workDir string) {
+	// Create channel for signals
+	sig := make(chan os.Signal, 1)
+	// Send message on channel upon reception of SIGINT or SIGTERM
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	// Intercept signal
+	go func() {
+		signal := <-sig
+		// Remove opensend directory to avoid future conflicts
+		_ = os.RemoveAll(workDir)
+		// Record interrupted session as failed and exit, notifying user
+		exit(exitInterrupted, log.Warn().Str("signal", signal.String()), "Interrupted by "+signal.String())
+	}()
+	// Create opensend dir ignoring errors
+	_ = os.Mkdir(workDir, 0755)
+}
+
+// Remove work directory after a session
+func removeWorkDir(workDir string) {
+	err := os.RemoveAll(workDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error removing opensend directory")
+	}
+}
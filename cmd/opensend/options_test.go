@@ -0,0 +1,77 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/history"
+)
+
+func TestPrepareWorkDirInterrupt(t *testing.T) {
+	// Interrupt session in a subprocess, as interrupting exits
+	if dir := os.Getenv("OPENSEND_TEST_INTERRUPT"); dir != "" {
+		output = "json"
+		setupOutput()
+		beginRecord(&config.Config{HistoryFile: filepath.Join(dir, "history.jsonl")}, history.Receive, "192.168.1.2:9797", "", "")
+		prepareWorkDir(filepath.Join(dir, "work"))
+		_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+		time.Sleep(10 * time.Second)
+		os.Exit(exitOK)
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPrepareWorkDirInterrupt$")
+	cmd.Env = append(os.Environ(), "OPENSEND_TEST_INTERRUPT="+dir)
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitInterrupted {
+		t.Fatalf("expected exit code %d, got %v", exitInterrupted, err)
+	}
+
+	// Check error event on stdout
+	var event errorEvent
+	if err := json.Unmarshal(stdout.Bytes(), &event); err != nil {
+		t.Fatalf("invalid error event %q: %v", stdout.String(), err)
+	}
+	if event.Event != "error" || event.Code != exitInterrupted || event.Message != "Interrupted by interrupt" {
+		t.Errorf("unexpected error event %+v", event)
+	}
+
+	// Check work directory is removed and session is recorded as failed
+	if _, err := os.Stat(filepath.Join(dir, "work")); !os.IsNotExist(err) {
+		t.Errorf("expected work directory to be removed, got %v", err)
+	}
+	records, err := history.Read(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Outcome != history.Failed || records[0].Error != "Interrupted by interrupt" {
+		t.Errorf("unexpected history %+v", records)
+	}
+}
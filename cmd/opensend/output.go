@@ -0,0 +1,194 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Output format given by --output, text or json
+var output string
+
+// Encoder of JSON-lines events on stdout, nil unless --output json is given
+//
+// Log messages are still written to stderr, so that stdout only contains
+// events. The field names of events are stable.
+var events *json.Encoder
+
+// Fields common to all events
+type eventHeader struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+// Event emitted when listening for the other side
+type listeningEvent struct {
+	eventHeader
+	Addr string `json:"addr"`
+	// Session code the other side needs, if any
+	Code string `json:"code,omitempty"`
+	// Link to the page in web modes
+	URL string `json:"url,omitempty"`
+}
+
+// Event emitted when key exchange is complete
+type handshakeEvent struct {
+	eventHeader
+	Role    string `json:"role"`
+	Peer    string `json:"peer"`
+	Session string `json:"session"`
+	// Fingerprint of the receiver's identity
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Event emitted when files are offered, by the sender once they are
+// encrypted and by the receiver once it has read the parameters
+type offerEvent struct {
+	eventHeader
+	Role   string      `json:"role"`
+	Action string      `json:"action"`
+	Data   string      `json:"data"`
+	Files  []offerFile `json:"files"`
+	Size   int64       `json:"size"`
+}
+
+// File in an offer
+type offerFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"sha256"`
+}
+
+// Event emitted whenever data is written to a received file
+type progressEvent struct {
+	eventHeader
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	Done int64  `json:"done"`
+}
+
+// Event emitted when the hash of a received file is checked
+type verifiedEvent struct {
+	eventHeader
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	Hash string `json:"sha256"`
+}
+
+// Event emitted when the receiver reports its sync plan
+type syncPlanEvent struct {
+	eventHeader
+	New       []string `json:"new"`
+	Changed   []string `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+	Delete    []string `json:"delete"`
+	DryRun    bool     `json:"dry_run"`
+}
+
+// Event emitted at the end of a successful session
+type summaryEvent struct {
+	eventHeader
+	Role         string  `json:"role"`
+	Action       string  `json:"action"`
+	Files        int     `json:"files"`
+	Size         int64   `json:"size"`
+	Received     int64   `json:"received"`
+	Deduplicated int64   `json:"deduplicated"`
+	Duration     float64 `json:"duration"`
+	OK           bool    `json:"ok"`
+}
+
+// Event emitted by the config command
+type configEvent struct {
+	eventHeader
+	Path   string         `json:"path"`
+	Config *config.Config `json:"config,omitempty"`
+}
+
+// Event emitted by the keys command
+type identityEvent struct {
+	eventHeader
+	Fingerprint string `json:"fingerprint"`
+	Path        string `json:"path"`
+}
+
+// Event emitted before exiting because of an error
+type errorEvent struct {
+	eventHeader
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// Enable JSON events if --output json is given
+func setupOutput() {
+	switch output {
+	case "text":
+	case "json":
+		events = json.NewEncoder(os.Stdout)
+		// Report fatal errors, which exit with exitError
+		log.Logger = log.Logger.Hook(zerolog.HookFunc(func(_ *zerolog.Event, level zerolog.Level, msg string) {
+			if level == zerolog.FatalLevel {
+				emit(errorEvent{header("error"), msg, exitError})
+			}
+		}))
+	default:
+		exit(exitUsage, log.Error().Str("output", output), "Unknown output format")
+	}
+}
+
+// Create header of event with the current time
+func header(event string) eventHeader {
+	return eventHeader{Event: event, Time: time.Now()}
+}
+
+// Write event as a single JSON line if JSON output is enabled
+func emit(event interface{}) {
+	if events == nil {
+		return
+	}
+	_ = events.Encode(event)
+}
+
+// Create offer event listing files of manifest, except parameters
+func newOfferEvent(role string, parameters *serialization.Parameters, manifest *transfer.Manifest) offerEvent {
+	event := offerEvent{eventHeader: header("offer"), Role: role, Action: parameters.ActionType, Data: parameters.ActionData, Files: []offerFile{}}
+	for _, entry := range manifest.Files {
+		if entry.Name == serialization.ParametersFile {
+			continue
+		}
+		event.Files = append(event.Files, offerFile{entry.Name, entry.Size, entry.Hash})
+		event.Size += entry.Size
+	}
+	return event
+}
+
+// Emit progress and verification of received files
+func emitProgress(progress transfer.FileProgress) {
+	if progress.Verified {
+		emit(verifiedEvent{header("verified"), progress.Name, progress.Size, progress.Hash})
+		return
+	}
+	emit(progressEvent{header("progress"), progress.Name, progress.Size, progress.Done})
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/crypto"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Maximum number of addresses in a pairing, to keep QR codes scannable
+const maxPairingAddrs = 3
+
+// Show pairing of this receiver, listening for key exchange on listener
+// or on the relay, as a QR code and as text for --from-qr
+func showPairing(cfg *config.Config, identity *crypto.Identity, listener net.Listener, code string) {
+	pairing := transfer.Pairing{Code: code, Fingerprint: identity.Fingerprint()}
+	// If a relay is used, senders must connect to it
+	if cfg.Relay.Address != "" {
+		host, port, _ := transfer.ParseHost(cfg.Relay.Address)
+		pairing.Addrs, pairing.Port, pairing.Relay = []string{host}, port, true
+	} else {
+		pairing.Addrs, pairing.Port = localHosts(cfg.Receiver.Bind), transfer.ListenerPort(listener)
+		if len(pairing.Addrs) > maxPairingAddrs {
+			pairing.Addrs = pairing.Addrs[:maxPairingAddrs]
+		}
+	}
+	printQR(pairing.String())
+	log.Info().Str("pairing", pairing.String()).Msg("Scan QR code or use --from-qr to send")
+}
+
+// Print data as a QR code on the terminal
+//
+// Two rows of modules are printed per line using half blocks. Light
+// modules are drawn, so that the code shows up on dark terminals.
+func printQR(data string) {
+	code, err := qrcode.New(data, qrcode.Low)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error creating QR code")
+	}
+	bitmap := code.Bitmap()
+	var builder strings.Builder
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			// Modules below the last row are light
+			top, bottom := !bitmap[y][x], y+1 == len(bitmap) || !bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				builder.WriteString("█")
+			case top:
+				builder.WriteString("▀")
+			case bottom:
+				builder.WriteString("▄")
+			default:
+				builder.WriteString(" ")
+			}
+		}
+		builder.WriteString("\n")
+	}
+	fmt.Fprint(os.Stderr, builder.String())
+}
@@ -0,0 +1,446 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/crypto"
+	"go.arsenm.dev/opensend/internal/history"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Add flags of receive and daemon commands
+func addReceiveFlags(fs *flag.FlagSet, opts *options) {
+	addTransferFlags(fs, opts)
+	fs.StringVar(&opts.destDir, "dest-dir", "", "Destination directory for files or dirs sent over opensend")
+	fs.BoolVar(&opts.skipMdns, "skip-mdns", false, "Skip zeroconf service registration (use if mdns fails)")
+	fs.IntVar(&opts.streams, "streams", 0, "Number of parallel streams used to receive files (default from config, 0 tunes automatically)")
+	fs.BoolVar(&opts.delta, "delta", false, "Receive only changed blocks of files which already exist in the destination directory")
+}
+
+// Receive a single transfer
+func receiveCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addReceiveFlags(fs, opts)
+	fs.BoolVar(&opts.webUpload, "web-upload", false, "Accept files from browsers on a local HTTPS page protected by a one-time code")
+	parseFlags(fs, args, 0)
+	cfg := opts.loadConfig(roleReceiver)
+	// Create limiter from rate and schedule
+	limiter := newLimiter(cfg)
+	// Create opensend dir
+	prepareWorkDir(opts.workDir)
+	// If files are received from browsers
+	if opts.webUpload {
+		// Browsers cannot use a relay or be connected to
+		if cfg.Relay.Address != "" || opts.connect != "" {
+			exit(exitUsage, log.Error(), "--web-upload cannot be used with a relay or --connect")
+		}
+		// Serve upload page until killed
+		serveWebUpload(cfg, opts.workDir, opts.destDir, opts.code, opts.qr, limiter)
+	}
+	err := receiveSession(cfg, opts, loadIdentity(cfg), sessionCode(cfg, opts), limiter)
+	if err != nil {
+		exit(exitError, log.Error().Err(err), "Error receiving transfer")
+	}
+}
+
+// Receive transfers until killed
+func daemonCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addReceiveFlags(fs, opts)
+	parseFlags(fs, args, 0)
+	// A daemon must accept connections from every sender
+	if opts.connect != "" {
+		exit(exitUsage, log.Error(), "--connect cannot be used with daemon")
+	}
+	cfg := opts.loadConfig(roleReceiver)
+	// Create limiter from rate and schedule
+	limiter := newLimiter(cfg)
+	// Create opensend dir
+	prepareWorkDir(opts.workDir)
+	// Load persistent identity and get session code once, so that they stay the same
+	identity := loadIdentity(cfg)
+	code := sessionCode(cfg, opts)
+	for {
+		// Keep receiving transfers if a session fails, so that a single
+		// sender cannot stop the daemon
+		err := receiveSession(cfg, opts, identity, code, limiter)
+		if err != nil {
+			log.Error().Err(err).Msg("Error receiving transfer, waiting for next sender")
+			emit(errorEvent{header("error"), err.Error(), exitError})
+		}
+	}
+}
+
+// Get session code from flags, generating one if a relay or --qr needs it
+func sessionCode(cfg *config.Config, opts *options) string {
+	// Get session code used to meet senders on the relay, if any
+	code := relayCode(cfg, opts.code)
+	// Pairings contain a session code, so that senders can check this receiver
+	if opts.qr && code == "" {
+		code = transfer.GenerateCode()
+	}
+	return code
+}
+
+// Wait for a sender, or connect to it if --connect is given, then receive
+// its files and execute their action
+//
+// Errors caused by the sender are returned, and the session is recorded
+// as failed in history.
+func receiveSession(cfg *config.Config, opts *options, identity *crypto.Identity, code string, limiter *transfer.Limiter) error {
+	// Create opensend dir ignoring errors
+	_ = os.Mkdir(opts.workDir, 0755)
+	// Remove opensend directory at the end of the session, so that files
+	// of a failed session are not delivered by the next one
+	defer removeWorkDir(opts.workDir)
+	// Notify user keypair is being generated
+	log.Info().Msg("Generating RSA keypair")
+	// Generate keypair
+	privateKey, publicKey := crypto.GenerateRSAKeypair()
+	// Declare key exchange listener and connection
+	var listener net.Listener
+	var connection net.Conn
+	// If receiver connects to sender
+	var err error
+	if opts.connect != "" {
+		// Connect to sender, which listens for key exchange on its transfer port
+		connection, err = dialSender(opts.connect)
+	} else {
+		// Start key exchange listener before advertising it
+		listener = keyExchangeListener(cfg, code)
+		// Stop listening at the end of the session
+		defer listener.Close()
+		// Accept key exchange connection while advertising listener
+		connection, err = advertiseAndAccept(cfg, opts, identity, listener, code)
+	}
+	if err != nil {
+		return err
+	}
+	// Close key exchange connection at the end of the session
+	defer connection.Close()
+	// Exchange keys with sender
+	senderAddr, offer, encryptedKey, err := crypto.ReceiverKeyExchange(connection, publicKey, identity, code, serialization.ActionTypes())
+	if err != nil {
+		return fmt.Errorf("key exchange: %w", err)
+	}
+	// Stop listening, unless sender connects for transfer
+	if listener != nil && senderAddr != "" {
+		listener.Close()
+	}
+	// Decrypt shared key
+	sharedKey, err := crypto.DecryptKey(encryptedKey, privateKey)
+	if err != nil {
+		return err
+	}
+	// Inform user key exchange is complete
+	log.Info().Str("session", crypto.SessionID(sharedKey)).Msg("Key exchange complete")
+	emit(handshakeEvent{eventHeader: header("handshake"), Role: "receiver", Peer: connection.RemoteAddr().String(), Session: crypto.SessionID(sharedKey)})
+	// Senders have no identity, so there is no fingerprint to record
+	beginRecord(cfg, history.Receive, connection.RemoteAddr().String(), "", crypto.SessionID(sharedKey))
+	// Receive files from sender and execute action
+	sender, err := newSender(cfg, senderAddr, offer, code, sharedKey, listener)
+	if err == nil {
+		err = receiveFiles(sender, connection.RemoteAddr().String(), sharedKey, cfg, opts.workDir, opts.destDir, limiter)
+	}
+	if err != nil {
+		finishRecord(history.Failed, err.Error())
+		return err
+	}
+	return nil
+}
+
+// Advertise key exchange listener using mDNS and beacons, as enabled, until
+// a sender connects to it, and return the sender's connection
+func advertiseAndAccept(cfg *config.Config, opts *options, identity *crypto.Identity, listener net.Listener, code string) (net.Conn, error) {
+	// Notify user of listening address
+	log.Info().Str("addr", listener.Addr().String()).Msg("Listening for key exchange")
+	emit(listeningEvent{eventHeader: header("listening"), Addr: listener.Addr().String(), Code: code})
+	// If --qr is given, show pairing
+	if opts.qr {
+		showPairing(cfg, identity, listener, code)
+	}
+	// If --skip-mdns is not given
+	if !opts.skipMdns {
+		// Register {hostname}._opensend._tcp.local. mDNS service, shutting it down
+		// as connection will be unavailable during transfer
+		zeroconfShutdown := transfer.RegisterService(identity.Fingerprint(), transfer.ListenerPort(listener), transfer.BindInterfaces(cfg.Receiver.Bind))
+		defer zeroconfShutdown()
+	}
+	// If beacon discovery is enabled
+	if cfg.Discovery.Beacon {
+		// Answer beacon queries until a sender connects
+		beaconShutdown := transfer.StartBeacon(cfg.Receiver.Bind, cfg.Discovery.BeaconPort, transfer.ListenerPort(listener), identity.PrivateKey)
+		defer beaconShutdown()
+	}
+	// Notify user opensend is waiting for key exchange
+	log.Info().Msg("Waiting for sender key exchange")
+	// Accept key exchange connection from sender
+	return acceptSender(listener)
+}
+
+// Receive files from sender at peerAddr using shared key, then execute
+// their action and run hooks
+//
+// The sender is told to stop serving files, even if receiving them fails.
+func receiveFiles(sender *transfer.Sender, peerAddr string, sharedKey string, cfg *config.Config, workDir string, destDir string, limiter *transfer.Limiter) error {
+	start := time.Now()
+	// Send stop signal to sender's HTTP server once, when done or on error
+	stopSender := sync.OnceFunc(func() { transfer.SendSrvStopSignal(sender) })
+	defer stopSender()
+	// Notify user files are being received
+	log.Info().Msg("Receiving files from server (This may take a while)")
+	// Get and decrypt manifest of files offered by sender
+	encryptedIndex, err := transfer.GetIndex(sender)
+	if err != nil {
+		return err
+	}
+	index, err := crypto.DecryptBytes(encryptedIndex, sharedKey, nil)
+	if err != nil {
+		return fmt.Errorf("decrypting manifest: %w", err)
+	}
+	manifest, err := transfer.ParseManifest(index)
+	if err != nil {
+		return err
+	}
+	// Create codec decrypting received chunks
+	codec := crypto.NewChunkCodec(sharedKey, crypto.Compression{})
+	// Split parameters from files
+	isParameters := func(entry transfer.ManifestEntry) bool {
+		return entry.Name == serialization.ParametersFile
+	}
+	files := manifest.Filter(func(entry transfer.ManifestEntry) bool {
+		return !isParameters(entry)
+	})
+	// Get parameters first, as they decide which files are needed
+	_, err = transfer.RecvFiles(sender, manifest.Filter(isParameters), workDir, cfg.Receiver.Streams, codec, limiter, nil, nil)
+	if err != nil {
+		return fmt.Errorf("receiving parameters: %w", err)
+	}
+	// Instantiate Config
+	parameters := &serialization.Parameters{}
+	// Read config file in opensend directory
+	err = parameters.ReadFile(filepath.Join(workDir, serialization.ParametersFile), sharedKey)
+	if err != nil {
+		return fmt.Errorf("reading parameters: %w", err)
+	}
+	// Refuse unsupported actions before receiving their files
+	if _, ok := serialization.LookupAction(parameters.ActionType); !ok {
+		return fmt.Errorf("unsupported action type %q, supported: %s", parameters.ActionType, strings.Join(serialization.ActionTypes(), ", "))
+	}
+	log.Info().Str("action", parameters.Describe()).Msg("Received offer")
+	offer := newOfferEvent("receiver", parameters, files)
+	emit(offer)
+	recordOffer(offer)
+	// Create variable for files deleted by a sync action
+	var deleted []string
+	// If action is sync
+	if parameters.ActionType == "sync" {
+		// Compare offered files with destination directory
+		plan, err := parameters.PlanSync(files, destDir)
+		if err != nil {
+			return fmt.Errorf("planning sync: %w", err)
+		}
+		// Report plan to sender, which replies with the manifest of the files it encoded
+		reply, err := transfer.SendReport(sender, plan.Marshal())
+		if err != nil {
+			return err
+		}
+		// Only record files the plan transfers or deletes
+		recordSyncPlan(plan, files)
+		// If only a dry run was requested, stop without changing anything
+		if plan.DryRun {
+			log.Info().Msg("Dry run, not syncing")
+			emit(summaryEvent{eventHeader: header("summary"), Role: "receiver", Action: parameters.ActionType, Duration: time.Since(start).Seconds(), OK: true})
+			finishRecord(history.OK, "")
+			return nil
+		}
+		// Only receive new and changed files
+		encoded, err := crypto.DecryptBytes(reply, sharedKey, nil)
+		if err != nil {
+			return fmt.Errorf("decrypting sync manifest: %w", err)
+		}
+		encodedFiles, err := transfer.ParseManifest(encoded)
+		if err != nil {
+			return err
+		}
+		files = encodedFiles.Filter(plan.Needs)
+		deleted = plan.Delete
+	}
+	// Get files from sender in parallel, decrypting them into the opensend directory
+	summary, err := transfer.RecvFiles(sender, files, workDir, cfg.Receiver.Streams, codec, limiter, deltaBasis(cfg, destDir), emitProgress)
+	if err != nil {
+		return fmt.Errorf("receiving files: %w", err)
+	}
+	// Log session summary with deduplication savings
+	log.Info().
+		Int("files", summary.Files).
+		Int64("size", summary.Size).
+		Int64("received", summary.Received).
+		Int64("deduplicated", summary.Deduplicated).
+		Msg("Session summary")
+	// Send stop signal to sender's HTTP server
+	stopSender()
+	// Notify user that action is being executed
+	log.Info().Msg("Executing action")
+	// Execute MessagePack action using files within opensend directory
+	if err := parameters.ExecuteAction(workDir, destDir); err != nil {
+		return fmt.Errorf("executing action: %w", err)
+	}
+	emit(summaryEvent{
+		eventHeader:  header("summary"),
+		Role:         "receiver",
+		Action:       parameters.ActionType,
+		Files:        summary.Files,
+		Size:         summary.Size,
+		Received:     summary.Received,
+		Deduplicated: summary.Deduplicated,
+		Duration:     time.Since(start).Seconds(),
+		OK:           true,
+	})
+	finishRecord(history.OK, "")
+	// Run hooks configured for this action and sender
+	runHooks(cfg, hookSession{
+		parameters: parameters,
+		senderAddr: peerAddr,
+		relayed:    cfg.Relay.Address != "",
+		sessionID:  crypto.SessionID(sharedKey),
+		destDir:    destDir,
+		files:      files,
+		deleted:    deleted,
+	})
+	return nil
+}
+
+// Connect to sender's HTTPS server at senderAddr using the transport
+// it offered, or through the relay if one is used, authenticated using
+// the shared key
+//
+// If senderAddr is empty, the sender connects to listener instead.
+func newSender(cfg *config.Config, senderAddr string, offer crypto.TransferOffer, code string, sharedKey string, listener net.Listener) (*transfer.Sender, error) {
+	tlsConfig := crypto.SessionTLSConfig(sharedKey, false)
+	if cfg.Relay.Address != "" {
+		return transfer.NewRelaySender(cfg.Relay.Address, transfer.RelayChannel(code, "transfer"), tlsConfig), nil
+	}
+	if senderAddr == "" {
+		// Make sure there is a listener the sender can connect to
+		if listener == nil {
+			return nil, errors.New("sender asked to connect to receiver, but receiver is not listening, use --listen on the sender")
+		}
+		log.Info().Msg("Sender connects to receiver for transfer")
+		return transfer.NewReverseSender(listener, tlsConfig), nil
+	}
+	switch offer.Transport {
+	case "", transfer.TransportTCP:
+		return transfer.NewSender(senderAddr, tlsConfig), nil
+	case transfer.TransportQUIC:
+		log.Info().Msg("Sender uses QUIC for transfer")
+		return transfer.NewQUICSender(senderAddr, tlsConfig), nil
+	}
+	return nil, fmt.Errorf("unsupported transport %q", offer.Transport)
+}
+
+// Accept key exchange connection from sender on listener
+func acceptSender(listener net.Listener) (net.Conn, error) {
+	connection, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("accepting connection: %w", err)
+	}
+	return connection, nil
+}
+
+// Connect to key exchange port of sender at addr
+func dialSender(addr string) (net.Conn, error) {
+	// Parse provided address
+	host, port, err := transfer.ParseHost(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	// If no port is given, use default transfer port
+	if port == 0 {
+		port = transfer.TransferPort
+	}
+	connection, err := transfer.DialFirst([]string{host}, port)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to sender %s: %w", addr, err)
+	}
+	log.Info().Str("addr", connection.RemoteAddr().String()).Msg("Connected to sender")
+	return connection, nil
+}
+
+// Get listener for key exchange, on the relay if one is used
+func keyExchangeListener(cfg *config.Config, code string) net.Listener {
+	if cfg.Relay.Address != "" {
+		return transfer.ListenRelay(cfg.Relay.Address, transfer.RelayChannel(code, "key"))
+	}
+	return transfer.Listen(cfg.Receiver.Bind, cfg.Receiver.Port)
+}
+
+// Get session code to meet senders on the relay, generating one if
+// none is given, or the given code if no relay is used
+func relayCode(cfg *config.Config, code string) string {
+	if cfg.Relay.Address == "" {
+		return code
+	}
+	if code == "" {
+		code = transfer.GenerateCode()
+	}
+	// Show code, as the sender needs it to find this receiver
+	log.Info().Str("relay", cfg.Relay.Address).Str("code", code).Msg("Waiting for sender on relay, use --code to send")
+	return code
+}
+
+// Add default relay port to addr if it has none
+func relayAddress(addr string) string {
+	host, port, err := transfer.ParseHost(addr)
+	if err != nil {
+		log.Fatal().Err(err).Str("relay", addr).Msg("Invalid relay address")
+	}
+	if port == 0 {
+		port = transfer.DefaultRelayPort
+	}
+	return transfer.JoinHostPort(host, port)
+}
+
+// Get function returning the existing version of received files in
+// destDir if delta transfers are enabled in config
+func deltaBasis(cfg *config.Config, destDir string) func(transfer.ManifestEntry) string {
+	// If delta transfers are disabled, always receive whole files
+	if !cfg.Receiver.Delta {
+		return nil
+	}
+	return func(entry transfer.ManifestEntry) string {
+		// Parameters are never delivered to the destination directory
+		if entry.Name == serialization.ParametersFile {
+			return ""
+		}
+		// File and dir actions deliver files to the same path in destDir
+		return filepath.Join(destDir, filepath.FromSlash(entry.Name))
+	}
+}
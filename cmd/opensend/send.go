@@ -0,0 +1,405 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	flag "github.com/spf13/pflag"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/crypto"
+	"go.arsenm.dev/opensend/internal/history"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Add flags of send and sync commands
+func addSendFlags(fs *flag.FlagSet, opts *options) {
+	addTransferFlags(fs, opts)
+	fs.StringVarP(&opts.actionType, "type", "t", "", "Type of data being sent (file, dir or url)")
+	fs.StringVarP(&opts.actionData, "data", "d", "", "Data to send")
+	fs.StringVar(&opts.sendTo, "send-to", "", "Use IP address (IPv4 or IPv6) and optional port of receiver instead of discovery")
+	fs.StringVarP(&opts.target, "target", "T", "", "Target as defined in opensend.toml")
+	fs.StringVar(&opts.to, "to", "", "Select discovered receiver by name, fingerprint or glob")
+	fs.BoolVar(&opts.first, "first", false, "Use the first discovered receiver (matching --to, if given)")
+	fs.StringVar(&opts.waitFor, "wait-for", "", "Wait until a receiver with the given name, fingerprint or glob appears")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "Maximum time to wait for --wait-for")
+	fs.StringVar(&opts.fromQR, "from-qr", "", "Use receiver in pairing shown by --qr (opensend://...) instead of discovery or --send-to")
+	fs.BoolVar(&opts.pad, "pad", false, "Pad sent blobs so their sizes reveal less about the files")
+	fs.StringVar(&opts.compression, "compression", "", "Compression of sent files: auto, none, fast, best or a zstd level from 1 to 22 (default from config)")
+	fs.StringVar(&opts.transport, "transport", "", "Transport of the transfer channel: tcp or quic (default from config)")
+	fs.BoolVar(&opts.listen, "listen", false, "Accept all connections from the receiver, which must use --connect (requires --code)")
+	fs.BoolVar(&opts.web, "web", false, "Offer files to browsers on a local HTTPS page protected by a one-time code")
+}
+
+// Send file, directory or URL given by flags or arguments
+func sendCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addSendFlags(fs, opts)
+	args = parseFlags(fs, args, 2)
+	// If type and data are not given as flags, use arguments
+	if opts.actionType == "" && opts.actionData == "" && len(args) == 2 {
+		opts.actionType, opts.actionData = args[0], args[1]
+	}
+	if opts.actionType == "" || opts.actionData == "" {
+		fs.Usage()
+		exit(exitUsage, log.Error(), "Valid action type and data is required to send")
+	}
+	// Make sure action type is supported
+	if _, ok := serialization.LookupAction(opts.actionType); !ok {
+		exit(exitUsage, log.Error().Str("type", opts.actionType).Strs("supported", serialization.ActionTypes()), "Unknown action type")
+	}
+	checkReceiverFlags(opts)
+	cfg := opts.loadConfig(roleSender)
+	send(cfg, opts, serialization.NewParameters(opts.actionType, opts.actionData))
+}
+
+// Sync local directory into receiver's destination directory
+func syncCommand(fs *flag.FlagSet, args []string) {
+	opts := &options{}
+	addSendFlags(fs, opts)
+	fs.BoolVar(&opts.deleteFiles, "delete", false, "Delete files on the receiver which do not exist locally")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Only show which files would be synced")
+	args = parseFlags(fs, args, 1)
+	// Make sure directory to sync and target are provided, the target may
+	// only be omitted if the receiver is given otherwise
+	if len(args) == 0 || (opts.to == "" && opts.target == "" && opts.sendTo == "" && opts.connect == "" && opts.fromQR == "" && !opts.listen) {
+		fs.Usage()
+		exit(exitUsage, log.Error(), "Usage: opensend sync <localdir> --to <target>:<remote-subdir>")
+	}
+	// Split remote directory from target given by --target or --to
+	spec := &opts.to
+	if opts.target != "" {
+		spec = &opts.target
+	}
+	parts := strings.SplitN(*spec, ":", 2)
+	// If remote directory is not given, use name of local directory
+	syncDir := filepath.Base(filepath.Clean(args[0]))
+	if len(parts) == 2 && parts[1] != "" {
+		syncDir = parts[1]
+	}
+	*spec = parts[0]
+	checkReceiverFlags(opts)
+	// Use target from config if --to names one, otherwise select discovered receiver
+	opts.toTarget = true
+	cfg := opts.loadConfig(roleSender)
+	// Send local directory using sync action
+	parameters := serialization.NewParameters("sync", args[0])
+	parameters.Sync = serialization.SyncOptions{Dir: syncDir, Delete: opts.deleteFiles, DryRun: opts.dryRun}
+	send(cfg, opts, parameters)
+}
+
+// Make sure --to is not given along with flags selecting the receiver
+// without discovery, as it would be ignored
+func checkReceiverFlags(opts *options) {
+	if opts.to != "" && (opts.sendTo != "" || opts.target != "" || opts.connect != "" || opts.fromQR != "" || opts.listen) {
+		exit(exitUsage, log.Error().Str("to", opts.to), "--to cannot be used with --send-to, --target, --connect, --from-qr or --listen")
+	}
+}
+
+// Send parameters, or offer them to browsers if --web is given
+func send(cfg *config.Config, opts *options, parameters *serialization.Parameters) {
+	// Create limiter from rate and schedule
+	limiter := newLimiter(cfg)
+	// Create opensend dir
+	prepareWorkDir(opts.workDir)
+	// If files are offered to browsers
+	if opts.web {
+		// Serve web page until killed
+		serveWeb(cfg, opts.workDir, parameters, opts.code, opts.qr, limiter)
+	}
+	sendSession(cfg, opts, parameters, limiter)
+	// Remove opensend directory
+	removeWorkDir(opts.workDir)
+}
+
+// Find receiver, exchange keys with it and serve it the files of parameters
+func sendSession(cfg *config.Config, opts *options, parameters *serialization.Parameters, limiter *transfer.Limiter) {
+	// Parse compression setting
+	compression := compressionConfig(cfg)
+	// Create 32 byte buffer
+	sharedKeyBytes := make([]byte, 32)
+	// Read random bytes into buffer
+	_, err := io.ReadFull(rand.Reader, sharedKeyBytes)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating random bytes")
+	}
+	// Encode random bytes to hexadecimal
+	sharedKey := hex.EncodeToString(sharedKeyBytes)
+	// Notify user a key has been created
+	log.Info().Msg("Generated random shared key")
+	// Find receiver to send to
+	chosen, choiceAddrs, receiverPort := findReceiver(cfg, opts)
+	// Validate data in config struct
+	if err := parameters.Validate(); err != nil {
+		exit(exitUsage, log.Error().Err(err), "Invalid action data")
+	}
+	// Collect any files that may be required for transaction into opensend directory
+	log.Info().Str("action", parameters.Describe()).Msg("Collecting files")
+	if err := parameters.CollectFiles(opts.workDir); err != nil {
+		exit(exitError, log.Error().Err(err), "Error collecting files")
+	}
+	// Get whether transfer channel uses QUIC
+	useQUIC := cfg.Sender.Transport == transfer.TransportQUIC
+	// Declare transport for transfer and connection for key exchange
+	var transport transfer.Transport
+	var connection net.Conn
+	// If a relay is used
+	if cfg.Relay.Address != "" {
+		// Wait for receiver on transfer channel of the relay
+		transport = transfer.NewTCPTransport(transfer.ListenRelay(cfg.Relay.Address, transfer.RelayChannel(opts.code, "transfer")))
+		// Meet receiver on key exchange channel of the relay
+		connection, err = transfer.DialRelay(cfg.Relay.Address, transfer.RelayChannel(opts.code, "key"))
+		if err != nil {
+			log.Fatal().Err(err).Str("relay", cfg.Relay.Address).Msg("Error connecting to relay")
+		}
+	} else if opts.listen {
+		// Start listening for receiver, which uses the same port for key exchange and transfer
+		listener := transfer.Listen(cfg.Sender.Bind, cfg.Sender.Port)
+		if useQUIC {
+			// Listen for QUIC on the UDP port with the same number
+			transport = transfer.NewQUICTransport(cfg.Sender.Bind, transfer.ListenerPort(listener))
+		} else {
+			transport = transfer.NewTCPTransport(listener)
+		}
+		// Notify user of listening address
+		log.Info().Str("addr", listener.Addr().String()).Msg("Waiting for receiver to connect")
+		// Accept key exchange connection from receiver
+		connection, err = listener.Accept()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error accepting connections")
+		}
+		// If transfer uses QUIC, the TCP listener is no longer needed
+		if useQUIC {
+			listener.Close()
+		}
+	} else {
+		// If sender does not connect to receiver for transfer, start listening
+		// for receiver so that the transfer port can be announced
+		if useQUIC {
+			transport = transfer.NewQUICTransport(cfg.Sender.Bind, cfg.Sender.Port)
+		} else if opts.connect == "" {
+			transport = transfer.NewTCPTransport(transfer.Listen(cfg.Sender.Bind, cfg.Sender.Port))
+		}
+		// Connect to key exchange port on the first reachable receiver address
+		connection, err = transfer.DialFirst(choiceAddrs, receiverPort)
+		if err != nil {
+			log.Fatal().Err(err).Strs("addrs", choiceAddrs).Msg("Error connecting to receiver")
+		}
+		// If sender connects to receiver, serve files over connections to its key exchange port
+		if opts.connect != "" {
+			transport = transfer.NewTCPTransport(transfer.NewDialListener(connection.RemoteAddr().String()))
+		}
+	}
+	// Notify user of key exchange
+	log.Info().Msg("Performing key exchange")
+	// Exchange keys with receiver, sending it the shared key if its fingerprint
+	// matches the advertised one (if any) and it knows the session code (if any),
+	// and offering it the transfer channel
+	fingerprint, err := crypto.SenderKeyExchange(connection, crypto.TransferOffer{
+		Port:      transfer.ListenerPort(transport),
+		Reverse:   opts.connect != "",
+		Transport: cfg.Sender.Transport,
+	}, sharedKey, chosen.Fingerprint, opts.code, parameters.ActionType)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Key exchange failed")
+	}
+	// Inform user key exchange is complete
+	log.Info().Str("fingerprint", fingerprint).Str("session", crypto.SessionID(sharedKey)).Msg("Key exchange complete")
+	emit(handshakeEvent{header("handshake"), "sender", connection.RemoteAddr().String(), crypto.SessionID(sharedKey), fingerprint})
+	beginRecord(cfg, history.Send, connection.RemoteAddr().String(), fingerprint, crypto.SessionID(sharedKey))
+	start := time.Now()
+	// Create config file in opensend directory, sealed for this session
+	parameters.CreateFile(opts.workDir, sharedKey)
+	// Notify user file encryption is beginning
+	log.Info().Msg("Encrypting files")
+	// Split files into chunks compressed as configured and encrypted using shared key under
+	// opaque IDs, padding them if enabled, and create manifest
+	codec := crypto.NewChunkCodec(sharedKey, compression)
+	manifest, encoder := transfer.CreateManifest(opts.workDir, cfg.Sender.ChunkSize, cfg.Sender.Padding, codec, func(entry transfer.ManifestEntry) bool {
+		// For syncs, only list files until the receiver reports which ones it needs
+		return parameters.ActionType != "sync" || entry.Name == serialization.ParametersFile
+	})
+	offer := newOfferEvent("sender", parameters, manifest)
+	emit(offer)
+	recordOffer(offer)
+	// Encrypt manifest using shared key
+	index := crypto.EncryptBytes(manifest.Marshal(), sharedKey, nil)
+	// Notify user server has started
+	log.Info().Str("addr", transport.Addr().String()).Str("transport", cfg.Sender.Transport).Msg("Server started")
+	// Send all files in opensend directory using an HTTPS server on transport,
+	// authenticated using the shared key
+	transfer.SendFiles(transport, opts.workDir, manifest, index, codec, crypto.SessionTLSConfig(sharedKey, true), limiter, syncReporter(parameters, manifest, encoder, sharedKey))
+	emit(summaryEvent{
+		eventHeader: header("summary"),
+		Role:        "sender",
+		Action:      parameters.ActionType,
+		Files:       len(offer.Files),
+		Size:        offer.Size,
+		Duration:    time.Since(start).Seconds(),
+		OK:          true,
+	})
+	finishRecord(history.OK, "")
+}
+
+// Find receiver to send to using the relay, pairing, address or discovery
+// given in opts, and get its addresses and key exchange port
+//
+// The receiver is empty unless it was discovered or paired.
+func findReceiver(cfg *config.Config, opts *options) (transfer.Receiver, []string, int) {
+	// Create variable to store chosen receiver, if discovered
+	var chosen transfer.Receiver
+	// Create variable to store addresses of chosen receiver
+	var choiceAddrs []string
+	// Create variable for port of receiver's key exchange listener
+	receiverPort := opts.receiverPort
+	// If a relay is used
+	if cfg.Relay.Address != "" {
+		// Make sure session code is provided, as the receiver is found using it
+		if opts.code == "" {
+			exit(exitUsage, log.Error(), "Session code shown by the receiver is required to send through a relay, use --code")
+		}
+		// Notify user that the relay is being used
+		log.Info().Str("relay", cfg.Relay.Address).Msg("Relay provided. Skipping discovery.")
+		// If receiver connects to sender
+	} else if opts.listen {
+		// Notify user that receiver will connect
+		log.Info().Msg("Listening for receiver. Skipping discovery.")
+		// If receiver is provided via --from-qr
+	} else if opts.pairing != nil {
+		// Notify user that pairing is being used
+		log.Info().Msg("Pairing provided. Skipping discovery.")
+		// Use addresses and port of paired receiver
+		choiceAddrs = opts.pairing.Addrs
+		receiverPort = opts.pairing.Port
+		// If IP is provided via --send-to
+	} else if opts.sendTo != "" {
+		// Notify user that provided IP is being used
+		log.Info().Msg("IP provided. Skipping discovery.")
+		// Parse provided address
+		host, port, err := transfer.ParseHost(opts.sendTo)
+		if err != nil {
+			exit(exitUsage, log.Error().Err(err), "Invalid receiver address")
+		}
+		// If port provided along with address, use it
+		if port != 0 {
+			receiverPort = port
+		}
+		// Set chosen addresses to provided
+		choiceAddrs = []string{host}
+		// Otherwise, if receiver to wait for is provided via --wait-for
+	} else if opts.waitFor != "" {
+		// Notify user opensend is waiting for receiver
+		log.Info().Str("receiver", opts.waitFor).Dur("timeout", opts.timeout).Msg("Waiting for receiver")
+		// Browse until receiver appears
+		receiver, err := transfer.WaitForReceiver(newDiscoverer(cfg), opts.waitFor, opts.timeout)
+		if err != nil {
+			exit(exitNoReceiver, log.Error().Err(err), "Receiver did not appear")
+		}
+		// Set chosen receiver and addresses
+		chosen = receiver
+		choiceAddrs = receiver.Addrs
+		// Otherwise
+	} else {
+		// Notify user device discovery is beginning
+		log.Info().Msg("Discovering opensend receivers")
+		// Discover all _opensend._tcp.local. mDNS services
+		discoveredReceivers := transfer.DiscoverReceivers(newDiscoverer(cfg))
+		for _, receiver := range discoveredReceivers {
+			emit(transfer.WatchEvent{Type: transfer.ReceiverUp, Time: time.Now(), Receiver: receiver})
+		}
+		// If --to provided, keep only matching receivers
+		if opts.to != "" {
+			discoveredReceivers = transfer.SelectReceivers(discoveredReceivers, opts.to)
+		}
+		switch {
+		case len(discoveredReceivers) == 0 && opts.to != "":
+			exit(exitNoReceiver, log.Error().Str("to", opts.to), "No receiver matches")
+		case len(discoveredReceivers) == 0:
+			exit(exitNoReceiver, log.Error(), "No receivers found")
+		case opts.first, opts.to != "" && len(discoveredReceivers) == 1:
+			// Use first receiver without prompting
+			chosen = discoveredReceivers[0]
+		case opts.to != "":
+			// Refuse to guess between several matches
+			exit(exitUsage, log.Error().Str("to", opts.to).Strs("matches", receiverNames(discoveredReceivers)), "Several receivers match, use --first or a more specific --to")
+		case events != nil:
+			// Prompts would mix with events on stdout
+			exit(exitUsage, log.Error(), "Receiver must be selected using --to or --first with JSON output")
+		default:
+			// Prompt user for choice
+			chosen = chooseReceiver(discoveredReceivers)
+		}
+		// Get addresses of chosen receiver
+		choiceAddrs = chosen.Addrs
+	}
+	// If chosen receiver advertised its port, use it
+	if chosen.Port != 0 {
+		receiverPort = chosen.Port
+	}
+	// If receiver is paired, make sure it has the fingerprint of the pairing
+	if opts.pairing != nil {
+		chosen.Fingerprint = opts.pairing.Fingerprint
+	}
+	return chosen, choiceAddrs, receiverPort
+}
+
+// Prompt user to choose one of the given receivers
+func chooseReceiver(receivers []transfer.Receiver) transfer.Receiver {
+	// Create reader for STDIN
+	reader := bufio.NewReader(os.Stdin)
+	// Print hostnames of each receiver
+	for index, receiver := range receivers {
+		// Print index+1 and receiver, whose fingerprint tells apart
+		// receivers advertising the same name
+		fmt.Println("["+strconv.Itoa(index+1)+"]", formatReceiver(receiver))
+	}
+	// Prompt user for choice
+	fmt.Print("Choose a receiver: ")
+	choiceStr, _ := reader.ReadString('\n')
+	// Convert input to int after trimming spaces
+	choiceInt, err := strconv.Atoi(strings.TrimSpace(choiceStr))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error converting choice to int")
+	}
+	// Make sure choice refers to a listed receiver
+	if choiceInt < 1 || choiceInt > len(receivers) {
+		log.Fatal().Int("choice", choiceInt).Msg("Choice out of range")
+	}
+	// Return chosen receiver (choice is 1-indexed)
+	return receivers[choiceInt-1]
+}
+
+// Get names of receivers
+func receiverNames(receivers []transfer.Receiver) []string {
+	names := make([]string, len(receivers))
+	for index, receiver := range receivers {
+		names[index] = receiver.Name
+	}
+	return names
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/crypto"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Create handler of the sync plan reported by the receiver, which encodes
+// the files the receiver needs and replies with their encrypted manifest
+//
+// Only the first report is handled, later ones get the same reply.
+func syncReporter(parameters *serialization.Parameters, manifest *transfer.Manifest, encoder *transfer.ManifestEncoder, sharedKey string) func([]byte) []byte {
+	var once sync.Once
+	var reply []byte
+	return func(report []byte) []byte {
+		once.Do(func() {
+			// Print sync plan reported by receiver
+			plan := serialization.ParseSyncPlan(report)
+			printSyncPlan(plan)
+			// Only record files the plan transfers or deletes
+			recordSyncPlan(plan, manifest)
+			// Files are not received in dry runs
+			if parameters.Sync.DryRun {
+				return
+			}
+			// Encode new and changed files
+			log.Info().Msg("Encrypting files")
+			for index := range manifest.Files {
+				if plan.Needs(manifest.Files[index]) {
+					encoder.Encode(&manifest.Files[index])
+				}
+			}
+			encoder.Finish()
+			// Encrypt manifest of needed files using shared key
+			reply = crypto.EncryptBytes(manifest.Filter(plan.Needs).Marshal(), sharedKey, nil)
+		})
+		return reply
+	}
+}
+
+// Print sync plan reported by receiver
+func printSyncPlan(plan *serialization.SyncPlan) {
+	// If JSON output is enabled, only emit plan as an event
+	if events != nil {
+		emit(syncPlanEvent{header("sync_plan"), plan.New, plan.Changed, plan.Unchanged, plan.Delete, plan.DryRun})
+		return
+	}
+	// Print every file which is transferred or deleted
+	for _, name := range plan.New {
+		fmt.Println("+", name)
+	}
+	for _, name := range plan.Changed {
+		fmt.Println("~", name)
+	}
+	for _, name := range plan.Delete {
+		fmt.Println("-", name)
+	}
+	// Print summary
+	summary := fmt.Sprintf("%d new, %d changed, %d unchanged, %d deleted", len(plan.New), len(plan.Changed), plan.Unchanged, len(plan.Delete))
+	if plan.DryRun {
+		summary += " (dry run)"
+	}
+	fmt.Println(summary)
+}
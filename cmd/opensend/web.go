@@ -0,0 +1,197 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/crypto"
+	"go.arsenm.dev/opensend/internal/history"
+	"go.arsenm.dev/opensend/internal/serialization"
+	"go.arsenm.dev/opensend/internal/transfer"
+	"go.arsenm.dev/opensend/internal/web"
+)
+
+// Offer files or link of parameters to browsers on an HTTPS page until killed
+//
+// Browsers need code, or a random code if it is empty, to open the page. The
+// link to the page is also shown as a QR code if qr is true.
+func serveWeb(cfg *config.Config, workDir string, parameters *serialization.Parameters, code string, qr bool, limiter *transfer.Limiter) {
+	// Sync needs a receiver to compare files with
+	if parameters.ActionType == "sync" {
+		log.Fatal().Msg("Sync cannot be used with --web")
+	}
+	// Validate data in parameters
+	if err := parameters.Validate(); err != nil {
+		exit(exitUsage, log.Error().Err(err), "Invalid action data")
+	}
+	// Collect files into opensend directory
+	if err := parameters.CollectFiles(workDir); err != nil {
+		exit(exitError, log.Error().Err(err), "Error collecting files")
+	}
+	// Create offer, listing collected files under their names
+	offer := web.Offer{Name: parameters.ActionData, Dir: workDir, Manifest: &transfer.Manifest{}}
+	if parameters.ActionType == "url" {
+		offer.Link = parameters.ActionData
+	} else {
+		offer.Manifest = transfer.ListManifest(workDir)
+	}
+	// If no code is given, generate one
+	if code == "" {
+		code = transfer.GenerateCode()
+	}
+	// Start listening for browsers
+	listener := transfer.Listen(cfg.Sender.Bind, cfg.Sender.Port)
+	// Create certificate and show link to page
+	tlsConfig := webTLSConfig(cfg.Sender.Bind, listener, code, qr)
+	// Serve page
+	web.ServeDownloads(listener, tlsConfig, code, offer, limiter)
+}
+
+// Accept files uploaded by browsers on an HTTPS page until killed, delivering
+// them to destDir
+//
+// Browsers need code, or a random code if it is empty, to open the page. The
+// link to the page is also shown as a QR code if qr is true.
+func serveWebUpload(cfg *config.Config, workDir string, destDir string, code string, qr bool, limiter *transfer.Limiter) {
+	// If no code is given, generate one
+	if code == "" {
+		code = transfer.GenerateCode()
+	}
+	// Start listening for browsers
+	listener := transfer.Listen(cfg.Receiver.Bind, cfg.Receiver.Port)
+	// Create certificate and show link to page
+	tlsConfig := webTLSConfig(cfg.Receiver.Bind, listener, code, qr)
+	// Serve page, delivering uploads one at a time, so that they are
+	// recorded separately and cannot be saved under the same name
+	var deliverMtx sync.Mutex
+	web.ServeUploads(listener, tlsConfig, code, workDir, limiter, func(upload *web.Upload) error {
+		deliverMtx.Lock()
+		defer deliverMtx.Unlock()
+		return deliverUpload(cfg, upload, destDir)
+	})
+}
+
+// Deliver file uploaded by a browser to destDir like a file sent by
+// opensend, recording it in history and running hooks
+//
+// Existing files are never replaced, the upload is saved under a free
+// name instead (see freeName).
+func deliverUpload(cfg *config.Config, upload *web.Upload, destDir string) error {
+	beginRecord(cfg, history.Receive, upload.Addr, "", "")
+	// Rename upload if a file with its name exists
+	if name := freeName(destDir, upload.Name); name != upload.Name {
+		err := os.Rename(filepath.Join(upload.Dir, upload.Name), filepath.Join(upload.Dir, name))
+		if err != nil {
+			finishRecord(history.Failed, err.Error())
+			return err
+		}
+		log.Info().Str("file", upload.Name).Str("name", name).Msg("File exists, saving upload under new name")
+		upload.Name = name
+	}
+	parameters := serialization.NewParameters("file", upload.Name)
+	files := &transfer.Manifest{Files: []transfer.ManifestEntry{{Name: upload.Name, Size: upload.Size, Hash: upload.Hash}}}
+	recordOffer(newOfferEvent("receiver", parameters, files))
+	err := parameters.ExecuteAction(upload.Dir, destDir)
+	if err != nil {
+		finishRecord(history.Failed, err.Error())
+		return err
+	}
+	finishRecord(history.OK, "")
+	log.Info().Str("file", upload.Name).Str("dest", destDir).Msg("File received")
+	// Run hooks configured for file actions and this browser's address
+	runHooks(cfg, hookSession{
+		parameters: parameters,
+		senderAddr: upload.Addr,
+		destDir:    destDir,
+		files:      files,
+	})
+	return nil
+}
+
+// Get name under which a file called name can be saved in destDir without
+// replacing another file, adding a number to it if needed, as in
+// "photo (1).jpg"
+func freeName(destDir string, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	// Number hidden files after their whole name
+	if base == "" {
+		base, ext = name, ""
+	}
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(destDir, name)); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// Create certificate for web page served on listener and show link
+// to it containing code, also as a QR code with the certificate
+// fingerprint if qr is true
+func webTLSConfig(bind string, listener net.Listener, code string, qr bool) *tls.Config {
+	// Get addresses browsers can use
+	hosts := localHosts(bind)
+	// Create certificate for page
+	tlsConfig, fingerprint := crypto.WebTLSConfig(hosts)
+	// Show link to page, containing the code
+	link := webLink(hosts[0], transfer.ListenerPort(listener), code)
+	log.Info().
+		Str("url", link).
+		Str("code", code).
+		Strs("addrs", hosts).
+		Str("certificate", fingerprint).
+		Msg("Open in browser, the code can only be used once")
+	emit(listeningEvent{header("listening"), listener.Addr().String(), code, link})
+	if qr {
+		printQR(webQRLink(link, fingerprint))
+	}
+	return tlsConfig
+}
+
+// Get addresses other devices can use to connect to this host, preferring
+// bind address if set
+func localHosts(bind string) []string {
+	if bind := strings.Trim(bind, "[]"); bind != "" && bind != "::" && bind != "0.0.0.0" {
+		return []string{bind}
+	}
+	hosts := transfer.LocalAddrs()
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	return hosts
+}
+
+// Create link to web page on host and port, logging in with code
+func webLink(host string, port int, code string) string {
+	return "https://" + transfer.URLHost(host, port) + "/?code=" + code
+}
+
+// Add certificate fingerprint to link as its fragment, which browsers
+// show in the address bar but never send to the page
+func webQRLink(link string, fingerprint string) string {
+	return link + "#fp=" + fingerprint
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/config"
+	"go.arsenm.dev/opensend/internal/history"
+	"go.arsenm.dev/opensend/internal/web"
+)
+
+// Write file with given content, creating its directory
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFreeName(t *testing.T) {
+	destDir := t.TempDir()
+	for _, name := range []string{"photo.jpg", "photo (1).jpg", "notes", ".bashrc", "archive.tar.gz"} {
+		writeFile(t, filepath.Join(destDir, name), "existing")
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"new.txt", "new.txt"},
+		{"photo.jpg", "photo (2).jpg"},
+		{"notes", "notes (1)"},
+		{".bashrc", ".bashrc (1)"},
+		{"archive.tar.gz", "archive.tar (1).gz"},
+	}
+	for _, test := range tests {
+		if got := freeName(destDir, test.name); got != test.want {
+			t.Errorf("freeName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDeliverUpload(t *testing.T) {
+	destDir := t.TempDir()
+	writeFile(t, filepath.Join(destDir, "photo.jpg"), "existing")
+	uploadDir := t.TempDir()
+	writeFile(t, filepath.Join(uploadDir, "photo.jpg"), "uploaded")
+	hookOutput := filepath.Join(t.TempDir(), "hook")
+	t.Setenv("HOOK_OUTPUT", hookOutput)
+	cfg := &config.Config{
+		HistoryFile: filepath.Join(t.TempDir(), "history.jsonl"),
+		Hooks:       []config.Hook{{Command: `printf '%s' "$OPENSEND_FILES" > "$HOOK_OUTPUT"`, Actions: []string{"file"}}},
+	}
+	upload := &web.Upload{Dir: uploadDir, Name: "photo.jpg", Size: 8, Hash: "hash", Addr: "192.168.1.3:50000"}
+	if err := deliverUpload(cfg, upload, destDir); err != nil {
+		t.Fatalf("deliverUpload() = %v", err)
+	}
+	// The existing file is kept, and the upload saved under a new name
+	if upload.Name != "photo (1).jpg" {
+		t.Errorf("upload saved as %q, want %q", upload.Name, "photo (1).jpg")
+	}
+	for name, want := range map[string]string{"photo.jpg": "existing", "photo (1).jpg": "uploaded"} {
+		data, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	// The upload is recorded in history
+	records, err := history.Read(cfg.HistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("history has %d records, want 1", len(records))
+	}
+	record := records[0]
+	if record.Direction != history.Receive || record.Outcome != history.OK || record.PeerAddr != upload.Addr || len(record.Files) != 1 || record.Files[0].Name != "photo (1).jpg" {
+		t.Errorf("history record = %+v", record)
+	}
+	// Hooks of file actions run with the saved name
+	data, err := os.ReadFile(hookOutput)
+	if err != nil || string(data) != "photo (1).jpg" {
+		t.Errorf("hook got files %q, %v, want %q", data, err, "photo (1).jpg")
+	}
+}
@@ -18,6 +18,7 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -25,13 +26,20 @@ import (
 
 	"github.com/pelletier/go-toml"
 	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/transfer"
 )
 
 // Struct for unmarshaling of opensend TOML configs
 type Config struct {
-	Receiver ReceiverConfig
-	Sender   SenderConfig
-	Targets  map[string]Target
+	IdentityFile string `toml:"identityFile"`
+	HistoryFile  string `toml:"historyFile"`
+	Receiver     ReceiverConfig
+	Sender       SenderConfig
+	Discovery    DiscoveryConfig
+	Limit        LimitConfig
+	Relay        RelayConfig
+	Targets      map[string]Target
+	Hooks        []Hook
 }
 
 // Config section for receiver
@@ -39,15 +47,60 @@ type ReceiverConfig struct {
 	DestDir      string `toml:"destinationDirectory"`
 	SkipZeroconf bool
 	WorkDir      string `toml:"workingDirectory"`
+	Port         int    `toml:"port"`
+	Bind         string `toml:"bind"`
+	Streams      int    `toml:"streams"`
+	Delta        bool   `toml:"delta"`
 }
 
 // Config section for sender
 type SenderConfig struct {
-	WorkDir string `toml:"workingDirectory"`
+	WorkDir     string `toml:"workingDirectory"`
+	Port        int    `toml:"port"`
+	Bind        string `toml:"bind"`
+	Padding     bool   `toml:"padding"`
+	ChunkSize   int64  `toml:"chunkSize"`
+	Compression string `toml:"compression"`
+	Transport   string `toml:"transport"`
+}
+
+// Config section for device discovery
+type DiscoveryConfig struct {
+	Beacon     bool
+	BeaconPort int `toml:"beaconPort"`
+}
+
+// Config section for bandwidth limiting
+type LimitConfig struct {
+	Rate     string   `toml:"rate"`
+	Schedule []string `toml:"schedule"`
+}
+
+// Config section for relay server and clients
+type RelayConfig struct {
+	Address string `toml:"address"`
+	Port    int    `toml:"port"`
+	Bind    string `toml:"bind"`
 }
 
 type Target struct {
-	IP string
+	IP    string
+	Port  int    `toml:"port"`
+	Limit string `toml:"limit"`
+}
+
+// Command run by the receiver after executing an action
+type Hook struct {
+	// Shell command to run
+	Command string `toml:"command"`
+	// Action types the hook runs for, all if empty
+	Actions []string `toml:"actions"`
+	// Addresses (globs or CIDR ranges) of senders the hook runs for, all if
+	// empty. Addresses are not authenticated, and the hook never runs for
+	// senders using a relay.
+	Senders []string `toml:"senders"`
+	// Maximum duration of the command, such as 5m, unlimited if empty
+	Timeout string `toml:"timeout"`
 }
 
 // Attempt to find config path
@@ -91,24 +144,60 @@ func NewConfig(path string) *Config {
 			log.Fatal().Err(err).Msg("Error unmarshalling toml")
 		}
 	}
+	// Make sure values read from the file are usable
+	if err := newConfig.Validate(); err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("Invalid config")
+	}
 	// Return new config struct
 	return newConfig
 }
 
 // Set config defaults
 func (config *Config) SetDefaults() {
+	// Set identity file to $HOME/.config/opensend/identity.pem
+	config.IdentityFile = ExpandPath("~/.config/opensend/identity.pem")
+	// Set history file to $HOME/.config/opensend/history.jsonl
+	config.HistoryFile = ExpandPath("~/.config/opensend/history.jsonl")
 	// Set destination directory to $HOME/Downloads
 	config.Receiver.DestDir = ExpandPath("~/Downloads")
 	// Set receiver working directory to $HOME/.opensend
 	config.Receiver.WorkDir = ExpandPath("~/.opensend")
 	// Set do not skip zeroconf
 	config.Receiver.SkipZeroconf = false
+	// Set receiver key exchange port to 9797 (0 picks a random free port)
+	config.Receiver.Port = 9797
+	// Set receiver to tune number of streams automatically
+	config.Receiver.Streams = 0
 	// Set sender working directory to $HOME/.opensend
 	config.Sender.WorkDir = ExpandPath("~/.opensend")
+	// Set sender transfer port to 9898 (0 picks a random free port)
+	config.Sender.Port = 9898
+	// Set sender average chunk size to 1 MiB
+	config.Sender.ChunkSize = transfer.DefaultChunkSize
+	// Set sender to skip compression of files which do not shrink
+	config.Sender.Compression = "auto"
+	// Set sender to transfer files over TCP
+	config.Sender.Transport = "tcp"
+	// Enable beacon discovery alongside zeroconf
+	config.Discovery.Beacon = true
+	// Set beacon port to default
+	config.Discovery.BeaconPort = 9799
+	// Set rate to unlimited
+	config.Limit.Rate = "unlimited"
+	// Set relay server port to 9900
+	config.Relay.Port = 9900
 	// Set targets to an empty map[string]map[string]string
 	config.Targets = map[string]Target{}
 }
 
+// Check config for values which cannot be used
+func (config *Config) Validate() error {
+	// Make sure chunk size is within the range accepted by the chunker
+	if config.Sender.ChunkSize < transfer.MinChunkSize || config.Sender.ChunkSize > transfer.MaxChunkSize {
+		return fmt.Errorf("sender.chunkSize must be between %d and %d, got %d", transfer.MinChunkSize, transfer.MaxChunkSize, config.Sender.ChunkSize)
+	}
+	return nil
+}
 
 func ExpandPath(s string) string {
 	// Use ConsoleWriter logger
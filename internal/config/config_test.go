@@ -0,0 +1,43 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestValidateChunkSize(t *testing.T) {
+	tests := []struct {
+		chunkSize int64
+		err       bool
+	}{
+		{-1, true},
+		{0, true},
+		{1, true},
+		{4<<10 - 1, true},
+		{4 << 10, false},
+		{1 << 20, false},
+		{256 << 20, false},
+		{256<<20 + 1, true},
+	}
+	for _, test := range tests {
+		config := &Config{}
+		config.SetDefaults()
+		config.Sender.ChunkSize = test.chunkSize
+		if err := config.Validate(); (err != nil) != test.err {
+			t.Errorf("Validate() with chunkSize %d = %v, want error %v", test.chunkSize, err, test.err)
+		}
+	}
+}
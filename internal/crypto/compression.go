@@ -0,0 +1,92 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs chunks can be encoded with, recorded per file in the manifest
+const (
+	// Chunks are stored without compression
+	CodecNone = "none"
+	// Chunks are compressed using Zstd
+	CodecZstd = "zstd"
+)
+
+// Zstd levels used for named compression settings
+const (
+	fastLevel    = 1
+	defaultLevel = 3
+	bestLevel    = 22
+)
+
+// Minimum share of a sample compression must save to be used in auto mode
+const minSavingsPercent = 5
+
+// Compression setting of a sender
+type Compression struct {
+	// Whether to skip compression of files whose content does not shrink
+	Auto bool
+	// Zstd level (1-22), 0 disables compression
+	//
+	// The encoder only has four speeds, which levels are mapped onto (see
+	// encoderLevel).
+	Level int
+}
+
+// Get speed of the Zstd encoder used for a level
+//
+// Levels 1-2 are the fastest, 3-5 the default, 6-9 better and 10-22 the
+// best compression, close to the zstd levels each speed is comparable to.
+func encoderLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level < 3:
+		return zstd.SpeedFastest
+	case level < 6:
+		return zstd.SpeedDefault
+	case level < 10:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// Parse compression setting
+//
+// Valid settings are auto, none, fast, best or a Zstd level from 1 to 22.
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "auto":
+		return Compression{Auto: true, Level: defaultLevel}, nil
+	case "none":
+		return Compression{}, nil
+	case "fast":
+		return Compression{Level: fastLevel}, nil
+	case "best":
+		return Compression{Level: bestLevel}, nil
+	}
+	// Otherwise, parse setting as Zstd level
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 1 || level > 22 {
+		return Compression{}, errors.New("compression must be auto, none, fast, best or a level from 1 to 22")
+	}
+	return Compression{Level: level}, nil
+}
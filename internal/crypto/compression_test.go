@@ -0,0 +1,119 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    Compression
+		valid   bool
+	}{
+		{"auto", Compression{Auto: true, Level: defaultLevel}, true},
+		{"none", Compression{}, true},
+		{"fast", Compression{Level: fastLevel}, true},
+		{"best", Compression{Level: bestLevel}, true},
+		{"1", Compression{Level: 1}, true},
+		{"22", Compression{Level: 22}, true},
+		{"0", Compression{}, false},
+		{"23", Compression{}, false},
+		{"-1", Compression{}, false},
+		{"", Compression{}, false},
+		{"max", Compression{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseCompression(test.setting)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseCompression(%q) error = %v, want valid %v", test.setting, err, test.valid)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseCompression(%q) = %+v, want %+v", test.setting, got, test.want)
+		}
+	}
+}
+
+func TestEncoderLevel(t *testing.T) {
+	tests := []struct {
+		level int
+		want  zstd.EncoderLevel
+	}{
+		{fastLevel, zstd.SpeedFastest},
+		{2, zstd.SpeedFastest},
+		{defaultLevel, zstd.SpeedDefault},
+		{5, zstd.SpeedDefault},
+		{6, zstd.SpeedBetterCompression},
+		{9, zstd.SpeedBetterCompression},
+		{10, zstd.SpeedBestCompression},
+		{bestLevel, zstd.SpeedBestCompression},
+	}
+	for _, test := range tests {
+		if got := encoderLevel(test.level); got != test.want {
+			t.Errorf("encoderLevel(%d) = %v, want %v", test.level, got, test.want)
+		}
+	}
+}
+
+func TestChunkCodecChoose(t *testing.T) {
+	text := bytes.Repeat([]byte("opensend compresses text well. "), 2048)
+	random := make([]byte, len(text))
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		setting string
+		sample  []byte
+		want    string
+	}{
+		{"auto", text, CodecZstd},
+		{"auto", random, CodecNone},
+		{"fast", random, CodecZstd},
+		{"best", text, CodecZstd},
+		{"none", text, CodecNone},
+	}
+	for _, test := range tests {
+		compression, err := ParseCompression(test.setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := NewChunkCodec("key", compression)
+		if got := codec.Choose(test.sample); got != test.want {
+			t.Errorf("%s: Choose() = %q, want %q", test.setting, got, test.want)
+		}
+	}
+}
+
+func TestChunkCodecRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("chunk of a file "), 1024)
+	for _, setting := range []string{"none", "fast", "best"} {
+		compression, err := ParseCompression(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := NewChunkCodec("key", compression)
+		name := codec.Choose(data)
+		got, err := codec.Decode(codec.Encode(data, name), name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: decoded chunk differs from encoded one: %v", setting, err)
+		}
+	}
+}
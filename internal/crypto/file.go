@@ -17,177 +17,161 @@
 package crypto
 
 import (
-	"bytes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-// Encrypt given file using the shared key
-func CompressAndEncryptFile(filePath string, newFilePath string, sharedKey string) {
-	// Use ConsoleWriter logger
-	// Read data from file
-	file, err := os.Open(filePath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error opening file")
-	}
-	// Create buffer for compressed data
-	compressedBuffer := &bytes.Buffer{}
-	// Create Zstd encoder
-	zstdEncoder, err := zstd.NewWriter(compressedBuffer)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating Zstd encoder")
+// Zstd decoder shared by all chunks, safe for concurrent use
+var (
+	zstdOnce    sync.Once
+	zstdDecoder *zstd.Decoder
+)
+
+// Codec compressing and encrypting chunks of files using the shared key
+type ChunkCodec struct {
+	sharedKey   string
+	compression Compression
+	encoder     *zstd.Encoder
+}
+
+// Create chunk codec for the session using the shared key
+func NewChunkCodec(sharedKey string, compression Compression) *ChunkCodec {
+	codec := &ChunkCodec{sharedKey: sharedKey, compression: compression}
+	// If compression is enabled
+	if compression.Level > 0 {
+		var err error
+		// Create Zstd encoder at configured level
+		codec.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel(compression.Level)))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error creating Zstd encoder")
+		}
 	}
-	// Copy file data to Zstd encoder
-	_, err = io.Copy(zstdEncoder, file)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading file")
+	return codec
+}
+
+// Choose codec for a file using a sample of its content
+//
+// In auto mode, files whose sample does not shrink by at least
+// minSavingsPercent, such as images, videos and archives, are stored
+// without compression.
+func (codec *ChunkCodec) Choose(sample []byte) string {
+	// If compression is disabled, do not compress
+	if codec.encoder == nil {
+		return CodecNone
+	}
+	// If not in auto mode, always compress
+	if !codec.compression.Auto {
+		return CodecZstd
+	}
+	// Compress sample and check how much it shrinks
+	compressed := codec.encoder.EncodeAll(sample, nil)
+	if len(compressed)*100 > len(sample)*(100-minSavingsPercent) {
+		return CodecNone
+	}
+	return CodecZstd
+}
+
+// Encode chunk of a file using codec, then encrypt it using the shared key
+func (codec *ChunkCodec) Encode(data []byte, name string) []byte {
+	// If chunk should be compressed
+	if name == CodecZstd {
+		// Compress data
+		data = codec.encoder.EncodeAll(data, nil)
 	}
-	// Close Zstd encoder
-	zstdEncoder.Close()
-	// Read compressed data into data variable
-	data, err := ioutil.ReadAll(compressedBuffer)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading compressed buffer")
+	// Encrypt data
+	return EncryptBytes(data, codec.sharedKey, nil)
+}
+
+// Decrypt chunk using the shared key, then decode it using codec
+func (codec *ChunkCodec) Decode(data []byte, name string) ([]byte, error) {
+	// Decrypt data
+	plaintext, err := DecryptBytes(data, codec.sharedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting chunk: %w", err)
+	}
+	switch name {
+	case CodecNone:
+		return plaintext, nil
+	case CodecZstd:
+		// Create shared Zstd decoder if it does not exist yet
+		zstdOnce.Do(func() {
+			var err error
+			zstdDecoder, err = zstd.NewReader(nil)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error creating Zstd decoder")
+			}
+		})
+		// Decompress plaintext
+		decompressed, err := zstdDecoder.DecodeAll(plaintext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing chunk: %w", err)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
 	}
+}
+
+// Create ChaCha20-Poly1305 cipher using shared key
+func newCipher(sharedKey string) cipher.AEAD {
 	// Create md5 hash of password in order to make it the required size
 	md5Hash := md5.New()
 	md5Hash.Write([]byte(sharedKey))
 	// Encode md5 hash bytes into hexadecimal
 	hashedKey := hex.EncodeToString(md5Hash.Sum(nil))
-	// Create new AES c20cipher
+	// Create new ChaCha20-Poly1305 cipher
 	c20cipher, err := chacha20poly1305.NewX([]byte(hashedKey))
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error creating ChaCha20-Poly1305 cipher")
 	}
+	return c20cipher
+}
+
+// Encrypt data using shared key, prepending the nonce
+//
+// additionalData is authenticated but not encrypted, and must be given
+// again to DecryptBytes. It may be nil.
+func EncryptBytes(data []byte, sharedKey string, additionalData []byte) []byte {
+	c20cipher := newCipher(sharedKey)
 	// Make byte slice for nonce
 	nonce := make([]byte, c20cipher.NonceSize())
 	// Read random bytes into nonce slice
-	_, err = io.ReadFull(rand.Reader, nonce)
+	_, err := io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error creating nonce")
 	}
 	// Encrypt data
-	ciphertext := c20cipher.Seal(nonce, nonce, data, nil)
-	// Create new file
-	newFile, err := os.Create(newFilePath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating file")
-	}
-	// Defer file close
-	defer newFile.Close()
-	// Write ciphertext to new file
-	bytesWritten, err := newFile.Write(ciphertext)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error writing to file")
-	}
-	// Log bytes written and to which file
-	log.Info().Str("file", filepath.Base(newFilePath)).Msg("Wrote " + strconv.Itoa(bytesWritten) + " bytes")
+	return c20cipher.Seal(nonce, nonce, data, additionalData)
 }
 
-// Decrypt given file using the shared key
-func DecryptAndDecompressFile(filePath string, newFilePath string, sharedKey string) {
-	// Use ConsoleWriter logger
-	// Read data from file
-	data, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading file")
-	}
-	// Create md5 hash of password in order to make it the required size
-	md5Hash := md5.New()
-	md5Hash.Write([]byte(sharedKey))
-	hashedKey := hex.EncodeToString(md5Hash.Sum(nil))
-	// Create new AES cipher
-	c20cipher, err := chacha20poly1305.NewX([]byte(hashedKey))
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating ChaCha20-Poly1305 cipher")
-	}
-	// Get standard GCM nonce size
+// Decrypt data encrypted using EncryptBytes with shared key
+//
+// Fails if data was modified, or encrypted using another key or
+// additional data.
+func DecryptBytes(data []byte, sharedKey string, additionalData []byte) ([]byte, error) {
+	c20cipher := newCipher(sharedKey)
+	// Get nonce size
 	nonceSize := c20cipher.NonceSize()
+	// Make sure data is large enough to contain the nonce
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted data too short")
+	}
 	// Get nonce and ciphertext from data
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 	// Decrypt data
-	plaintext, err := c20cipher.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error decrypting data")
-	}
-	// Create new Zstd decoder
-	zstdDecoder, err := zstd.NewReader(bytes.NewBuffer(plaintext))
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating Zstd decoder")
-	}
-	// Create new file
-	newFile, err := os.Create(newFilePath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating file")
-	}
-	// Close new file at the end of this function
-	defer newFile.Close()
-	// Write decompressed plaintext to new file
-	bytesWritten, err := io.Copy(newFile, zstdDecoder)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error writing to file")
-	}
-	zstdDecoder.Close()
-	// Log bytes written and to which file
-	log.Info().Str("file", filepath.Base(newFilePath)).Msg("Wrote " + strconv.Itoa(int(bytesWritten)) + " bytes")
-}
-
-// Encrypt files in given directory using shared key
-func EncryptFiles(dir string, sharedKey string) {
-	// Use ConsoleWriter logger
-	// Walk given directory
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		// If error reading, return err
-		if err != nil {
-			return err
-		}
-		// If file is not a directory and is not the key
-		if !info.IsDir() && !strings.Contains(path, "key.aes") {
-			// Compress and Encrypt the file using shared key, appending .zst.enc
-			CompressAndEncryptFile(path, path+".zst.enc", sharedKey)
-			// Remove unencrypted file
-			err := os.Remove(path)
-			if err != nil {
-				return err
-			}
-		}
-		// Return nil if no error occurs
-		return nil
-	})
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error encrypting files")
-	}
-}
-
-// Decrypt files in given directory using shared key
-func DecryptFiles(dir string, sharedKey string) {
-	// Use ConsoleWriter logger
-	// Walk given directory
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		// If error reading, return err
-		if err != nil {
-			return err
-		}
-		// If file is not a directory and is encrypted
-		if !info.IsDir() && strings.Contains(path, ".enc") {
-			// Decrypt and decompress the file using the shared key, removing .zst.enc
-			DecryptAndDecompressFile(path, strings.TrimSuffix(path, ".zst.enc"), sharedKey)
-		}
-		// Return nil if no errors occurred
-		return nil
-	})
+	plaintext, err := c20cipher.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error decrypting files")
+		return nil, fmt.Errorf("decrypting data: %w", err)
 	}
+	return plaintext, nil
 }
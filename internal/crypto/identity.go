@@ -0,0 +1,98 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Persistent device identity
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// Load identity at given path, generating and saving a new one if it does not exist
+func LoadIdentity(path string) *Identity {
+	// Read PEM file at path
+	pemData, err := ioutil.ReadFile(path)
+	// If file does not exist
+	if errors.Is(err, os.ErrNotExist) {
+		// Generate new identity
+		return createIdentity(path)
+	} else if err != nil {
+		log.Fatal().Err(err).Msg("Error reading identity")
+	}
+	// Decode PEM block
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		log.Fatal().Str("path", path).Msg("Identity file is not PEM encoded")
+	}
+	// Parse PKCS #8 private key
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing identity")
+	}
+	// Make sure key is an Ed25519 key
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		log.Fatal().Str("path", path).Msg("Identity is not an Ed25519 key")
+	}
+	return &Identity{PrivateKey: privateKey, PublicKey: privateKey.Public().(ed25519.PublicKey)}
+}
+
+// Generate new identity and save it at given path
+func createIdentity(path string) *Identity {
+	// Generate Ed25519 keypair
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating identity")
+	}
+	// Marshal private key as PKCS #8
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error encoding identity")
+	}
+	// Create parent directory of identity file
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error creating identity directory")
+	}
+	// Write PEM encoded key, readable only by the user
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	err = ioutil.WriteFile(path, pemData, 0600)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error writing identity")
+	}
+	log.Info().Str("path", path).Msg("Generated new identity")
+	return &Identity{PrivateKey: privateKey, PublicKey: publicKey}
+}
+
+// Get fingerprint of identity
+func (identity *Identity) Fingerprint() string {
+	return transfer.Fingerprint(identity.PublicKey)
+}
@@ -20,11 +20,9 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"io/ioutil"
-	"net/http"
+	"fmt"
 
 	"github.com/rs/zerolog/log"
-	"go.arsenm.dev/opensend/internal/transfer"
 )
 
 // Generate RSA keypair
@@ -41,34 +39,6 @@ func GenerateRSAKeypair() (*rsa.PrivateKey, *rsa.PublicKey) {
 	return privateKey, &publicKey
 }
 
-// Get public key from sender
-func GetKey(sender *transfer.Sender) []byte {
-	// Use ConsoleWriter logger
-	// Send key request to connection
-	keyReader, code, err := sender.Get("/key")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error sending key request")
-	}
-	// If ok code returned
-	if code == http.StatusOK {
-		// Read received bytes into key
-		key, err := ioutil.ReadAll(keyReader)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error reading key")
-		}
-		// Return key
-		return key
-		// Otherwise
-	} else {
-		// Fatally log
-		if err != nil {
-			log.Fatal().Msg("Server reported error")
-		}
-	}
-	// Return nil if all else fails
-	return nil
-}
-
 // Encrypt shared key with received public key
 func EncryptKey(sharedKey string, recvPubKey *rsa.PublicKey) []byte {
 	// Use ConsoleWriter logger
@@ -82,14 +52,12 @@ func EncryptKey(sharedKey string, recvPubKey *rsa.PublicKey) []byte {
 }
 
 // Decrypt shared key using private RSA key
-func DecryptKey(encryptedKey []byte, privateKey *rsa.PrivateKey) string {
+func DecryptKey(encryptedKey []byte, privateKey *rsa.PrivateKey) (string, error) {
 	// Decrypt shared key using RSA
 	decryptedKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKey, nil)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error decrypting shared key")
+		return "", fmt.Errorf("decrypting shared key: %w", err)
 	}
-	// Get string of decrypted key
-	sharedKey := string(decryptedKey)
-	// Return shared key
-	return sharedKey
+	// Return string of decrypted key
+	return string(decryptedKey), nil
 }
@@ -17,59 +17,233 @@
 package crypto
 
 import (
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 
 	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/transfer"
+	"golang.org/x/crypto/hkdf"
 )
 
-// Exchange keys with sender
-func ReceiverKeyExchange(key *rsa.PublicKey) string {
-	// Use ConsoleWriter logger
-	// Create TCP listener on port 9797
-	listener, err := net.Listen("tcp", ":9797")
+// HKDF info labels for the keys proving knowledge of the session code
+const (
+	// Key of the receiver's MAC
+	codeKeyInfo = "opensend relay auth"
+	// Key of the sender's MAC
+	senderCodeKeyInfo = "opensend sender auth"
+)
+
+// Message sent by the receiver during key exchange
+type keyExchangeMsg struct {
+	// Session public key
+	Key *rsa.PublicKey
+	// Public key of the receiver's persistent identity
+	Identity ed25519.PublicKey
+	// Signature of the session key by the identity
+	Signature []byte
+	// MAC of the session key and identity keyed from the session code,
+	// if one is used
+	CodeMAC []byte
+	// Action types supported by the receiver, empty if not advertised
+	Actions []string
+}
+
+// Transfer channel offered by the sender during key exchange
+type TransferOffer struct {
+	// Port of the sender's transfer server
+	Port int
+	// Whether the sender connects to the receiver for transfer instead
+	// of listening, as only the receiver can be reached
+	Reverse bool
+	// Transport of the transfer channel, TCP if empty
+	Transport string
+}
+
+// Message sent by the sender during key exchange
+type senderHelloMsg struct {
+	// Transfer channel offered by the sender
+	Offer TransferOffer
+	// Shared key encrypted using the receiver's session key
+	EncryptedKey []byte
+	// MAC of the offer, encrypted shared key and the receiver's session
+	// key keyed from the session code, if one is used
+	CodeMAC []byte
+}
+
+// Exchange keys with sender over connection
+//
+// If code is not empty, the receiver proves it knows the session code,
+// so that a relay cannot substitute its own keys, and the sender must
+// prove it knows the code as well, so that nobody who only knows the
+// relay channel can send files. The action types in actions are
+// advertised to the sender, so that it does not send unsupported
+// actions. Returns the address of the sender's transfer server, or an
+// empty address if the sender connects to the receiver for transfer
+// instead, the transfer channel offered by the sender and the shared key
+// encrypted using key
+func ReceiverKeyExchange(connection net.Conn, key *rsa.PublicKey, identity *Identity, code string, actions []string) (string, TransferOffer, []byte, error) {
+	// Close connection at the end of this function
+	defer connection.Close()
+	// Get sender address
+	senderAddr := connection.RemoteAddr().String()
+	// Sign session key using identity to prove ownership of the fingerprint
+	signature := ed25519.Sign(identity.PrivateKey, x509.MarshalPKCS1PublicKey(key))
+	// Create gob encoder with connection as io.Writer
+	encoder := gob.NewEncoder(connection)
+	// Encode key into connection
+	err := encoder.Encode(keyExchangeMsg{
+		Key:       key,
+		Identity:  identity.PublicKey,
+		Signature: signature,
+		CodeMAC:   codeMAC(code, codeKeyInfo, x509.MarshalPKCS1PublicKey(key), identity.PublicKey),
+		Actions:   actions,
+	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error starting listener")
+		return "", TransferOffer{}, nil, fmt.Errorf("encoding key: %w", err)
 	}
-	// Create string for sender address
-	var senderAddr string
-	for {
-		// Accept connection on listener
-		connection, err := listener.Accept()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error accepting connections")
-		}
-		// Get sender address and store it in senderAddr
-		senderAddr = connection.RemoteAddr().String()
-		// Create gob encoder with connection as io.Writer
-		encoder := gob.NewEncoder(connection)
-		// Encode key into connection
-		err = encoder.Encode(key)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error encoding key")
-		}
-		return senderAddr
+	// Create gob decoder with connection as io.Reader
+	decoder := gob.NewDecoder(connection)
+	// Decode sender hello
+	hello := senderHelloMsg{}
+	err = decoder.Decode(&hello)
+	if err != nil {
+		return "", TransferOffer{}, nil, fmt.Errorf("decoding sender hello: %w", err)
+	}
+	// If a session code is used, make sure the sender knows it
+	if code != "" && !hmac.Equal(hello.CodeMAC, senderCodeMAC(code, key, hello)) {
+		return "", TransferOffer{}, nil, errors.New("sender does not know the session code")
 	}
+	// If sender connects to receiver, there is no transfer server address
+	if hello.Offer.Reverse {
+		return "", hello.Offer, hello.EncryptedKey, nil
+	}
+	// Get host of sender without the port
+	senderHost, _, _ := net.SplitHostPort(senderAddr)
+	// Return address of sender's transfer server and encrypted shared key
+	return transfer.JoinHostPort(senderHost, hello.Offer.Port), hello.Offer, hello.EncryptedKey, nil
 }
 
-// Exchange keys with receiver
-func SenderKeyExchange(receiverIP string) *rsa.PublicKey {
-	// Use ConsoleWriter logger
-	// Connect to TCP socket on receiver IP port 9797
-	connection, err := net.Dial("tcp", receiverIP+":9797")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error connecting to sender")
-	}
+// Exchange keys with receiver over connection, sending it the shared
+// key and offering it the transfer channel described by offer
+//
+// If expectedFingerprint is not empty, the exchange is aborted before
+// the shared key is sent unless the receiver proves it owns that
+// fingerprint. Likewise, if code is not empty, the receiver must prove
+// it knows the session code, and the sender proves it knows the code in
+// return. If the receiver advertises its supported action types, they
+// must include actionType. Returns the fingerprint of the receiver's
+// identity.
+func SenderKeyExchange(connection net.Conn, offer TransferOffer, sharedKey string, expectedFingerprint string, code string, actionType string) (string, error) {
+	// Close connection at the end of this function
+	defer connection.Close()
+	// Log address used for key exchange
+	log.Info().Str("addr", connection.RemoteAddr().String()).Msg("Connected to receiver")
 	// Create gob decoder
 	decoder := gob.NewDecoder(connection)
-	// Instantiate rsa.PublicKey struct
-	recvPubKey := &rsa.PublicKey{}
+	// Instantiate keyExchangeMsg struct
+	msg := keyExchangeMsg{}
 	// Decode key
-	err = decoder.Decode(recvPubKey)
+	err := decoder.Decode(&msg)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error decoding key")
+		return "", fmt.Errorf("decoding key: %w", err)
+	}
+	// Make sure message contains a valid identity
+	if msg.Key == nil || len(msg.Identity) != ed25519.PublicKeySize {
+		return "", errors.New("receiver did not send a valid identity")
+	}
+	// Verify session key was signed by the receiver's identity
+	if !ed25519.Verify(msg.Identity, x509.MarshalPKCS1PublicKey(msg.Key), msg.Signature) {
+		return "", errors.New("invalid session key signature")
+	}
+	// If a session code is used, make sure the receiver knows it
+	if code != "" && !hmac.Equal(msg.CodeMAC, codeMAC(code, codeKeyInfo, x509.MarshalPKCS1PublicKey(msg.Key), msg.Identity)) {
+		return "", errors.New("receiver does not know the session code")
+	}
+	// Get fingerprint of receiver's identity
+	fingerprint := transfer.Fingerprint(msg.Identity)
+	// If a fingerprint is expected, make sure it matches the one proven by the receiver
+	if expectedFingerprint != "" && expectedFingerprint != fingerprint {
+		return "", fmt.Errorf("receiver fingerprint mismatch: expected %s, got %s", expectedFingerprint, fingerprint)
+	}
+	// If receiver advertises supported action types, make sure it supports this one
+	if len(msg.Actions) != 0 && !containsString(msg.Actions, actionType) {
+		return "", &UnsupportedActionError{Type: actionType, Supported: msg.Actions}
+	}
+	// Create gob encoder with connection as io.Writer
+	encoder := gob.NewEncoder(connection)
+	// Offer transfer channel and send shared key encrypted using the
+	// receiver's session key, proving knowledge of the code if one is used
+	hello := senderHelloMsg{Offer: offer, EncryptedKey: EncryptKey(sharedKey, msg.Key)}
+	hello.CodeMAC = senderCodeMAC(code, msg.Key, hello)
+	err = encoder.Encode(hello)
+	if err != nil {
+		return "", fmt.Errorf("encoding sender hello: %w", err)
+	}
+	// Return fingerprint of receiver
+	return fingerprint, nil
+}
+
+// Error returned by SenderKeyExchange if the receiver does not support the action type
+type UnsupportedActionError struct {
+	// Requested action type
+	Type string
+	// Action types supported by the receiver
+	Supported []string
+}
+
+func (err *UnsupportedActionError) Error() string {
+	return "receiver does not support action type " + err.Type + " (supported: " + strings.Join(err.Supported, ", ") + ")"
+}
+
+// Get MAC of the sender hello and the receiver's session key keyed from
+// the session code, or nil if code is empty
+func senderCodeMAC(code string, key *rsa.PublicKey, hello senderHelloMsg) []byte {
+	offer := fmt.Sprintf("%d %t %s", hello.Offer.Port, hello.Offer.Reverse, hello.Offer.Transport)
+	return codeMAC(code, senderCodeKeyInfo, x509.MarshalPKCS1PublicKey(key), hello.EncryptedKey, []byte(offer))
+}
+
+// Get MAC of parts keyed from the session code using HKDF info label
+// info, or nil if code is empty
+//
+// Every part is prefixed with its length, so that parts cannot be
+// shifted into each other.
+func codeMAC(code string, info string, parts ...[]byte) []byte {
+	if code == "" {
+		return nil
+	}
+	// Derive MAC key from code
+	macKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(code), nil, []byte(info)), macKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error deriving code key")
+	}
+	// Authenticate parts
+	mac := hmac.New(sha256.New, macKey)
+	for _, part := range parts {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(part)))
+		mac.Write(length[:])
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// Check whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	// Return received key
-	return recvPubKey
+	return false
 }
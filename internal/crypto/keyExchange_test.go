@@ -0,0 +1,132 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Result of one side of a key exchange
+type exchangeResult struct {
+	fingerprint string
+	offer       TransferOffer
+	sharedKey   string
+	err         error
+}
+
+// Start relay server on a loopback port, stopping it at the end of the test
+func startRelay(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		transfer.RunRelay(listener)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// Exchange keys between a receiver using receiverCode and a sender using
+// senderCode over the relay channel of receiverCode, returning the
+// results of the receiver and the sender
+//
+// The sender joins the receiver's channel even if its code differs, as
+// a relay or anyone else who saw the channel could.
+func exchangeOverRelay(t *testing.T, receiverCode string, senderCode string, actions []string, actionType string) (exchangeResult, exchangeResult) {
+	t.Helper()
+	relayAddr := startRelay(t)
+	identity := LoadIdentity(filepath.Join(t.TempDir(), "identity.pem"))
+	privateKey, publicKey := GenerateRSAKeypair()
+	offer := TransferOffer{Port: 9898, Transport: "quic"}
+	channel := transfer.RelayChannel(receiverCode, "key")
+
+	receiverDone := make(chan exchangeResult, 1)
+	go func() {
+		listener := transfer.ListenRelay(relayAddr, channel)
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			receiverDone <- exchangeResult{err: err}
+			return
+		}
+		_, offer, encryptedKey, err := ReceiverKeyExchange(conn, publicKey, identity, receiverCode, actions)
+		result := exchangeResult{offer: offer, err: err}
+		if err == nil {
+			result.sharedKey, result.err = DecryptKey(encryptedKey, privateKey)
+		}
+		receiverDone <- result
+	}()
+
+	var sender exchangeResult
+	conn, err := transfer.DialRelay(relayAddr, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.sharedKey = "0123456789abcdef0123456789abcdef"
+	sender.fingerprint, sender.err = SenderKeyExchange(conn, offer, sender.sharedKey, identity.Fingerprint(), senderCode, actionType)
+	return <-receiverDone, sender
+}
+
+func TestKeyExchangeOverRelay(t *testing.T) {
+	code := transfer.GenerateCode()
+	receiver, sender := exchangeOverRelay(t, code, code, nil, "file")
+	if receiver.err != nil || sender.err != nil {
+		t.Fatalf("key exchange failed: receiver: %v, sender: %v", receiver.err, sender.err)
+	}
+	if receiver.sharedKey != sender.sharedKey {
+		t.Errorf("receiver got shared key %q, want %q", receiver.sharedKey, sender.sharedKey)
+	}
+	if want := (TransferOffer{Port: 9898, Transport: "quic"}); receiver.offer != want {
+		t.Errorf("receiver got offer %+v, want %+v", receiver.offer, want)
+	}
+}
+
+func TestKeyExchangeRefusesSenderWithoutCode(t *testing.T) {
+	// A sender which only knows the relay channel, like the relay itself,
+	// must not be able to send files
+	code := transfer.GenerateCode()
+	receiver, _ := exchangeOverRelay(t, code, "", nil, "file")
+	if receiver.err == nil || !strings.Contains(receiver.err.Error(), "sender does not know the session code") {
+		t.Errorf("receiver error = %v, want refusal of sender", receiver.err)
+	}
+	if receiver.sharedKey != "" {
+		t.Error("receiver accepted shared key of sender without code")
+	}
+}
+
+func TestKeyExchangeRefusesReceiverWithWrongCode(t *testing.T) {
+	// A receiver substituted by the relay does not know the sender's code
+	receiver, sender := exchangeOverRelay(t, transfer.GenerateCode(), transfer.GenerateCode(), nil, "file")
+	if sender.err == nil || !strings.Contains(sender.err.Error(), "receiver does not know the session code") {
+		t.Errorf("sender error = %v, want refusal of receiver", sender.err)
+	}
+	if receiver.sharedKey != "" {
+		t.Error("sender sent shared key to receiver which does not know the code")
+	}
+}
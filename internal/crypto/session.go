@@ -0,0 +1,135 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HKDF info labels for the keys of each side of the session
+const (
+	serverKeyInfo = "opensend session server key"
+	clientKeyInfo = "opensend session client key"
+	sessionIDInfo = "opensend session id"
+)
+
+// Get ID of the session using the given shared key
+//
+// Both sides derive the same ID from the shared key, so it identifies
+// the transfer without having to be sent during the handshake.
+func SessionID(sharedKey string) string {
+	id := make([]byte, 16)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(sharedKey), nil, []byte(sessionIDInfo)), id)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error deriving session ID")
+	}
+	return hex.EncodeToString(id)
+}
+
+// Create TLS config for the transfer channel, keyed from the shared key
+//
+// Each side derives an Ed25519 key for itself and for its peer from the
+// shared key exchanged during the handshake. Certificates are checked
+// against the derived peer key rather than a CA, so only a peer which
+// knows the shared key can complete the TLS handshake, in both
+// directions.
+func SessionTLSConfig(sharedKey string, server bool) *tls.Config {
+	// Derive keys of both sides
+	serverKey := deriveSessionKey(sharedKey, serverKeyInfo)
+	clientKey := deriveSessionKey(sharedKey, clientKeyInfo)
+	// Select own and peer key depending on side
+	ownKey, peerKey := clientKey, serverKey
+	if server {
+		ownKey, peerKey = serverKey, clientKey
+	}
+	// Create self-signed certificate for own key
+	cert := sessionCertificate(ownKey)
+	// Get expected public key of peer
+	expectedPeer := peerKey.Public().(ed25519.PublicKey)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// Certificates are verified against the derived key in VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("peer did not present a certificate")
+			}
+			peerCert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			peerPub, ok := peerCert.PublicKey.(ed25519.PublicKey)
+			if !ok || !bytes.Equal(peerPub, expectedPeer) {
+				return errors.New("peer is not part of this session")
+			}
+			return nil
+		},
+	}
+	// Require client to present a certificate
+	if server {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	return config
+}
+
+// Derive Ed25519 key from shared key using HKDF-SHA256
+func deriveSessionKey(sharedKey string, info string) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(sharedKey), nil, []byte(info)), seed)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error deriving session key")
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// Create self-signed certificate for key
+func sessionCertificate(key ed25519.PrivateKey) tls.Certificate {
+	// Create random serial number
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating certificate serial")
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "opensend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	// Create DER encoded certificate
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error creating session certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
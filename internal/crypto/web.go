@@ -0,0 +1,97 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Validity of certificates of web pages
+const webCertValidity = 24 * time.Hour
+
+// Create TLS config for web pages served to browsers on hosts
+//
+// Browsers do not accept the Ed25519 session certificates, so a new
+// ECDSA certificate is created instead. It is self-signed, so browsers
+// will warn about it. Returns the config and the SHA-256 fingerprint of
+// the certificate, formatted like browsers show it, so that users can
+// check they are connected to this page.
+func WebTLSConfig(hosts []string) (*tls.Config, string) {
+	// Generate key for certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating web key")
+	}
+	// Create random serial number
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating serial number")
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "opensend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(webCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	// Add hosts to certificate
+	for _, host := range hosts {
+		ipStr := host
+		if i := strings.LastIndexByte(host, '%'); i != -1 {
+			ipStr = host[:i]
+		}
+		if ip := net.ParseIP(ipStr); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	// Self-sign certificate
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error creating web certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return config, certFingerprint(der)
+}
+
+// Get SHA-256 fingerprint of certificate as colon-separated hex
+func certFingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	parts := make([]string, len(hash))
+	for index, b := range hash {
+		parts[index] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
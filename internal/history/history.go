@@ -0,0 +1,195 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Direction of a transfer as seen from this device
+const (
+	Send    = "send"
+	Receive = "receive"
+)
+
+// Outcome of a transfer
+const (
+	OK     = "ok"
+	Failed = "failed"
+)
+
+// Transfer recorded in the history
+type Record struct {
+	// Time the session started
+	Time time.Time `json:"time"`
+	// Direction of the transfer, Send or Receive
+	Direction string `json:"direction"`
+	// Address of the other side
+	PeerAddr string `json:"peer_addr"`
+	// Fingerprint of the receiver's identity, if known
+	//
+	// Only recorded by senders: senders have no identity, so receivers
+	// only authenticate them by the session code, if one is used.
+	PeerFingerprint string `json:"peer_fingerprint,omitempty"`
+	// Session ID derived from the shared key
+	Session string `json:"session,omitempty"`
+	// Action type and data of the transfer
+	Action string `json:"action"`
+	Data   string `json:"data"`
+	// Transferred files
+	Files []File `json:"files"`
+	// Total size of the files
+	Size int64 `json:"size"`
+	// Duration of the session in seconds
+	Duration float64 `json:"duration"`
+	// Outcome of the session, OK or Failed
+	Outcome string `json:"outcome"`
+	// Error which made the session fail
+	Error string `json:"error,omitempty"`
+}
+
+// File recorded in the history
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"sha256"`
+	// Whether the file was deleted by a sync instead of transferred
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Append record to the JSON-lines history at path, creating it if needed
+func Append(path string, record Record) error {
+	// Create parent directory of history, readable only by the user
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(record)
+}
+
+// Maximum length of a record in the history
+//
+// Records listing many files can be long.
+var maxRecordSize = 64 << 20
+
+// Read all records of the JSON-lines history at path, oldest first
+//
+// A history which does not exist yet is empty. Blank lines are skipped,
+// and lines longer than maxRecordSize fail with bufio.ErrTooLong.
+func Read(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxRecordSize)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Filter of history records, empty fields match every record
+type Filter struct {
+	// Glob matched against address, host and fingerprint of the peer
+	Peer string
+	// Direction, Send or Receive
+	Direction string
+	// Action type
+	Action string
+	// Outcome, OK or Failed
+	Outcome string
+	// Only records of sessions started in this time range
+	Since time.Time
+	Until time.Time
+}
+
+// Check whether record matches filter
+func (filter Filter) Match(record Record) bool {
+	if filter.Peer != "" && !matchPeer(filter.Peer, record) {
+		return false
+	}
+	if filter.Direction != "" && filter.Direction != record.Direction {
+		return false
+	}
+	if filter.Action != "" && filter.Action != record.Action {
+		return false
+	}
+	if filter.Outcome != "" && filter.Outcome != record.Outcome {
+		return false
+	}
+	if !filter.Since.IsZero() && record.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !record.Time.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// Check whether glob matches address, host or fingerprint of the peer of record
+func matchPeer(glob string, record Record) bool {
+	candidates := []string{record.PeerAddr, record.PeerFingerprint}
+	if host, _, err := net.SplitHostPort(record.PeerAddr); err == nil {
+		candidates = append(candidates, host)
+	}
+	for _, candidate := range candidates {
+		if matchGlob(glob, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether value matches glob, case-insensitively, or contains it if
+// it has no wildcards
+//
+// Only * and ? make glob a pattern, so that bracketed IPv6 addresses
+// such as [fe80::2%eth0]:9797 are matched literally.
+func matchGlob(glob string, value string) bool {
+	glob, value = strings.ToLower(glob), strings.ToLower(value)
+	if !strings.ContainsAny(glob, "*?") {
+		return value != "" && strings.Contains(value, glob)
+	}
+	matched, _ := path.Match(glob, value)
+	return matched
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		glob  string
+		value string
+		match bool
+	}{
+		{"192.168.1.2", "192.168.1.2:9797", true},
+		{"168.1", "192.168.1.2", true},
+		{"LAPTOP", "laptop.local", true},
+		{"laptop", "", false},
+		{"192.168.1.*", "192.168.1.2", true},
+		{"192.168.1.*", "192.168.2.2", false},
+		{"ab:cd:??", "AB:CD:EF", true},
+		{"ab:cd:?", "AB:CD:EF", false},
+		{"[ab]b:*", "BB:CD", true},
+		{"[fe80::2%eth0]:9797", "[FE80::2%eth0]:9797", true},
+		{"[fe80::2", "[fe80::2]:9797", true},
+		{"[*", "[fe80::2]:9797", false},
+	}
+	for _, test := range tests {
+		if match := matchGlob(test.glob, test.value); match != test.match {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.glob, test.value, match, test.match)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	record := Record{
+		Time:            start,
+		Direction:       Send,
+		PeerAddr:        "[fe80::2%eth0]:9797",
+		PeerFingerprint: "AB:CD:EF",
+		Action:          "file",
+		Outcome:         OK,
+	}
+	tests := []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"empty", Filter{}, true},
+		{"peer address", Filter{Peer: "[fe80::2%eth0]:9797"}, true},
+		{"peer host", Filter{Peer: "fe80::2%eth0"}, true},
+		{"peer host glob", Filter{Peer: "fe80::*"}, true},
+		{"peer fingerprint", Filter{Peer: "ab:cd"}, true},
+		{"other peer", Filter{Peer: "192.168.*"}, false},
+		{"direction", Filter{Direction: Send}, true},
+		{"other direction", Filter{Direction: Receive}, false},
+		{"action", Filter{Action: "file"}, true},
+		{"other action", Filter{Action: "dir"}, false},
+		{"outcome", Filter{Outcome: OK}, true},
+		{"other outcome", Filter{Outcome: Failed}, false},
+		{"since start", Filter{Since: start}, true},
+		{"since later", Filter{Since: start.Add(time.Second)}, false},
+		{"until start", Filter{Until: start}, false},
+		{"until later", Filter{Until: start.Add(time.Second)}, true},
+		{"all fields", Filter{Peer: "ab:*", Direction: Send, Action: "file", Outcome: OK, Since: start, Until: start.Add(time.Hour)}, true},
+		{"one field differs", Filter{Peer: "ab:*", Direction: Send, Action: "url"}, false},
+	}
+	for _, test := range tests {
+		if match := test.filter.Match(record); match != test.match {
+			t.Errorf("%s: Match() = %v, want %v", test.name, match, test.match)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	// History which does not exist yet is empty
+	records, err := Read(path)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Read() of missing history = %v, %v, want no records", records, err)
+	}
+
+	for _, action := range []string{"file", "dir"} {
+		if err := Append(path, Record{Action: action, Files: []File{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Blank lines are skipped
+	appendLine(t, path, "")
+	appendLine(t, path, "  \t")
+	if err := Append(path, Record{Action: "url", Files: []File{}}); err != nil {
+		t.Fatal(err)
+	}
+	records, err = Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Action != "file" || records[1].Action != "dir" || records[2].Action != "url" {
+		t.Errorf("Read() = %+v, want file, dir and url records in order", records)
+	}
+
+	// Invalid records fail
+	appendLine(t, path, "{")
+	if _, err := Read(path); err == nil {
+		t.Error("Read() with invalid record succeeded, want error")
+	}
+}
+
+func TestReadOversizedLine(t *testing.T) {
+	defer func(size int) { maxRecordSize = size }(maxRecordSize)
+	maxRecordSize = 1024
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	// Record just below the limit is read
+	if err := Append(path, Record{Data: strings.Repeat("a", 800)}); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := Read(path); err != nil || len(records) != 1 {
+		t.Fatalf("Read() = %d records, %v, want 1 record", len(records), err)
+	}
+	// Record above the limit fails
+	if err := Append(path, Record{Data: strings.Repeat("a", 2048)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(path); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("Read() with oversized line error = %v, want %v", err, bufio.ErrTooLong)
+	}
+}
+
+// Append raw line to file at path
+func appendLine(t *testing.T, path string, line string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package serialization
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/browser"
+)
+
+// Handler of an action type
+//
+// Senders validate parameters and collect the files they need into the
+// work directory, receivers execute the action once the files are
+// received. New action types are added using RegisterAction.
+type Action interface {
+	// Make sure action data of parameters is valid before sending
+	Validate(parameters *Parameters) error
+	// Collect files needed by the action into dir, replacing action data
+	// of parameters with what the receiver needs to find them
+	Collect(parameters *Parameters, dir string) error
+	// Describe action of parameters for the user
+	Describe(parameters *Parameters) string
+	// Execute action of parameters using files received in srcDir,
+	// delivering them to destDir
+	Execute(parameters *Parameters, srcDir string, destDir string) error
+}
+
+var (
+	actionsMtx sync.RWMutex
+	actions    = map[string]Action{}
+)
+
+// Register handler of action type name, replacing any existing handler
+func RegisterAction(name string, action Action) {
+	actionsMtx.Lock()
+	defer actionsMtx.Unlock()
+	actions[name] = action
+}
+
+// Get handler of action type name
+func LookupAction(name string) (Action, bool) {
+	actionsMtx.RLock()
+	defer actionsMtx.RUnlock()
+	action, ok := actions[name]
+	return action, ok
+}
+
+// Get names of all registered action types, sorted
+func ActionTypes() []string {
+	actionsMtx.RLock()
+	defer actionsMtx.RUnlock()
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterAction("file", fileAction{})
+	RegisterAction("url", urlAction{})
+	RegisterAction("dir", dirAction{})
+	RegisterAction("sync", syncAction{})
+}
+
+// Action sending a single file
+type fileAction struct{}
+
+func (fileAction) Validate(parameters *Parameters) error {
+	return nil
+}
+
+func (fileAction) Collect(parameters *Parameters, dir string) error {
+	// Open file path in parameters.ActionData
+	src, err := os.Open(parameters.ActionData)
+	if err != nil {
+		return fmt.Errorf("opening file from parameters: %w", err)
+	}
+	// Close source file at the end of this function
+	defer src.Close()
+	// Create new file with the same name at given directory
+	dst, err := os.Create(dir + "/" + filepath.Base(parameters.ActionData))
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	// Copy data from source file to destination file
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return fmt.Errorf("copying data to file: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// Replace file path in parameters.ActionData with file name
+	parameters.ActionData = filepath.Base(parameters.ActionData)
+	return nil
+}
+
+func (fileAction) Describe(parameters *Parameters) string {
+	return "file " + parameters.ActionData
+}
+
+func (fileAction) Execute(parameters *Parameters, srcDir string, destDir string) error {
+	// Make sure file sent by the sender cannot escape the destination directory
+	if !filepath.IsLocal(parameters.ActionData) {
+		return errors.New("invalid file name: " + parameters.ActionData)
+	}
+	// Open file from parameters at given directory
+	src, err := os.Open(srcDir + "/" + parameters.ActionData)
+	if err != nil {
+		return fmt.Errorf("reading file from parameters: %w", err)
+	}
+	// Close source file at the end of this function
+	defer src.Close()
+	// Create file in user's Downloads directory
+	dst, err := os.Create(filepath.Clean(destDir) + "/" + parameters.ActionData)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	// Copy data from source file to destination file
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return fmt.Errorf("copying data to file: %w", err)
+	}
+	return dst.Close()
+}
+
+// Action opening a URL in the receiver's browser
+type urlAction struct{}
+
+func (urlAction) Validate(parameters *Parameters) error {
+	return validateURL(parameters.ActionData)
+}
+
+func (urlAction) Collect(parameters *Parameters, dir string) error {
+	return nil
+}
+
+func (urlAction) Describe(parameters *Parameters) string {
+	return "URL " + parameters.ActionData
+}
+
+func (urlAction) Execute(parameters *Parameters, srcDir string, destDir string) error {
+	// Make sure received URL is valid
+	if err := validateURL(parameters.ActionData); err != nil {
+		return err
+	}
+	// Attempt to open URL in browser
+	err := browser.OpenURL(parameters.ActionData)
+	if err != nil {
+		return fmt.Errorf("opening browser: %w", err)
+	}
+	return nil
+}
+
+// Make sure rawURL is a valid URL with scheme and host
+func validateURL(rawURL string) error {
+	// Parse URL
+	urlParser, err := url.Parse(rawURL)
+	// If there was an error parsing
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+		// If scheme is not detected
+	} else if urlParser.Scheme == "" {
+		return errors.New("invalid URL scheme")
+		// If host is not detected
+	} else if urlParser.Host == "" {
+		return errors.New("invalid URL host")
+	}
+	return nil
+}
+
+// Action sending a directory tree
+type dirAction struct{}
+
+func (dirAction) Validate(parameters *Parameters) error {
+	return nil
+}
+
+func (dirAction) Collect(parameters *Parameters, dir string) error {
+	// Copy directory tree into given directory, so that every file is sent separately
+	err := copyTree(parameters.ActionData, filepath.Join(dir, filepath.Base(parameters.ActionData)))
+	if err != nil {
+		return fmt.Errorf("copying directory: %w", err)
+	}
+	// Set parameters data to base path for receiver
+	parameters.ActionData = filepath.Base(parameters.ActionData)
+	return nil
+}
+
+func (dirAction) Describe(parameters *Parameters) string {
+	return "directory " + parameters.ActionData
+}
+
+func (dirAction) Execute(parameters *Parameters, srcDir string, destDir string) error {
+	// Make sure directory sent by the sender cannot escape the destination directory
+	if !isLocalDir(parameters.ActionData) {
+		return errors.New("invalid directory name: " + parameters.ActionData)
+	}
+	// Copy received directory tree to ~/Downloads/{dir name}
+	return copyTree(filepath.Join(srcDir, parameters.ActionData), filepath.Join(destDir, parameters.ActionData))
+}
+
+// Action syncing a directory into the receiver's destination directory
+//
+// The receiver plans the sync using PlanSync before receiving files.
+type syncAction struct{}
+
+func (syncAction) Validate(parameters *Parameters) error {
+	// Make sure synced directory exists
+	info, err := os.Stat(parameters.ActionData)
+	if err != nil || !info.IsDir() {
+		return errors.New("synced directory does not exist: " + parameters.ActionData)
+	}
+	// Make sure remote directory is within the receiver's destination directory
+	if !isLocalDir(parameters.Sync.Dir) {
+		return errors.New("invalid remote directory: " + parameters.Sync.Dir)
+	}
+	return nil
+}
+
+func (syncAction) Collect(parameters *Parameters, dir string) error {
+	// Copy directory tree into given directory under the remote directory
+	err := copyTree(parameters.ActionData, filepath.Join(dir, filepath.FromSlash(parameters.Sync.Dir)))
+	if err != nil {
+		return fmt.Errorf("copying directory: %w", err)
+	}
+	// Set parameters data to remote directory for receiver
+	parameters.ActionData = parameters.Sync.Dir
+	return nil
+}
+
+func (syncAction) Describe(parameters *Parameters) string {
+	return "sync of directory " + parameters.ActionData
+}
+
+func (syncAction) Execute(parameters *Parameters, srcDir string, destDir string) error {
+	// Copy received files and delete extraneous ones as planned
+	return parameters.applySync(srcDir, destDir)
+}
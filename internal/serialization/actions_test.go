@@ -0,0 +1,153 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package serialization
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/crypto"
+)
+
+// Action doing nothing, registered by tests
+type testAction struct{}
+
+func (testAction) Validate(parameters *Parameters) error            { return nil }
+func (testAction) Collect(parameters *Parameters, dir string) error { return nil }
+func (testAction) Describe(parameters *Parameters) string           { return "test" }
+func (testAction) Execute(parameters *Parameters, srcDir string, destDir string) error {
+	return nil
+}
+
+func TestActionRegistry(t *testing.T) {
+	if want := []string{"dir", "file", "sync", "url"}; !reflect.DeepEqual(ActionTypes(), want) {
+		t.Fatalf("ActionTypes() = %v, want %v", ActionTypes(), want)
+	}
+	RegisterAction("test", testAction{})
+	defer func() {
+		actionsMtx.Lock()
+		delete(actions, "test")
+		actionsMtx.Unlock()
+	}()
+	if _, ok := LookupAction("test"); !ok {
+		t.Error("LookupAction() did not find registered action")
+	}
+	if want := []string{"dir", "file", "sync", "test", "url"}; !reflect.DeepEqual(ActionTypes(), want) {
+		t.Errorf("ActionTypes() = %v, want %v", ActionTypes(), want)
+	}
+	if _, ok := LookupAction("unknown"); ok {
+		t.Error("LookupAction() found unregistered action")
+	}
+}
+
+func TestKeyExchangeRefusesUnregisteredAction(t *testing.T) {
+	identity := crypto.LoadIdentity(filepath.Join(t.TempDir(), "identity.pem"))
+	_, publicKey := crypto.GenerateRSAKeypair()
+	receiverConn, senderConn := net.Pipe()
+
+	// Receiver supports the registered action types
+	receiverDone := make(chan error, 1)
+	go func() {
+		defer receiverConn.Close()
+		_, _, _, err := crypto.ReceiverKeyExchange(receiverConn, publicKey, identity, "", ActionTypes())
+		receiverDone <- err
+	}()
+
+	_, err := crypto.SenderKeyExchange(senderConn, crypto.TransferOffer{Port: 9898}, "0123456789abcdef0123456789abcdef", identity.Fingerprint(), "", "unregistered")
+	senderConn.Close()
+	var unsupported *crypto.UnsupportedActionError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("SenderKeyExchange() error = %v, want UnsupportedActionError", err)
+	}
+	if unsupported.Type != "unregistered" || !reflect.DeepEqual(unsupported.Supported, ActionTypes()) {
+		t.Errorf("SenderKeyExchange() error = %+v, want type unregistered and supported %v", unsupported, ActionTypes())
+	}
+	// Receiver never gets a shared key
+	if err := <-receiverDone; err == nil {
+		t.Error("ReceiverKeyExchange() succeeded, want error")
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url string
+		err bool
+	}{
+		{"https://example.com/page", false},
+		{"example.com", true},
+		{"https://", true},
+		{"://example.com", true},
+	}
+	for _, test := range tests {
+		err := NewParameters("url", test.url).Validate()
+		if (err != nil) != test.err {
+			t.Errorf("Validate() of URL %q = %v, want error %v", test.url, err, test.err)
+		}
+	}
+}
+
+func TestExecuteRefusesTraversal(t *testing.T) {
+	root := t.TempDir()
+	// Received files are in work/src, next to files a sender could try to reach
+	srcDir := filepath.Join(root, "work", "src")
+	destDir := filepath.Join(root, "dest", "sub")
+	for _, dir := range []string{srcDir, destDir, filepath.Join(root, "work", "tree"), filepath.Join(srcDir, "tree")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{filepath.Join(root, "work", "file.txt"), filepath.Join(root, "work", "tree", "a.txt"), filepath.Join(srcDir, "file.txt"), filepath.Join(srcDir, "tree", "a.txt")} {
+		if err := os.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		action string
+		data   string
+		err    bool
+		// Path relative to root which must not exist afterwards
+		escaped string
+	}{
+		{"file", "file.txt", false, ""},
+		{"file", "../file.txt", true, "dest/file.txt"},
+		{"file", "sub/../../file.txt", true, "dest/file.txt"},
+		{"file", filepath.Join(root, "work", "file.txt"), true, ""},
+		{"file", "", true, ""},
+		{"dir", "tree", false, ""},
+		{"dir", "../tree", true, "dest/tree"},
+		{"dir", "./../tree", true, "dest/tree"},
+		{"dir", "/tree", true, ""},
+		{"dir", ".", true, ""},
+	}
+	for _, test := range tests {
+		err := NewParameters(test.action, test.data).ExecuteAction(srcDir, destDir)
+		if (err != nil) != test.err {
+			t.Errorf("ExecuteAction() of %s %q = %v, want error %v", test.action, test.data, err, test.err)
+		}
+		if test.escaped == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(test.escaped))); !os.IsNotExist(err) {
+			t.Errorf("ExecuteAction() of %s %q wrote outside destination directory", test.action, test.data)
+		}
+	}
+}
@@ -17,24 +17,38 @@
 package serialization
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 
-	"github.com/mholt/archiver/v3"
-	"github.com/pkg/browser"
 	"github.com/rs/zerolog/log"
 	"github.com/vmihailenco/msgpack/v5"
+	"go.arsenm.dev/opensend/internal/crypto"
 )
 
+// Version of the parameters format
+const ParametersVersion = 1
+
+// Name of the sealed parameters file in the work directory
+const ParametersFile = "parameters.msgpack.enc"
+
 // Create config type to store action type and data
 type Parameters struct {
+	// Version of the parameters format
+	Version int
+	// ID of the session the parameters were created for
+	SessionID  string
 	ActionType string
 	ActionData string
+	// Options of the sync action
+	Sync SyncOptions
+
+	// Plan of the sync action, created by PlanSync
+	plan *SyncPlan
 }
 
 // Instantiate and return a new Config struct
@@ -42,31 +56,23 @@ func NewParameters(actionType string, actionData string) *Parameters {
 	return &Parameters{ActionType: actionType, ActionData: actionData}
 }
 
-func (parameters *Parameters) Validate() {
-	if parameters.ActionType == "url" {
-		// Parse URL in parameters
-		urlParser, err := url.Parse(parameters.ActionData)
-		// If there was an error parsing
-		if err != nil {
-			// Alert user of invalid url
-			log.Fatal().Err(err).Msg("Invalid URL")
-			// If scheme is not detected
-		} else if urlParser.Scheme == "" {
-			// Alert user of invalid scheme
-			log.Fatal().Msg("Invalid URL scheme")
-			// If host is not detected
-		} else if urlParser.Host == "" {
-			// Alert user of invalid host
-			log.Fatal().Msg("Invalid URL host")
-		}
-	}
+// Make sure action type is registered and action data is valid
+func (parameters *Parameters) Validate() error {
+	return parameters.Action().Validate(parameters)
 }
 
-// Create config file
-func (parameters *Parameters) CreateFile(dir string) {
+// Create sealed config file for the session using the shared key
+//
+// The parameters are encrypted with the session's protocol version and
+// ID as associated data, so that they cannot be modified or replayed
+// into a different transfer.
+func (parameters *Parameters) CreateFile(dir string, sharedKey string) {
 	// Use ConsoleWriter logger
+	// Bind parameters to this version and session
+	parameters.Version = ParametersVersion
+	parameters.SessionID = crypto.SessionID(sharedKey)
 	// Create parameters file at given directory
-	configFile, err := os.Create(dir + "/parameters.msgpack")
+	configFile, err := os.Create(filepath.Join(dir, ParametersFile))
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error creating parameters file")
 	}
@@ -77,128 +83,122 @@ func (parameters *Parameters) CreateFile(dir string) {
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error encoding MessagePack")
 	}
-	// Write []byte to previously created parameters file
-	bytesWritten, err := configFile.Write(MessagePackData)
+	// Encrypt MessagePack data, authenticating version and session ID
+	sealedData := crypto.EncryptBytes(MessagePackData, sharedKey, parametersAD(parameters.SessionID))
+	// Write sealed data to previously created parameters file
+	bytesWritten, err := configFile.Write(sealedData)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error writing MessagePack to file")
 	}
 	// Log bytes written
-	log.Info().Str("file", "parameters.msgpack").Msg("Wrote " + strconv.Itoa(bytesWritten) + " bytes")
+	log.Info().Str("file", ParametersFile).Msg("Wrote " + strconv.Itoa(bytesWritten) + " bytes")
 }
 
 // Collect all required files into given directory
-func (parameters *Parameters) CollectFiles(dir string) {
-	// Use ConsoleWriter logger
-	// If action type is file
-	if parameters.ActionType == "file" {
-		// Open file path in parameters.ActionData
-		src, err := os.Open(parameters.ActionData)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error opening file from parameters")
-		}
-		// Close source file at the end of this function
-		defer src.Close()
-		// Create new file with the same name at given directory
-		dst, err := os.Create(dir + "/" + filepath.Base(parameters.ActionData))
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error creating file")
-		}
-		// Close new file at the end of this function
-		defer dst.Close()
-		// Copy data from source file to destination file
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error copying data to file")
-		}
-		// Replace file path in parameters.ActionData with file name
-		parameters.ActionData = filepath.Base(parameters.ActionData)
-	} else if parameters.ActionType == "dir" {
-		err := archiver.Archive([]string{parameters.ActionData}, dir+"/"+filepath.Base(parameters.ActionData)+".tar")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error creating tar archive")
-		}
-		// Set parameters data to base path for receiver
-		parameters.ActionData = filepath.Base(parameters.ActionData)
-	}
+func (parameters *Parameters) CollectFiles(dir string) error {
+	return parameters.Action().Collect(parameters, dir)
 }
 
-// Read config file at given file path
-func (parameters *Parameters) ReadFile(filePath string) {
-	// Use ConsoleWriter logger
+// Read sealed config file at given file path using the shared key
+//
+// Fails if the file was not created for the session using sharedKey.
+func (parameters *Parameters) ReadFile(filePath string, sharedKey string) error {
 	// Read file at filePath
 	fileData, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading parameters file")
+		return fmt.Errorf("reading parameters file: %w", err)
+	}
+	// Get ID of current session
+	sessionID := crypto.SessionID(sharedKey)
+	// Decrypt file data, verifying version and session ID
+	MessagePackData, err := crypto.DecryptBytes(fileData, sharedKey, parametersAD(sessionID))
+	if err != nil {
+		return fmt.Errorf("parameters were not sealed for this session: %w", err)
 	}
 	// Unmarshal data from MessagePack into parameters struct
-	err = msgpack.Unmarshal(fileData, parameters)
+	err = msgpack.Unmarshal(MessagePackData, parameters)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error decoding MessagePack")
+		return fmt.Errorf("decoding MessagePack: %w", err)
+	}
+	// Make sure parameters are of this version
+	if parameters.Version != ParametersVersion {
+		return fmt.Errorf("unsupported parameters version %d", parameters.Version)
+	}
+	// Make sure parameters are from this session
+	if parameters.SessionID != sessionID {
+		return errors.New("parameters are from a different session: " + parameters.SessionID)
 	}
+	return nil
+}
+
+// Get associated data binding parameters to a version and session
+func parametersAD(sessionID string) []byte {
+	return []byte("opensend parameters v" + strconv.Itoa(ParametersVersion) + " " + sessionID)
 }
 
 // Execute action specified in config
-func (parameters *Parameters) ExecuteAction(srcDir string, destDir string) {
-	// Use ConsoleWriter logger
-	// If action is file
-	switch parameters.ActionType {
-	case "file":
-		// Open file from parameters at given directory
-		src, err := os.Open(srcDir + "/" + parameters.ActionData)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error reading file from parameters")
-		}
-		// Close source file at the end of this function
-		defer src.Close()
-		// Create file in user's Downloads directory
-		dst, err := os.Create(filepath.Clean(destDir) + "/" + parameters.ActionData)
+func (parameters *Parameters) ExecuteAction(srcDir string, destDir string) error {
+	return parameters.Action().Execute(parameters, srcDir, destDir)
+}
+
+// Get handler of action type, fatally logging if it is not registered
+func (parameters *Parameters) Action() Action {
+	action, ok := LookupAction(parameters.ActionType)
+	if !ok {
+		log.Fatal().Str("type", parameters.ActionType).Strs("supported", ActionTypes()).Msg("Unknown action type")
+	}
+	return action
+}
+
+// Describe action for the user
+func (parameters *Parameters) Describe() string {
+	return parameters.Action().Describe(parameters)
+}
+
+// Copy all files in directory tree at src into dst, creating directories as needed
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error creating file")
+			return err
 		}
-		// Close destination file at the end of this function
-		defer dst.Close()
-		// Copy data from source file to destination file
-		_, err = io.Copy(dst, src)
+		// Get path of file in dst
+		relPath, err := filepath.Rel(src, path)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error copying data to file")
+			return err
 		}
-		// If action is url
-	case "url":
-		// Parse received URL
-		urlParser, err := url.Parse(parameters.ActionData)
-		// If there was an error parsing
-		if err != nil {
-			// Alert user of invalid url
-			log.Fatal().Err(err).Msg("Invalid URL")
-			// If scheme is not detected
-		} else if urlParser.Scheme == "" {
-			// Alert user of invalid scheme
-			log.Fatal().Msg("Invalid URL scheme")
-			// If host is not detected
-		} else if urlParser.Host == "" {
-			// Alert user of invalid host
-			log.Fatal().Msg("Invalid URL host")
+		dstPath := filepath.Join(dst, relPath)
+		// If directory, create it
+		if info.IsDir() {
+			return os.MkdirAll(dstPath, 0755)
 		}
-		// Attempt to open URL in browser
-		err = browser.OpenURL(parameters.ActionData)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error opening browser")
+		// Skip anything but regular files
+		if !info.Mode().IsRegular() {
+			return nil
 		}
-		// If action is dir
-	case "dir":
-		// Set destination directory to ~/Downloads/{dir name}
-		dstDir := filepath.Dir(filepath.Clean(destDir) + "/" + parameters.ActionData)
-
-		fmt.Println(dstDir)
+		return copyFile(path, dstPath)
+	})
+}
 
-		err := archiver.Unarchive(srcDir+"/"+parameters.ActionData+".tar", dstDir)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error extracting tar archive")
-		}
-		// Loop to recursively unarchive tar file
-		// Catchall
-	default:
-		// Log unknown action type
-		log.Fatal().Msg("Unknown action type " + parameters.ActionType)
+// Copy file at src to dst, keeping its permissions
+func copyFile(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstFile, srcFile)
+	dstFile.Close()
+	if err != nil {
+		return err
 	}
+	// Keep modification time, so that synced files can be compared
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
 }
@@ -0,0 +1,95 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package serialization
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"go.arsenm.dev/opensend/internal/crypto"
+)
+
+const (
+	testKey      = "0123456789abcdef0123456789abcdef"
+	otherTestKey = "fedcba9876543210fedcba9876543210"
+)
+
+func TestParametersRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	NewParameters("file", "photo.jpg").CreateFile(dir, testKey)
+	parameters := &Parameters{}
+	if err := parameters.ReadFile(filepath.Join(dir, ParametersFile), testKey); err != nil {
+		t.Fatal(err)
+	}
+	if parameters.ActionType != "file" || parameters.ActionData != "photo.jpg" || parameters.SessionID != crypto.SessionID(testKey) {
+		t.Errorf("ReadFile() = %+v, want file photo.jpg of the session", parameters)
+	}
+}
+
+func TestParametersRejectOtherSession(t *testing.T) {
+	// Parameters sealed for another session, such as replayed from it
+	dir := t.TempDir()
+	NewParameters("file", "photo.jpg").CreateFile(dir, otherTestKey)
+	if err := (&Parameters{}).ReadFile(filepath.Join(dir, ParametersFile), testKey); err == nil {
+		t.Error("ReadFile() of parameters of another session succeeded, want error")
+	}
+}
+
+func TestParametersRejectTampered(t *testing.T) {
+	dir := t.TempDir()
+	NewParameters("file", "photo.jpg").CreateFile(dir, testKey)
+	path := filepath.Join(dir, ParametersFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Parameters{}).ReadFile(path, testKey); err == nil {
+		t.Error("ReadFile() of tampered parameters succeeded, want error")
+	}
+}
+
+func TestParametersRejectMismatchedFields(t *testing.T) {
+	sessionID := crypto.SessionID(testKey)
+	tests := []struct {
+		name       string
+		parameters Parameters
+	}{
+		{"other version", Parameters{Version: ParametersVersion + 1, SessionID: sessionID, ActionType: "file"}},
+		{"other session ID", Parameters{Version: ParametersVersion, SessionID: crypto.SessionID(otherTestKey), ActionType: "file"}},
+	}
+	for _, test := range tests {
+		// Seal parameters with the associated data of this session, so
+		// that only the fields inside differ
+		data, err := msgpack.Marshal(test.parameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), ParametersFile)
+		if err := ioutil.WriteFile(path, crypto.EncryptBytes(data, testKey, parametersAD(sessionID)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Parameters{}).ReadFile(path, testKey); err == nil {
+			t.Errorf("%s: ReadFile() succeeded, want error", test.name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package serialization
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Options of the sync action
+type SyncOptions struct {
+	// Path of the synced directory relative to the receiver's destination directory
+	Dir string
+	// Delete files on the receiver which do not exist on the sender
+	Delete bool
+	// Only report the changes without transferring or deleting files
+	DryRun bool
+}
+
+// Changes needed to sync the receiver's directory with the sender's
+type SyncPlan struct {
+	// Files which do not exist on the receiver
+	New []string
+	// Files which differ on the receiver
+	Changed []string
+	// Number of files which are identical on the receiver
+	Unchanged int
+	// Files on the receiver which do not exist on the sender, if deletion was requested
+	Delete []string
+	// Whether the plan is only reported and not applied
+	DryRun bool
+	// Set of new and changed files, created by the first call to Needs
+	needed map[string]bool
+}
+
+// Compare files in manifest with the synced directory in destDir and plan
+// the changes needed to sync it
+//
+// Files are compared by size and modification time, and by hash if only
+// the modification time differs.
+func (parameters *Parameters) PlanSync(manifest *transfer.Manifest, destDir string) (*SyncPlan, error) {
+	// Make sure synced directory cannot escape the destination directory
+	if !isLocalDir(parameters.ActionData) {
+		return nil, errors.New("invalid sync directory: " + parameters.ActionData)
+	}
+	plan := &SyncPlan{DryRun: parameters.Sync.DryRun}
+	// Create set of files offered by sender
+	offered := map[string]bool{}
+	for _, entry := range manifest.Files {
+		// Make sure file is within synced directory
+		if !strings.HasPrefix(entry.Name, parameters.ActionData+"/") {
+			return nil, errors.New("file outside of synced directory: " + entry.Name)
+		}
+		offered[entry.Name] = true
+		// Get info of existing file
+		info, err := os.Stat(filepath.Join(destDir, filepath.FromSlash(entry.Name)))
+		if os.IsNotExist(err) {
+			plan.New = append(plan.New, entry.Name)
+		} else if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size {
+			plan.Changed = append(plan.Changed, entry.Name)
+		} else if info.ModTime().Equal(time.Unix(0, entry.ModTime)) {
+			plan.Unchanged++
+		} else if transfer.HashFile(filepath.Join(destDir, filepath.FromSlash(entry.Name))) == entry.Hash {
+			plan.Unchanged++
+		} else {
+			plan.Changed = append(plan.Changed, entry.Name)
+		}
+	}
+	// If deletion was requested
+	if parameters.Sync.Delete {
+		root := filepath.Join(destDir, filepath.FromSlash(parameters.ActionData))
+		// Find files in synced directory which are not offered by sender
+		err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) && filePath == root {
+				return filepath.SkipDir
+			} else if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			relPath, err := filepath.Rel(destDir, filePath)
+			if err != nil {
+				return err
+			}
+			if name := filepath.ToSlash(relPath); !offered[name] {
+				plan.Delete = append(plan.Delete, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading synced directory: %w", err)
+		}
+	}
+	// Keep plan to apply it in ExecuteAction
+	parameters.plan = plan
+	return plan, nil
+}
+
+// Check whether plan requires file of entry to be transferred
+func (plan *SyncPlan) Needs(entry transfer.ManifestEntry) bool {
+	if plan.needed == nil {
+		plan.needed = make(map[string]bool, len(plan.New)+len(plan.Changed))
+		for _, name := range plan.New {
+			plan.needed[name] = true
+		}
+		for _, name := range plan.Changed {
+			plan.needed[name] = true
+		}
+	}
+	return plan.needed[entry.Name]
+}
+
+// Encode plan as MessagePack
+func (plan *SyncPlan) Marshal() []byte {
+	data, err := msgpack.Marshal(plan)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error encoding sync plan")
+	}
+	return data
+}
+
+// Decode plan from MessagePack
+func ParseSyncPlan(data []byte) *SyncPlan {
+	plan := &SyncPlan{}
+	err := msgpack.Unmarshal(data, plan)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error decoding sync plan")
+	}
+	return plan
+}
+
+// Apply planned sync using received files in srcDir
+func (parameters *Parameters) applySync(srcDir string, destDir string) error {
+	// Make sure a plan was created
+	if parameters.plan == nil {
+		return errors.New("sync was not planned")
+	}
+	// Get received and destination synced directories
+	received := filepath.Join(srcDir, filepath.FromSlash(parameters.ActionData))
+	root := filepath.Join(destDir, filepath.FromSlash(parameters.ActionData))
+	// If any files were received, copy them into the synced directory
+	if _, err := os.Stat(received); err == nil {
+		if err := copyTree(received, root); err != nil {
+			return fmt.Errorf("copying synced files: %w", err)
+		}
+	}
+	// Delete files which do not exist on the sender
+	for _, name := range parameters.plan.Delete {
+		filePath := filepath.Join(destDir, filepath.FromSlash(name))
+		err := os.Remove(filePath)
+		if err != nil {
+			return fmt.Errorf("deleting file: %w", err)
+		}
+		// Remove directories left empty, up to the synced directory. Removing
+		// a directory which is not empty fails, which stops at the first one.
+		for dir := filepath.Dir(filePath); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	log.Info().
+		Int("new", len(parameters.plan.New)).
+		Int("changed", len(parameters.plan.Changed)).
+		Int("unchanged", parameters.plan.Unchanged).
+		Int("deleted", len(parameters.plan.Delete)).
+		Msg("Synced directory")
+	return nil
+}
+
+// Check whether slash-separated path is a directory within the directory it is relative to
+func isLocalDir(name string) bool {
+	if name == "" || name == "." || strings.HasPrefix(name, "/") || path.Clean(name) != name {
+		return false
+	}
+	return name != ".." && !strings.HasPrefix(name, "../")
+}
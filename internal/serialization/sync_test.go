@@ -0,0 +1,187 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package serialization
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Write files with given content and modification time into dir
+func writeSyncFiles(t *testing.T, dir string, files map[string]string, modTime time.Time) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Create sender's files and receiver's destination directory, returning
+// the manifest of the sender's files and the destination directory
+func setupSync(t *testing.T) (*transfer.Manifest, string) {
+	t.Helper()
+	modTime := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	srcDir := t.TempDir()
+	writeSyncFiles(t, srcDir, map[string]string{
+		"docs/new.txt":       "new",
+		"docs/same.txt":      "same",
+		"docs/touched.txt":   "touched",
+		"docs/resized.txt":   "resized",
+		"docs/sub/edited.md": "edited",
+	}, modTime)
+	destDir := t.TempDir()
+	writeSyncFiles(t, destDir, map[string]string{
+		"docs/same.txt":      "same",
+		"docs/resized.txt":   "resized, longer",
+		"docs/old/gone.txt":  "gone",
+		"docs/extra.txt":     "extra",
+		"other/keep.txt":     "outside of synced directory",
+		"docs/sub/edited.md": "EDITED",
+	}, modTime)
+	// Same content as the sender's file, with a different modification time
+	writeSyncFiles(t, destDir, map[string]string{"docs/touched.txt": "touched"}, modTime.Add(time.Hour))
+	// Same size as the sender's file, with different content and modification time
+	writeSyncFiles(t, destDir, map[string]string{"docs/sub/edited.md": "EDITED"}, modTime.Add(time.Hour))
+	return transfer.ListManifest(srcDir), destDir
+}
+
+func TestPlanSync(t *testing.T) {
+	tests := []struct {
+		name    string
+		options SyncOptions
+		delete  []string
+	}{
+		{"keep", SyncOptions{}, nil},
+		{"delete", SyncOptions{Delete: true}, []string{"docs/extra.txt", "docs/old/gone.txt"}},
+		{"dry run", SyncOptions{Delete: true, DryRun: true}, []string{"docs/extra.txt", "docs/old/gone.txt"}},
+	}
+	for _, test := range tests {
+		manifest, destDir := setupSync(t)
+		parameters := NewParameters("sync", "docs")
+		parameters.Sync = test.options
+		plan, err := parameters.PlanSync(manifest, destDir)
+		if err != nil {
+			t.Fatalf("%s: PlanSync() = %v", test.name, err)
+		}
+		if want := []string{"docs/new.txt"}; !reflect.DeepEqual(plan.New, want) {
+			t.Errorf("%s: New = %v, want %v", test.name, plan.New, want)
+		}
+		if want := []string{"docs/resized.txt", "docs/sub/edited.md"}; !reflect.DeepEqual(plan.Changed, want) {
+			t.Errorf("%s: Changed = %v, want %v", test.name, plan.Changed, want)
+		}
+		if plan.Unchanged != 2 {
+			t.Errorf("%s: Unchanged = %d, want 2", test.name, plan.Unchanged)
+		}
+		if !reflect.DeepEqual(plan.Delete, test.delete) {
+			t.Errorf("%s: Delete = %v, want %v", test.name, plan.Delete, test.delete)
+		}
+		if plan.DryRun != test.options.DryRun {
+			t.Errorf("%s: DryRun = %v, want %v", test.name, plan.DryRun, test.options.DryRun)
+		}
+		// Only new and changed files are transferred
+		needed := manifest.Filter(plan.Needs)
+		if len(needed.Files) != 3 {
+			t.Errorf("%s: %d files needed, want 3", test.name, len(needed.Files))
+		}
+		// The sender gets the plan as reported
+		if reported := ParseSyncPlan(plan.Marshal()); reported.DryRun != plan.DryRun || !reflect.DeepEqual(reported.Delete, plan.Delete) {
+			t.Errorf("%s: reported plan = %+v, want %+v", test.name, reported, plan)
+		}
+	}
+}
+
+func TestApplySync(t *testing.T) {
+	manifest, destDir := setupSync(t)
+	parameters := NewParameters("sync", "docs")
+	parameters.Sync = SyncOptions{Delete: true}
+	plan, err := parameters.PlanSync(manifest, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Received files only include new and changed files
+	srcDir := t.TempDir()
+	writeSyncFiles(t, srcDir, map[string]string{
+		"docs/new.txt":       "new",
+		"docs/resized.txt":   "resized",
+		"docs/sub/edited.md": "edited",
+	}, time.Now())
+	sameInfo, err := os.Stat(filepath.Join(destDir, "docs", "same.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parameters.ExecuteAction(srcDir, destDir); err != nil {
+		t.Fatalf("ExecuteAction() = %v", err)
+	}
+	want := map[string]string{
+		"docs/new.txt":       "new",
+		"docs/same.txt":      "same",
+		"docs/touched.txt":   "touched",
+		"docs/resized.txt":   "resized",
+		"docs/sub/edited.md": "edited",
+		"other/keep.txt":     "outside of synced directory",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(destDir, filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, content)
+		}
+	}
+	for _, name := range plan.Delete {
+		if _, err := os.Stat(filepath.Join(destDir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", name)
+		}
+	}
+	// Directories left empty are removed
+	if _, err := os.Stat(filepath.Join(destDir, "docs", "old")); !os.IsNotExist(err) {
+		t.Error("empty directory was not removed")
+	}
+	// Unchanged files are not touched
+	info, err := os.Stat(filepath.Join(destDir, "docs", "same.txt"))
+	if err != nil || !info.ModTime().Equal(sameInfo.ModTime()) {
+		t.Error("unchanged file was modified")
+	}
+}
+
+func TestApplySyncUnplanned(t *testing.T) {
+	parameters := NewParameters("sync", "docs")
+	if err := parameters.ExecuteAction(t.TempDir(), t.TempDir()); err == nil {
+		t.Error("ExecuteAction() of unplanned sync succeeded")
+	}
+}
+
+func TestPlanSyncRejectsEscapes(t *testing.T) {
+	manifest, destDir := setupSync(t)
+	for _, dir := range []string{"..", "../docs", "/docs", "doc"} {
+		parameters := NewParameters("sync", dir)
+		if _, err := parameters.PlanSync(manifest, destDir); err == nil {
+			t.Errorf("PlanSync() of %q succeeded", dir)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Default port used by the receiver for key exchange
+	KeyExchangePort = 9797
+	// Default port used by the sender for file transfer
+	TransferPort = 9898
+	// Timeout for a single connection attempt to one of a receiver's addresses
+	dialTimeout = 3 * time.Second
+)
+
+// Parse host and optional port provided by the user (e.g. via --send-to)
+//
+// Accepts IPv4 addresses, IPv6 addresses with or without brackets and
+// with or without a zone ID (fe80::1%eth0), and hostnames, optionally
+// followed by a port ([fe80::1%eth0]:9797). The returned port is 0 if
+// none was given.
+func ParseHost(s string) (string, int, error) {
+	// Remove surrounding whitespace
+	host := strings.TrimSpace(s)
+	if host == "" {
+		return "", 0, errors.New("empty host")
+	}
+	// Create variable for port
+	port := 0
+	// If host contains a port ([::1]:9797 or 1.2.3.4:9797), split it off
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, errors.New("invalid port: " + p)
+		}
+		host = h
+	}
+	// Remove brackets from IPv6 literals without a port
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	// Split off zone ID, if any
+	ipStr, zone := splitZone(host)
+	// Attempt to parse host as an IP address
+	ip := net.ParseIP(ipStr)
+	// If host is not an IP address
+	if ip == nil {
+		// Hostnames cannot contain zones or colons
+		if zone != "" || strings.Contains(host, ":") {
+			return "", 0, errors.New("invalid address: " + s)
+		}
+		return host, port, nil
+	}
+	// Zones are only meaningful on IPv6 addresses
+	if zone != "" && ip.To4() != nil {
+		return "", 0, errors.New("zone ID on IPv4 address: " + s)
+	}
+	return host, port, nil
+}
+
+// Create TCP listener on bind address and port
+//
+// An empty bind address listens on all addresses (dual-stack) and
+// port 0 picks a random free port.
+func Listen(bind string, port int) net.Listener {
+	// Remove brackets from IPv6 bind address, if any
+	bind = strings.TrimSuffix(strings.TrimPrefix(bind, "["), "]")
+	// Create TCP listener
+	listener, err := net.Listen("tcp", JoinHostPort(bind, port))
+	if err != nil {
+		log.Fatal().Err(err).Str("bind", bind).Int("port", port).Msg("Error starting listener")
+	}
+	return listener
+}
+
+// Get port a listener or transport is listening on, or 0 if it does not
+// listen on a TCP or UDP port
+func ListenerPort(listener interface{ Addr() net.Addr }) int {
+	switch addr := listener.Addr().(type) {
+	case *net.TCPAddr:
+		return addr.Port
+	case *net.UDPAddr:
+		return addr.Port
+	}
+	return 0
+}
+
+// Get interfaces owning bind address, or nil for all interfaces
+func BindInterfaces(bind string) []net.Interface {
+	// Get IP of bind address without brackets and zone
+	ipStr, _ := splitZone(strings.TrimSuffix(strings.TrimPrefix(bind, "["), "]"))
+	ip := net.ParseIP(ipStr)
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return []net.Interface{iface}
+			}
+		}
+	}
+	return nil
+}
+
+// Join host and port, bracketing IPv6 literals as required
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Create URL host component from host and port
+//
+// Zone IDs must be percent-encoded as %25 inside URLs (RFC 6874).
+func URLHost(host string, port int) string {
+	return JoinHostPort(strings.Replace(host, "%", "%25", 1), port)
+}
+
+// Sort addresses by preference, most preferred first
+//
+// Routable IPv4 addresses are preferred, followed by global and
+// unique local IPv6 addresses, link-local IPv6 addresses with a zone,
+// IPv4 link-local addresses, and finally loopback addresses. Addresses
+// that are not IP literals (hostnames) are kept after IPv4 addresses.
+// Order within a class is preserved.
+func SortAddrs(addrs []string) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrRank(addrs[i]) < addrRank(addrs[j])
+	})
+}
+
+// Get rank of address for SortAddrs, lower is better
+func addrRank(addr string) int {
+	ipStr, zone := splitZone(addr)
+	ip := net.ParseIP(ipStr)
+	switch {
+	case ip == nil:
+		return 1
+	case ip.IsLoopback():
+		return 6
+	case ip.To4() != nil && ip.IsLinkLocalUnicast():
+		return 5
+	case ip.To4() != nil:
+		return 0
+	case ip.IsLinkLocalUnicast() && zone == "":
+		// Link-local addresses without a zone cannot be dialed reliably
+		return 7
+	case ip.IsLinkLocalUnicast():
+		return 4
+	case ip[0]&0xfe == 0xfc:
+		// Unique local address (fc00::/7)
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Dial the first reachable address out of addrs, in order
+func DialFirst(addrs []string, port int) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	var lastErr error
+	// For every address
+	for _, addr := range addrs {
+		// Attempt to connect to address
+		conn, err := net.DialTimeout("tcp", JoinHostPort(addr, port), dialTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// Get addresses of this host which other devices can connect to, most
+// preferred first
+//
+// Loopback addresses are only returned if there is no other address.
+func LocalAddrs() []string {
+	var addrs, loopback []string
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		// Skip interfaces which are down
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaceAddrs, _ := iface.Addrs()
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP.String()
+			switch {
+			case ipNet.IP.IsLoopback():
+				loopback = append(loopback, ip)
+			case ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast():
+				// Link-local IPv6 addresses need the zone of their interface
+				addrs = append(addrs, ip+"%"+iface.Name)
+			default:
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = loopback
+	}
+	SortAddrs(addrs)
+	return addrs
+}
+
+// Split IP address into address and zone ID
+func splitZone(addr string) (string, string) {
+	if i := strings.LastIndexByte(addr, '%'); i != -1 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		in   string
+		host string
+		port int
+		err  bool
+	}{
+		{"192.168.1.2", "192.168.1.2", 0, false},
+		{" 192.168.1.2:9797 ", "192.168.1.2", 9797, false},
+		{"2001:db8::2", "2001:db8::2", 0, false},
+		{"[2001:db8::2]", "2001:db8::2", 0, false},
+		{"[2001:db8::2]:9797", "2001:db8::2", 9797, false},
+		{"fe80::2%eth0", "fe80::2%eth0", 0, false},
+		{"[fe80::2%eth0]:9797", "fe80::2%eth0", 9797, false},
+		{"laptop.local", "laptop.local", 0, false},
+		{"laptop.local:9797", "laptop.local", 9797, false},
+		{"", "", 0, true},
+		{"192.168.1.2:0", "", 0, true},
+		{"192.168.1.2:70000", "", 0, true},
+		{"192.168.1.2%eth0", "", 0, true},
+		{"laptop%eth0", "", 0, true},
+	}
+	for _, test := range tests {
+		host, port, err := ParseHost(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("ParseHost(%q) error = %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if host != test.host || port != test.port {
+			t.Errorf("ParseHost(%q) = %q, %d, want %q, %d", test.in, host, port, test.host, test.port)
+		}
+	}
+}
+
+func TestAddrRank(t *testing.T) {
+	tests := []struct {
+		addr string
+		rank int
+	}{
+		{"192.168.1.2", 0},
+		{"10.0.0.1", 0},
+		{"8.8.8.8", 0},
+		{"laptop.local", 1},
+		{"2001:db8::2", 2},
+		{"fd00::2", 3},
+		{"fe80::2%eth0", 4},
+		{"169.254.1.2", 5},
+		{"127.0.0.1", 6},
+		{"::1", 6},
+		{"fe80::2", 7},
+	}
+	for _, test := range tests {
+		if rank := addrRank(test.addr); rank != test.rank {
+			t.Errorf("addrRank(%q) = %d, want %d", test.addr, rank, test.rank)
+		}
+	}
+}
+
+func TestSortAddrs(t *testing.T) {
+	addrs := []string{"fe80::2", "127.0.0.1", "fe80::2%eth0", "2001:db8::2", "169.254.1.2", "fd00::2", "192.168.1.2", "laptop.local", "8.8.8.8"}
+	SortAddrs(addrs)
+	want := []string{"192.168.1.2", "8.8.8.8", "laptop.local", "2001:db8::2", "fd00::2", "fe80::2%eth0", "169.254.1.2", "127.0.0.1", "fe80::2"}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("SortAddrs() = %v, want %v", addrs, want)
+	}
+}
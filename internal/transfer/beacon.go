@@ -0,0 +1,299 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// Default UDP port used for beacon discovery
+	DefaultBeaconPort = 9799
+	// Magic value identifying beacon packets
+	beaconMagic = "opensend-beacon"
+	// Interval between beacon queries
+	beaconQueryInterval = time.Second
+	// Maximum size of a beacon packet
+	maxBeaconSize = 1024
+)
+
+// Beacon query sent by the sender
+type beaconQuery struct {
+	Magic string
+	// Random nonce that must be signed by responding receivers
+	Nonce []byte
+}
+
+// Beacon sent by a receiver in response to a query
+type beacon struct {
+	Magic string
+	// Nonce of the query being answered
+	Nonce []byte
+	// Name of the receiver
+	Name string
+	// Protocol version of the receiver
+	Version int
+	// Key exchange port of the receiver
+	Port int
+	// Public key of the receiver's identity
+	Identity ed25519.PublicKey
+	// Signature of the beacon (with an empty signature) by the identity
+	Signature []byte
+}
+
+// Get bytes of beacon covered by its signature
+func (b beacon) signedData() []byte {
+	b.Signature = nil
+	data, _ := msgpack.Marshal(b)
+	return data
+}
+
+// Discoverer using a signed UDP beacon
+//
+// The sender broadcasts queries on IPv4 and multicasts them to the
+// IPv6 all-nodes group. Receivers reply with a beacon signed by their
+// identity, which is used when mDNS is unavailable.
+type BeaconDiscoverer struct {
+	Port int
+}
+
+// Browse for receivers answering beacon queries until ctx is done
+func (discoverer BeaconDiscoverer) Browse(ctx context.Context, found func(Receiver)) {
+	// Create random nonce for this browse session
+	nonce := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		log.Warn().Err(err).Msg("Error generating beacon nonce")
+		return
+	}
+	// Encode query
+	query, err := msgpack.Marshal(beaconQuery{Magic: beaconMagic, Nonce: nonce})
+	if err != nil {
+		log.Warn().Err(err).Msg("Error encoding beacon query")
+		return
+	}
+	// Create channel signalling that reading for an IP version has stopped
+	done := make(chan struct{}, 2)
+	for _, network := range []string{"udp4", "udp6"} {
+		// Listen on an ephemeral port to send queries and receive beacons
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			log.Debug().Err(err).Str("network", network).Msg("Error creating beacon socket")
+			done <- struct{}{}
+			continue
+		}
+		// Close socket once ctx is done, unblocking reads
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		// Periodically send queries
+		go func(network string) {
+			ticker := time.NewTicker(beaconQueryInterval)
+			defer ticker.Stop()
+			for {
+				for _, addr := range beaconTargets(network, discoverer.Port) {
+					_, _ = conn.WriteToUDP(query, addr)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(network)
+		// Read beacons
+		go func() {
+			defer func() { done <- struct{}{} }()
+			buf := make([]byte, maxBeaconSize)
+			for {
+				n, addr, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				// Decode and verify beacon, ignoring invalid ones
+				receiver, ok := parseBeacon(buf[:n], nonce, addr)
+				if ok {
+					found(receiver)
+				}
+			}
+		}()
+	}
+	// Wait for both readers to stop
+	<-done
+	<-done
+}
+
+// Get addresses queries should be sent to for network
+func beaconTargets(network string, port int) []*net.UDPAddr {
+	var targets []*net.UDPAddr
+	if network == "udp4" {
+		// Limited broadcast
+		targets = append(targets, &net.UDPAddr{IP: net.IPv4bcast, Port: port})
+	}
+	// For every interface capable of multicast
+	for _, iface := range multicastInterfaces() {
+		if network == "udp6" {
+			// IPv6 link-local all-nodes multicast group
+			targets = append(targets, &net.UDPAddr{IP: net.IPv6linklocalallnodes, Port: port, Zone: iface.Name})
+			continue
+		}
+		// Directed broadcast addresses of interface
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			broadcast := make(net.IP, 4)
+			for i, b := range ipNet.IP.To4() {
+				broadcast[i] = b | ^ipNet.Mask[len(ipNet.Mask)-4+i]
+			}
+			targets = append(targets, &net.UDPAddr{IP: broadcast, Port: port})
+		}
+	}
+	return targets
+}
+
+// Decode and verify beacon received from addr
+func parseBeacon(data, nonce []byte, addr *net.UDPAddr) (Receiver, bool) {
+	b := beacon{}
+	err := msgpack.Unmarshal(data, &b)
+	if err != nil || b.Magic != beaconMagic || !bytes.Equal(b.Nonce, nonce) {
+		return Receiver{}, false
+	}
+	// Verify beacon was signed by the identity it advertises
+	if len(b.Identity) != ed25519.PublicKeySize || !ed25519.Verify(b.Identity, b.signedData(), b.Signature) {
+		log.Warn().Str("addr", addr.String()).Msg("Ignoring beacon with invalid signature")
+		return Receiver{}, false
+	}
+	return Receiver{
+		Name:        b.Name,
+		Fingerprint: Fingerprint(b.Identity),
+		Version:     b.Version,
+		Port:        b.Port,
+		Addrs:       []string{ipString(addr.IP, addr.Zone)},
+	}, true
+}
+
+// Answer beacon queries on port, advertising the given key exchange
+// port and signing beacons with identity
+//
+// If bind is not empty, only queries from the networks of the interface
+// owning bind are answered. The listener itself is not bound to it, as
+// sockets bound to a unicast address do not receive broadcasts.
+//
+// Returns a function which stops answering queries.
+func StartBeacon(bind string, port int, keyExchangePort int, identity ed25519.PrivateKey) func() {
+	// Get computer hostname
+	hostname, _ := os.Hostname()
+	// Get networks queries are answered on, all if nil
+	var nets []beaconNet
+	if ifaces := BindInterfaces(bind); ifaces != nil {
+		nets = interfaceNets(ifaces)
+	}
+	// Listen on beacon port on all addresses
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error starting beacon listener")
+	}
+	go func() {
+		buf := make([]byte, maxBeaconSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Ignore queries from other networks than the bind address
+			if nets != nil && !onNets(nets, addr) {
+				continue
+			}
+			// Decode query, ignoring anything that is not one
+			query := beaconQuery{}
+			if msgpack.Unmarshal(buf[:n], &query) != nil || query.Magic != beaconMagic {
+				continue
+			}
+			// Create and sign beacon
+			b := beacon{
+				Magic:    beaconMagic,
+				Nonce:    query.Nonce,
+				Name:     hostname,
+				Version:  ProtocolVersion,
+				Port:     keyExchangePort,
+				Identity: identity.Public().(ed25519.PublicKey),
+			}
+			b.Signature = ed25519.Sign(identity, b.signedData())
+			// Encode beacon
+			data, err := msgpack.Marshal(b)
+			if err != nil {
+				continue
+			}
+			// Reply to sender of query
+			_, _ = conn.WriteToUDP(data, addr)
+		}
+	}()
+	// Return function closing the listener
+	return func() { conn.Close() }
+}
+
+// Network of an interface beacon queries are answered on
+type beaconNet struct {
+	*net.IPNet
+	// Name of the interface
+	iface string
+}
+
+// Get networks of all addresses of ifaces
+func interfaceNets(ifaces []net.Interface) []beaconNet {
+	var nets []beaconNet
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				nets = append(nets, beaconNet{ipNet, iface.Name})
+			}
+		}
+	}
+	return nets
+}
+
+// Check whether addr is on one of nets
+//
+// IPv6 link-local addresses must also come from the same interface, as
+// every interface has the same link-local network.
+func onNets(nets []beaconNet, addr *net.UDPAddr) bool {
+	for _, n := range nets {
+		if !n.Contains(addr.IP) {
+			continue
+		}
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() && addr.Zone != n.iface {
+			continue
+		}
+		return true
+	}
+	return false
+}
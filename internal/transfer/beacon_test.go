@@ -0,0 +1,87 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestOnNets(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.2/24")
+	_, linkLocal, _ := net.ParseCIDR("fe80::2/64")
+	nets := []beaconNet{{lan, "eth0"}, {linkLocal, "eth0"}}
+	tests := []struct {
+		addr *net.UDPAddr
+		on   bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.77")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.2.77")}, false},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.2")}, false},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::77"), Zone: "eth0"}, true},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::77"), Zone: "wlan0"}, false},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::77")}, false},
+	}
+	for _, test := range tests {
+		if on := onNets(nets, test.addr); on != test.on {
+			t.Errorf("onNets(%v) = %v, want %v", test.addr, on, test.on)
+		}
+	}
+}
+
+func TestStartBeaconBind(t *testing.T) {
+	// Get free UDP port for beacon
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	_, identity, _ := ed25519.GenerateKey(nil)
+	stop := StartBeacon("127.0.0.1", port, 9797, identity)
+	defer stop()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	nonce := []byte("0123456789abcdef")
+	query, _ := msgpack.Marshal(beaconQuery{Magic: beaconMagic, Nonce: nonce})
+	if _, err := conn.WriteToUDP(query, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	// Queries from the network of the bind address are answered
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxBeaconSize)
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, ok := parseBeacon(buf[:n], nonce, addr)
+	if !ok {
+		t.Fatal("parseBeacon() of reply failed")
+	}
+	if receiver.Port != 9797 || receiver.Fingerprint != Fingerprint(identity.Public().(ed25519.PublicKey)) {
+		t.Errorf("beacon advertises %+v, want port 9797 and the identity's fingerprint", receiver)
+	}
+}
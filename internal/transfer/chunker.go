@@ -0,0 +1,95 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Table of random values used by the gear hash, derived deterministically
+// so that chunk boundaries only depend on content
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		hash := sha256.Sum256([]byte("opensend gear " + strconv.Itoa(i)))
+		table[i] = binary.LittleEndian.Uint64(hash[:8])
+	}
+	return table
+}()
+
+// Split file at path into content-defined chunks of about avgSize bytes
+//
+// Boundaries are placed where a gear hash of the preceding bytes has its
+// top bits cleared, so that inserting or removing data only changes the
+// chunks around it. Chunks are between avgSize/4 and avgSize*4 bytes.
+// Every chunk is hashed, and empty files have a single empty chunk.
+func splitChunks(path string, avgSize int64) []Chunk {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening file")
+	}
+	defer file.Close()
+	// Get limits and mask for average size
+	minSize, maxSize := avgSize/4, avgSize*4
+	maskBits := uint(bits.Len64(uint64(avgSize)) - 1)
+	buf := make([]byte, 1<<20)
+	hash := sha256.New()
+	var chunks []Chunk
+	var offset, size int64
+	var gear uint64
+	// Add chunk ending at the current position
+	cut := func() {
+		chunks = append(chunks, Chunk{Offset: offset, Size: size, Hash: hex.EncodeToString(hash.Sum(nil))})
+		offset += size
+		size, gear = 0, 0
+		hash.Reset()
+	}
+	for {
+		n, err := io.ReadFull(file, buf)
+		data := buf[:n]
+		// Start of the data not hashed yet
+		start := 0
+		for i, b := range data {
+			size++
+			gear = gear<<1 + gearTable[b]
+			// Cut chunk at boundary or maximum size
+			if (size >= minSize && gear>>(64-maskBits) == 0) || size >= maxSize {
+				hash.Write(data[start : i+1])
+				start = i + 1
+				cut()
+			}
+		}
+		hash.Write(data[start:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			log.Fatal().Err(err).Msg("Error reading file")
+		}
+	}
+	// Add last chunk, or a single empty one for empty files
+	if size > 0 || len(chunks) == 0 {
+		cut()
+	}
+	return chunks
+}
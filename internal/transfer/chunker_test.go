@@ -0,0 +1,129 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// Size of chunks used by tests, small enough to get many chunks
+const testChunkSize = 16 << 10
+
+// Make sure chunks cover data exactly, have the right hashes and are
+// within the size limits for avgSize
+func checkChunks(t *testing.T, data []byte, chunks []Chunk, avgSize int64) {
+	t.Helper()
+	var offset int64
+	for index, chunk := range chunks {
+		if chunk.Offset != offset {
+			t.Fatalf("chunk %d at offset %d, want %d", index, chunk.Offset, offset)
+		}
+		if chunk.Size > avgSize*4 {
+			t.Errorf("chunk %d has %d bytes, want at most %d", index, chunk.Size, avgSize*4)
+		}
+		if chunk.Size < avgSize/4 && index != len(chunks)-1 {
+			t.Errorf("chunk %d has %d bytes, want at least %d", index, chunk.Size, avgSize/4)
+		}
+		hash := sha256.Sum256(data[chunk.Offset : chunk.Offset+chunk.Size])
+		if chunk.Hash != hex.EncodeToString(hash[:]) {
+			t.Errorf("chunk %d has wrong hash", index)
+		}
+		offset += chunk.Size
+	}
+	if offset != int64(len(data)) {
+		t.Errorf("chunks cover %d bytes, want %d", offset, len(data))
+	}
+}
+
+// Count chunks of b whose content does not appear in a
+func countNewChunks(a []Chunk, b []Chunk) int {
+	hashes := map[string]bool{}
+	for _, chunk := range a {
+		hashes[chunk.Hash] = true
+	}
+	count := 0
+	for _, chunk := range b {
+		if !hashes[chunk.Hash] {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSplitChunksEmpty(t *testing.T) {
+	chunks := splitChunks(writeTempFile(t, "empty", nil), testChunkSize)
+	if len(chunks) != 1 || chunks[0].Size != 0 {
+		t.Fatalf("splitChunks() of empty file = %+v, want a single empty chunk", chunks)
+	}
+	checkChunks(t, nil, chunks, testChunkSize)
+}
+
+func TestSplitChunksSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"smaller than minimum", randomData(10, testChunkSize/8)},
+		{"random", randomData(11, 2<<20)},
+		{"zeros", make([]byte, 1<<20)},
+	}
+	for _, test := range tests {
+		chunks := splitChunks(writeTempFile(t, "file", test.data), testChunkSize)
+		checkChunks(t, test.data, chunks, testChunkSize)
+		if len(test.data) < testChunkSize/4 && len(chunks) != 1 {
+			t.Errorf("%s: %d chunks, want 1", test.name, len(chunks))
+		}
+	}
+	// Larger files produce chunks of about the average size
+	data := randomData(12, 4<<20)
+	chunks := splitChunks(writeTempFile(t, "file", data), testChunkSize)
+	if average := len(data) / len(chunks); average < testChunkSize/2 || average > testChunkSize*2 {
+		t.Errorf("average chunk size = %d, want about %d", average, testChunkSize)
+	}
+}
+
+func TestSplitChunksDeterministic(t *testing.T) {
+	data := randomData(13, 1<<20)
+	a := splitChunks(writeTempFile(t, "a", data), testChunkSize)
+	b := splitChunks(writeTempFile(t, "b", data), testChunkSize)
+	if countNewChunks(a, b) != 0 || len(a) != len(b) {
+		t.Error("chunks of identical files differ")
+	}
+}
+
+func TestSplitChunksBoundariesStay(t *testing.T) {
+	data := randomData(14, 1<<20)
+	original := splitChunks(writeTempFile(t, "original", data), testChunkSize)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"inserted", append(append(append([]byte{}, data[:500000]...), randomData(15, 100)...), data[500000:]...)},
+		{"removed", append(append([]byte{}, data[:500000]...), data[500100:]...)},
+		{"prepended", append(randomData(16, 3000), data...)},
+	}
+	for _, test := range tests {
+		chunks := splitChunks(writeTempFile(t, "modified", test.data), testChunkSize)
+		checkChunks(t, test.data, chunks, testChunkSize)
+		// Only the chunks around the modification may change
+		if changed := countNewChunks(original, chunks); changed > 2 {
+			t.Errorf("%s: %d of %d chunks changed, want at most 2", test.name, changed, len(chunks))
+		}
+	}
+}
@@ -0,0 +1,358 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Minimum and maximum size of the blocks signatures are made of
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 64 << 10
+)
+
+// Maximum size of a single literal in a delta
+const maxLiteralSize = 1 << 20
+
+// Limits of a single frame of a delta, keeping memory use bounded on both sides
+const (
+	// Literal bytes after which a frame is sent
+	maxFrameLiteral = 1 << 20
+	// Number of operations after which a frame is sent
+	maxFrameOps = 1 << 16
+	// Maximum size of an encoded frame accepted by the receiver
+	maxFrameSize = 4 << 20
+)
+
+// Size of strong block hashes in bytes
+const strongHashSize = 16
+
+// Signature of an existing file, used by the sender to create a delta
+type Signature struct {
+	// Size of the file
+	Size int64
+	// Size of all blocks except the last, which may be shorter
+	BlockSize int
+	// Signatures of the blocks of the file
+	Blocks []BlockSignature
+}
+
+// Signature of a single block
+type BlockSignature struct {
+	// Rolling checksum of the block
+	Weak uint32
+	// Truncated SHA-256 hash of the block
+	Strong []byte
+}
+
+// Frame of a delta turning a receiver's existing file into the sender's file
+//
+// Deltas are created and applied as a sequence of frames, so that a file
+// sharing no blocks with the existing one is never held in memory as a
+// whole.
+type Delta struct {
+	Ops []DeltaOp
+}
+
+// Single operation of a delta
+type DeltaOp struct {
+	// Index of the block of the existing file to copy, -1 for literals
+	Block int
+	// Literal data to write if Block is -1
+	Data []byte
+}
+
+// Get block size for a file of given size, roughly its square root
+func blockSizeFor(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	if blockSize < minBlockSize {
+		return minBlockSize
+	}
+	if blockSize > maxBlockSize {
+		return maxBlockSize
+	}
+	return blockSize
+}
+
+// Create signature of file at path
+func CreateSignature(path string) (*Signature, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	signature := &Signature{Size: info.Size(), BlockSize: blockSizeFor(info.Size())}
+	block := make([]byte, signature.BlockSize)
+	reader := bufio.NewReader(file)
+	for {
+		// Read next block
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			signature.Blocks = append(signature.Blocks, BlockSignature{
+				Weak:   weakChecksum(block[:n]),
+				Strong: strongHash(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return signature, nil
+}
+
+// Check whether signature could have been created by CreateSignature
+//
+// Signatures come from the receiver, so their block size must be within
+// the accepted range and their blocks must cover exactly the file.
+func (signature *Signature) valid() bool {
+	if signature.Size < 0 || signature.BlockSize < minBlockSize || signature.BlockSize > maxBlockSize {
+		return false
+	}
+	blockSize := int64(signature.BlockSize)
+	return int64(len(signature.Blocks)) == (signature.Size+blockSize-1)/blockSize
+}
+
+// Get size of block at index in file described by signature
+func (signature *Signature) blockLen(index int) int {
+	if index == len(signature.Blocks)-1 {
+		return int(signature.Size - int64(index)*int64(signature.BlockSize))
+	}
+	return signature.BlockSize
+}
+
+// Create delta turning the file described by signature into the file at
+// path, calling emit with each frame of the delta in order
+func CreateDelta(signature *Signature, path string, emit func(*Delta)) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening file")
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	// Index blocks by rolling checksum
+	blocks := map[uint32][]int{}
+	for index, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], index)
+	}
+	delta := &Delta{}
+	var literal []byte
+	var frameLiteral int
+	// Add operation to current frame, emitting the frame once it is full
+	addOp := func(op DeltaOp) {
+		delta.Ops = append(delta.Ops, op)
+		frameLiteral += len(op.Data)
+		if frameLiteral >= maxFrameLiteral || len(delta.Ops) >= maxFrameOps {
+			emit(delta)
+			delta, frameLiteral = &Delta{}, 0
+		}
+	}
+	// Add pending literal data to delta
+	flushLiteral := func() {
+		if len(literal) > 0 {
+			addOp(DeltaOp{Block: -1, Data: literal})
+			literal = nil
+		}
+	}
+	// Fill window with up to one block of data
+	fillWindow := func() []byte {
+		window := make([]byte, signature.BlockSize)
+		n, err := io.ReadFull(reader, window)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Fatal().Err(err).Msg("Error reading file")
+		}
+		return window[:n]
+	}
+	window := fillWindow()
+	a, b := checksumParts(window)
+	for len(window) > 0 {
+		// If window matches a block of the existing file, reference it
+		if index, ok := signature.match(blocks[a|b<<16], window); ok {
+			flushLiteral()
+			addOp(DeltaOp{Block: index})
+			window = fillWindow()
+			a, b = checksumParts(window)
+			continue
+		}
+		// Otherwise, move first byte of window to literal data
+		out := window[0]
+		literal = append(literal, out)
+		if len(literal) >= maxLiteralSize {
+			flushLiteral()
+		}
+		length := uint32(len(window))
+		in, err := reader.ReadByte()
+		if err == io.EOF {
+			// At the end of the file, shrink window
+			window = window[1:]
+			a = (a - uint32(out)) & 0xffff
+			b = (b - length*uint32(out)) & 0xffff
+			continue
+		} else if err != nil {
+			log.Fatal().Err(err).Msg("Error reading file")
+		}
+		// Roll window forward by one byte
+		window = append(window[1:], in)
+		a = (a - uint32(out) + uint32(in)) & 0xffff
+		b = (b - length*uint32(out) + a) & 0xffff
+	}
+	flushLiteral()
+	// Emit last frame, if it has any operations
+	if len(delta.Ops) > 0 {
+		emit(delta)
+	}
+}
+
+// Find block among candidates with the same content as window
+func (signature *Signature) match(candidates []int, window []byte) (int, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongHash(window)
+	for _, index := range candidates {
+		if signature.blockLen(index) == len(window) && bytes.Equal(signature.Blocks[index].Strong, strong) {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// Apply delta to existing file at basisPath described by signature, writing the result to out
+//
+// Frames of the delta are read by calling next until it returns nil.
+// Returns the number of literal bytes in the delta.
+func ApplyDelta(basisPath string, signature *Signature, next func() (*Delta, error), out io.Writer) (int64, error) {
+	basis, err := os.Open(basisPath)
+	if err != nil {
+		return 0, err
+	}
+	defer basis.Close()
+	var literalBytes int64
+	block := make([]byte, signature.BlockSize)
+	for {
+		delta, err := next()
+		if err != nil {
+			return literalBytes, err
+		} else if delta == nil {
+			return literalBytes, nil
+		}
+		n, err := applyFrame(basis, signature, delta, block, out)
+		literalBytes += n
+		if err != nil {
+			return literalBytes, err
+		}
+	}
+}
+
+// Apply a single frame of a delta to basis, using block as buffer
+//
+// Returns the number of literal bytes in the frame.
+func applyFrame(basis *os.File, signature *Signature, delta *Delta, block []byte, out io.Writer) (int64, error) {
+	var literalBytes int64
+	for _, op := range delta.Ops {
+		var data []byte
+		if op.Block == -1 {
+			data = op.Data
+			literalBytes += int64(len(data))
+		} else {
+			// Make sure block exists in the existing file
+			if op.Block < 0 || op.Block >= len(signature.Blocks) {
+				return literalBytes, fmt.Errorf("invalid block %d in delta", op.Block)
+			}
+			// Read referenced block from existing file
+			data = block[:signature.blockLen(op.Block)]
+			_, err := basis.ReadAt(data, int64(op.Block)*int64(signature.BlockSize))
+			if err != nil {
+				return literalBytes, fmt.Errorf("reading block: %w", err)
+			}
+		}
+		_, err := out.Write(data)
+		if err != nil {
+			return literalBytes, err
+		}
+	}
+	return literalBytes, nil
+}
+
+// Write encoded frame of a delta to w, prefixed with its length
+func writeFrame(w io.Writer, frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	_, err := w.Write(append(length[:], frame...))
+	return err
+}
+
+// Read encoded frame of a delta written by writeFrame from r
+//
+// Returns io.EOF if there are no more frames.
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	// Refuse frames larger than the sender would create
+	if size > maxFrameSize {
+		return nil, errors.New("delta frame too large")
+	}
+	frame := make([]byte, size)
+	_, err = io.ReadFull(r, frame)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return frame, err
+}
+
+// Get rolling checksum of block
+func weakChecksum(block []byte) uint32 {
+	a, b := checksumParts(block)
+	return a | b<<16
+}
+
+// Get both 16-bit parts of rolling checksum of block
+func checksumParts(block []byte) (uint32, uint32) {
+	var a, b uint32
+	length := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (length - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// Get truncated SHA-256 hash of block
+func strongHash(block []byte) []byte {
+	hash := sha256.Sum256(block)
+	return hash[:strongHashSize]
+}
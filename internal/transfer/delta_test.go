@@ -0,0 +1,235 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Create file with given content in a temporary directory
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Create random data of given size
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestRollingChecksum(t *testing.T) {
+	data := randomData(1, 4096)
+	const window = 512
+	a, b := checksumParts(data[:window])
+	for start := 1; start+window <= len(data); start++ {
+		// Roll window forward by one byte as CreateDelta does
+		out, in := uint32(data[start-1]), uint32(data[start+window-1])
+		a = (a - out + in) & 0xffff
+		b = (b - window*out + a) & 0xffff
+		if wantA, wantB := checksumParts(data[start : start+window]); a != wantA || b != wantB {
+			t.Fatalf("rolled checksum at %d = (%d, %d), want (%d, %d)", start, a, b, wantA, wantB)
+		}
+	}
+}
+
+func TestCreateDeltaMatchesBlocks(t *testing.T) {
+	basis := randomData(2, 64<<10)
+	// Insert data in the middle of the file, shifting all following blocks
+	target := append(append(append([]byte{}, basis[:20000]...), []byte("inserted")...), basis[20000:]...)
+	signature, err := CreateSignature(writeTempFile(t, "basis", basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks, literal int
+	CreateDelta(signature, writeTempFile(t, "target", target), func(delta *Delta) {
+		for _, op := range delta.Ops {
+			if op.Block == -1 {
+				literal += len(op.Data)
+			} else {
+				blocks++
+			}
+		}
+	})
+	// Only the block containing the insertion may be sent as literal data
+	if maxLiteral := signature.BlockSize + len("inserted"); literal > maxLiteral {
+		t.Errorf("literal bytes = %d, want at most %d", literal, maxLiteral)
+	}
+	if blocks < len(signature.Blocks)-1 {
+		t.Errorf("matched blocks = %d, want at least %d", blocks, len(signature.Blocks)-1)
+	}
+}
+
+func TestApplyDeltaRoundTrip(t *testing.T) {
+	basis := randomData(3, 100<<10)
+	tests := []struct {
+		name   string
+		basis  []byte
+		target []byte
+	}{
+		{"identical", basis, basis},
+		{"appended", basis, append(append([]byte{}, basis...), randomData(4, 5000)...)},
+		{"truncated", basis, basis[:50000]},
+		{"modified", basis, append(append(append([]byte{}, basis[:30000]...), randomData(5, 3000)...), basis[33000:]...)},
+		{"unrelated", basis, randomData(6, 3<<20)},
+		{"empty basis", nil, randomData(7, 10000)},
+		{"empty target", basis, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			basisPath := writeTempFile(t, "basis", test.basis)
+			signature, err := CreateSignature(basisPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Pass frames through their wire format
+			var wire bytes.Buffer
+			frames := 0
+			CreateDelta(signature, writeTempFile(t, "target", test.target), func(delta *Delta) {
+				frames++
+				var literal int
+				for _, op := range delta.Ops {
+					literal += len(op.Data)
+				}
+				if literal >= maxFrameLiteral+maxLiteralSize {
+					t.Errorf("frame has %d literal bytes", literal)
+				}
+				data, err := msgpack.Marshal(delta)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := writeFrame(&wire, data); err != nil {
+					t.Fatal(err)
+				}
+			})
+			next := func() (*Delta, error) {
+				data, err := readFrame(&wire)
+				if err == io.EOF {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+				delta := &Delta{}
+				return delta, msgpack.Unmarshal(data, delta)
+			}
+			var out bytes.Buffer
+			if _, err := ApplyDelta(basisPath, signature, next, &out); err != nil {
+				t.Fatalf("ApplyDelta() = %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), test.target) {
+				t.Errorf("applied delta has %d bytes, want %d bytes of target", out.Len(), len(test.target))
+			}
+			if test.name == "unrelated" && frames < 3 {
+				t.Errorf("unrelated file sent in %d frames, want it split into several", frames)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaInvalidBlock(t *testing.T) {
+	basisPath := writeTempFile(t, "basis", randomData(9, 10000))
+	signature, err := CreateSignature(basisPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range []int{-2, len(signature.Blocks)} {
+		sent := false
+		next := func() (*Delta, error) {
+			if sent {
+				return nil, nil
+			}
+			sent = true
+			return &Delta{Ops: []DeltaOp{{Block: block}}}, nil
+		}
+		if _, err := ApplyDelta(basisPath, signature, next, ioutil.Discard); err == nil {
+			t.Errorf("ApplyDelta() with block %d succeeded", block)
+		}
+	}
+}
+
+func TestSignatureValid(t *testing.T) {
+	blocks := func(n int) []BlockSignature { return make([]BlockSignature, n) }
+	tests := []struct {
+		name      string
+		signature Signature
+		valid     bool
+	}{
+		{"empty file", Signature{Size: 0, BlockSize: minBlockSize}, true},
+		{"single block", Signature{Size: 100, BlockSize: minBlockSize, Blocks: blocks(1)}, true},
+		{"short last block", Signature{Size: 3*maxBlockSize + 1, BlockSize: maxBlockSize, Blocks: blocks(4)}, true},
+		{"exact blocks", Signature{Size: 4 * minBlockSize, BlockSize: minBlockSize, Blocks: blocks(4)}, true},
+		{"negative size", Signature{Size: -1, BlockSize: minBlockSize}, false},
+		{"zero block size", Signature{Size: 100, BlockSize: 0, Blocks: blocks(1)}, false},
+		{"tiny blocks", Signature{Size: 100, BlockSize: 1, Blocks: blocks(100)}, false},
+		{"huge blocks", Signature{Size: 1 << 30, BlockSize: 1 << 30, Blocks: blocks(1)}, false},
+		{"missing blocks", Signature{Size: 1 << 30, BlockSize: maxBlockSize, Blocks: blocks(1)}, false},
+		{"extra blocks", Signature{Size: 100, BlockSize: minBlockSize, Blocks: blocks(2)}, false},
+	}
+	for _, test := range tests {
+		if valid := test.signature.valid(); valid != test.valid {
+			t.Errorf("%s: valid() = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestDeltaHandlerRejectsInvalidSignature(t *testing.T) {
+	sender, manifest := serveTestFiles(t, map[string][]byte{"file": randomData(8, 10000)})
+	data, err := msgpack.Marshal(&Signature{Size: 1 << 30, BlockSize: 1, Blocks: make([]BlockSignature, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, code, err := sender.Post("/delta/"+manifest.Files[0].ID, "application/msgpack", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if code != http.StatusBadRequest {
+		t.Errorf("delta of invalid signature returned status %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestReadFrameLimits(t *testing.T) {
+	var wire bytes.Buffer
+	if err := writeFrame(&wire, make([]byte, maxFrameSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFrame(&wire); err == nil {
+		t.Error("readFrame() accepted oversized frame")
+	}
+	// Truncated frame must not be mistaken for the end of the delta
+	wire.Reset()
+	if err := writeFrame(&wire, []byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	wire.Truncate(6)
+	if _, err := readFrame(&wire); err != io.ErrUnexpectedEOF {
+		t.Errorf("readFrame() on truncated frame = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
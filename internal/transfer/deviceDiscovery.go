@@ -18,63 +18,256 @@ package transfer
 
 import (
 	"context"
-	"os"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/grandcat/zeroconf"
 	"github.com/rs/zerolog/log"
 )
 
-// Discover opensend receivers on the network
-func DiscoverReceivers() ([]string, []string) {
-	// Use ConsoleWriter logger
-	// Create zeroconf resolver
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating zeroconf resolver")
-	}
-	// Create channel for zeroconf entries
-	entries := make(chan *zeroconf.ServiceEntry)
-	// Create slice to store hostnames of discovered receivers
-	var discoveredReceivers []string
-	// Create slice to store IPs of discovered receivers
-	var discoveredReceiverIPs []string
-	// Concurrently run mDNS query
-	go func(results <-chan *zeroconf.ServiceEntry) {
-		// For each entry
-		for entry := range results {
-			// Append hostname to discoveredReceivers
-			discoveredReceivers = append(discoveredReceivers, entry.HostName)
-			// Append IP to discoveredReceiverIPs
-			discoveredReceiverIPs = append(discoveredReceiverIPs, entry.AddrIPv4[0].String())
-		}
-	}(entries)
+// Version of the opensend protocol advertised by receivers
+const ProtocolVersion = 1
+
+// Opensend receiver discovered on the network
+type Receiver struct {
+	// Service instance name (usually the receiver's hostname)
+	Name string `json:"name"`
+	// Host name as advertised by the receiver
+	HostName string `json:"hostName"`
+	// Fingerprint of the receiver's identity as advertised by the receiver
+	Fingerprint string `json:"fingerprint"`
+	// Protocol version advertised by the receiver, 0 if unknown
+	Version int `json:"version"`
+	// Key exchange port of the receiver, 0 if unknown
+	Port int `json:"port"`
+	// Addresses of the receiver, sorted by preference (see SortAddrs)
+	Addrs []string `json:"addrs"`
+}
+
+// Discovery backend
+type Discoverer interface {
+	// Browse for receivers until ctx is done, calling found every
+	// time a receiver is discovered or its details change
+	Browse(ctx context.Context, found func(Receiver))
+}
+
+// Discoverer running several discoverers concurrently and merging their results
+type MultiDiscoverer []Discoverer
 
+// Browse using all discoverers until ctx is done
+func (discoverers MultiDiscoverer) Browse(ctx context.Context, found func(Receiver)) {
+	// Create set to merge results of all discoverers
+	set := newReceiverSet()
+	// Create wait group for all discoverers
+	var wg sync.WaitGroup
+	// For each discoverer
+	for _, discoverer := range discoverers {
+		wg.Add(1)
+		// Concurrently browse using discoverer
+		go func(discoverer Discoverer) {
+			defer wg.Done()
+			discoverer.Browse(ctx, func(receiver Receiver) {
+				// Merge receiver into set and notify caller of merged result
+				found(set.merge(receiver))
+			})
+		}(discoverer)
+	}
+	// Wait for all discoverers to stop
+	wg.Wait()
+}
+
+// Discover opensend receivers on the network using discoverer
+func DiscoverReceivers(discoverer Discoverer) []Receiver {
 	// Create context with 4 second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
 	// Cancel context at the end of this function
 	defer cancel()
-	// Browse for mDNS entries
-	err = resolver.Browse(ctx, "_opensend._tcp", "local.", entries)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error browsing zeroconf services")
+	// Create set to collect receivers
+	set := newReceiverSet()
+	// Browse until context times out, collecting receivers
+	discoverer.Browse(ctx, func(receiver Receiver) {
+		set.merge(receiver)
+	})
+	// Return discovered receivers
+	return set.list()
+}
+
+// Get fingerprint of an identity public key
+//
+// The fingerprint is the hex encoded first 16 bytes of the
+// SHA-256 hash of the public key.
+func Fingerprint(publicKey ed25519.PublicKey) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:16])
+}
+
+// Set of receivers, merging information about receivers with the same identity
+//
+// Receivers are identified by fingerprint, so that a beacon spoofing the
+// name of a receiver is listed separately instead of replacing its
+// fingerprint and adding its own addresses. Receivers which do not
+// advertise a fingerprint are identified by name and are never merged
+// with ones that do.
+type receiverSet struct {
+	mtx       sync.Mutex
+	receivers map[string]*Receiver
+	order     []string
+}
+
+// Create new empty receiver set
+func newReceiverSet() *receiverSet {
+	return &receiverSet{receivers: map[string]*Receiver{}}
+}
+
+// Merge receiver into set, returning a copy of the merged receiver
+func (set *receiverSet) merge(receiver Receiver) Receiver {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	key := receiverKey(receiver)
+	// Get existing receiver with this identity
+	existing, ok := set.receivers[key]
+	if !ok {
+		// Add new receiver if not yet seen
+		existing = &Receiver{Name: receiver.Name, Fingerprint: receiver.Fingerprint}
+		set.receivers[key] = existing
+		set.order = append(set.order, key)
+	}
+	// Fill in details that are known
+	if receiver.HostName != "" {
+		existing.HostName = receiver.HostName
+	}
+	if receiver.Version != 0 {
+		existing.Version = receiver.Version
+	}
+	if receiver.Port != 0 {
+		existing.Port = receiver.Port
+	}
+	// Add addresses of receiver
+	existing.Addrs = appendUnique(existing.Addrs, receiver.Addrs...)
+	// Sort addresses by preference
+	SortAddrs(existing.Addrs)
+	// Return copy so that it can be used outside the lock
+	return existing.copy()
+}
+
+// Get key identifying receiver in a set, its fingerprint if advertised,
+// otherwise its case-insensitive name
+func receiverKey(receiver Receiver) string {
+	if receiver.Fingerprint != "" {
+		return "fp:" + receiver.Fingerprint
+	}
+	return "name:" + strings.ToLower(receiver.Name)
+}
+
+// Get copy of receiver with given key
+func (set *receiverSet) get(key string) (Receiver, bool) {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	receiver, ok := set.receivers[key]
+	if !ok {
+		return Receiver{}, false
+	}
+	return receiver.copy(), true
+}
+
+// Remove addresses from receiver with given key, returning a copy of the
+// updated receiver
+func (set *receiverSet) removeAddrs(key string, addrs ...string) Receiver {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	receiver, ok := set.receivers[key]
+	if !ok {
+		return Receiver{}
+	}
+	kept := receiver.Addrs[:0]
+	for _, addr := range receiver.Addrs {
+		if !containsAddr(addrs, addr) {
+			kept = append(kept, addr)
+		}
+	}
+	receiver.Addrs = kept
+	return receiver.copy()
+}
+
+// Check whether addrs contains addr
+func containsAddr(addrs []string, addr string) bool {
+	for _, existing := range addrs {
+		if existing == addr {
+			return true
+		}
 	}
+	return false
+}
 
-	// Send Done signal to context
-	<-ctx.Done()
-	// Return discovered receiver slices
-	return discoveredReceivers, discoveredReceiverIPs
+// Remove receiver with given key
+func (set *receiverSet) remove(key string) {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	delete(set.receivers, key)
+	for i, existing := range set.order {
+		if existing == key {
+			set.order = append(set.order[:i], set.order[i+1:]...)
+			break
+		}
+	}
 }
 
-// Register opensend zeroconf service on the network
-func RegisterService() func() {
-	// Get computer hostname
-	hostname, _ := os.Hostname()
-	// Register zeroconf service {hostname}._opensend._tcp.local.
-	server, err := zeroconf.Register(hostname, "_opensend._tcp", "local.", 9797, []string{"txtv=0", "lo=1", "la=2"}, nil)
+// Get all receivers in set, in the order they were first seen
+func (set *receiverSet) list() []Receiver {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	out := make([]Receiver, 0, len(set.order))
+	for _, key := range set.order {
+		out = append(out, set.receivers[key].copy())
+	}
+	return out
+}
+
+// Create deep copy of receiver
+func (receiver *Receiver) copy() Receiver {
+	out := *receiver
+	out.Addrs = append([]string(nil), receiver.Addrs...)
+	return out
+}
+
+// Append values to slice, skipping those already present
+func appendUnique(slice []string, values ...string) []string {
+outer:
+	for _, value := range values {
+		for _, existing := range slice {
+			if existing == value {
+				continue outer
+			}
+		}
+		slice = append(slice, value)
+	}
+	return slice
+}
+
+// Get list of up interfaces that support multicast
+func multicastInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error registering zeroconf service")
+		log.Warn().Err(err).Msg("Error listing network interfaces")
+		return nil
+	}
+	var out []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			out = append(out, iface)
+		}
+	}
+	return out
+}
+
+// Get string form of IP address, adding zone to link-local IPv6 addresses
+func ipString(ip net.IP, zone string) string {
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() && zone != "" {
+		return ip.String() + "%" + zone
 	}
-	// Return server.Shutdown() function to allow for shutdown in main()
-	return server.Shutdown
+	return ip.String()
 }
@@ -0,0 +1,54 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReceiverSetMerge(t *testing.T) {
+	set := newReceiverSet()
+	set.merge(Receiver{Name: "laptop", Fingerprint: "aaaa", Addrs: []string{"192.168.1.2"}})
+	set.merge(Receiver{Name: "laptop", Fingerprint: "aaaa", Addrs: []string{"2001:db8::2"}, Port: 9797})
+	// Spoofed beacon with the same name but a different identity
+	set.merge(Receiver{Name: "Laptop", Fingerprint: "bbbb", Addrs: []string{"192.168.1.66"}})
+	// Receiver without fingerprint must not merge with either of them
+	set.merge(Receiver{Name: "laptop", Addrs: []string{"192.168.1.77"}})
+
+	want := []Receiver{
+		{Name: "laptop", Fingerprint: "aaaa", Port: 9797, Addrs: []string{"192.168.1.2", "2001:db8::2"}},
+		{Name: "Laptop", Fingerprint: "bbbb", Addrs: []string{"192.168.1.66"}},
+		{Name: "laptop", Addrs: []string{"192.168.1.77"}},
+	}
+	if got := set.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("list() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReceiverSetRemoveAddrs(t *testing.T) {
+	set := newReceiverSet()
+	receiver := set.merge(Receiver{Name: "laptop", Fingerprint: "aaaa", Addrs: []string{"192.168.1.2", "10.0.0.2", "2001:db8::2"}})
+	got := set.removeAddrs(receiverKey(receiver), "10.0.0.2", "192.0.2.1")
+	want := []string{"192.168.1.2", "2001:db8::2"}
+	if !reflect.DeepEqual(got.Addrs, want) {
+		t.Errorf("removeAddrs() addrs = %v, want %v", got.Addrs, want)
+	}
+	if stored, _ := set.get(receiverKey(receiver)); !reflect.DeepEqual(stored.Addrs, want) {
+		t.Errorf("stored addrs = %v, want %v", stored.Addrs, want)
+	}
+}
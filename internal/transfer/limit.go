@@ -0,0 +1,243 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum number of bytes a limiter allows at once
+const minBurst = 32 << 10
+
+// Units accepted in rates, in bytes
+var rateUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// Parse rate such as 20MB/s, 512KiB/s or unlimited into bytes per second
+//
+// A rate of 0 means unlimited.
+func ParseRate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	// Empty and unlimited rates have no limit
+	if s == "" || s == "unlimited" {
+		return 0, nil
+	}
+	// Remove optional per second suffix
+	s = strings.TrimSuffix(s, "/s")
+	// Split number from unit
+	unitIndex := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if unitIndex == -1 {
+		unitIndex = len(s)
+	}
+	number, err := strconv.ParseFloat(s[:unitIndex], 64)
+	if err != nil || number < 0 {
+		return 0, errors.New("invalid rate: " + s)
+	}
+	unit, ok := rateUnits[strings.TrimSpace(s[unitIndex:])]
+	if !ok {
+		return 0, errors.New("unknown rate unit: " + s[unitIndex:])
+	}
+	return int64(number * unit), nil
+}
+
+// Rate applied during a daily time window
+type LimitWindow struct {
+	// Start and end of the window in minutes since midnight. If end is
+	// before start, the window spans midnight.
+	Start, End int
+	// Rate in bytes per second, 0 means unlimited
+	Rate int64
+}
+
+// Parse schedule of windows such as "19:00-07:00 unlimited" or "09:00-17:00 5MB/s"
+func ParseSchedule(schedule []string) ([]LimitWindow, error) {
+	var windows []LimitWindow
+	for _, entry := range schedule {
+		// Split time range from rate
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, errors.New("schedule entries must be of the form HH:MM-HH:MM RATE: " + entry)
+		}
+		times := strings.Split(fields[0], "-")
+		if len(times) != 2 {
+			return nil, errors.New("invalid time range: " + fields[0])
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, LimitWindow{Start: start, End: end, Rate: rate})
+	}
+	return windows, nil
+}
+
+// Parse HH:MM into minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("invalid time of day: " + s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Check whether window contains minute of day
+func (window LimitWindow) contains(minute int) bool {
+	if window.Start <= window.End {
+		return minute >= window.Start && minute < window.End
+	}
+	return minute >= window.Start || minute < window.End
+}
+
+// Token bucket limiting the combined rate of all streams of a transfer
+type Limiter struct {
+	// Rate in bytes per second outside of scheduled windows, 0 means unlimited
+	Rate int64
+	// Windows overriding Rate, the first matching window is used
+	Schedule []LimitWindow
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Create new limiter with given rate and schedule
+func NewLimiter(rate int64, schedule []LimitWindow) *Limiter {
+	return &Limiter{Rate: rate, Schedule: schedule}
+}
+
+// Get rate in bytes per second at given time, 0 means unlimited
+func (limiter *Limiter) RateAt(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range limiter.Schedule {
+		if window.contains(minute) {
+			return window.Rate
+		}
+	}
+	return limiter.Rate
+}
+
+// Block until n bytes may be transferred
+func (limiter *Limiter) Wait(n int) {
+	for n > 0 {
+		limiter.lock.Lock()
+		now := time.Now()
+		rate := limiter.RateAt(now)
+		// If rate is unlimited, reset bucket and return
+		if rate == 0 {
+			limiter.tokens, limiter.last = 0, now
+			limiter.lock.Unlock()
+			return
+		}
+		// Allow bursts of up to one second worth of bytes
+		burst := float64(rate)
+		if burst < minBurst {
+			burst = minBurst
+		}
+		// Refill bucket for time passed since last call
+		if !limiter.last.IsZero() {
+			limiter.tokens += now.Sub(limiter.last).Seconds() * float64(rate)
+		}
+		if limiter.tokens > burst {
+			limiter.tokens = burst
+		}
+		limiter.last = now
+		// Take as many tokens as allowed at once
+		take := float64(n)
+		if take > burst {
+			take = burst
+		}
+		limiter.tokens -= take
+		// Get time needed to refill bucket if it is in debt
+		var delay time.Duration
+		if limiter.tokens < 0 {
+			delay = time.Duration(-limiter.tokens / float64(rate) * float64(time.Second))
+		}
+		limiter.lock.Unlock()
+		time.Sleep(delay)
+		n -= int(take)
+	}
+}
+
+// Wrap reader so that reads are limited by limiter
+func (limiter *Limiter) Reader(reader io.Reader) io.Reader {
+	return limitedReader{reader: reader, limiter: limiter}
+}
+
+// Wrap writer so that writes are limited by limiter
+func (limiter *Limiter) Writer(writer io.Writer) io.Writer {
+	return limitedWriter{writer: writer, limiter: limiter}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.reader.Read(p)
+	lr.limiter.Wait(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	writer  io.Writer
+	limiter *Limiter
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	lw.limiter.Wait(len(p))
+	return lw.writer.Write(p)
+}
+
+// Wrap res so that writes to the response body are limited
+func (limiter *Limiter) ResponseWriter(res http.ResponseWriter) http.ResponseWriter {
+	return limitedResponseWriter{ResponseWriter: res, body: limiter.Writer(res)}
+}
+
+// Response writer whose body writes are limited by limiter
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (lrw limitedResponseWriter) Write(p []byte) (int, error) {
+	return lrw.body.Write(p)
+}
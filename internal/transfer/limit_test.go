@@ -0,0 +1,134 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate  string
+		want  int64
+		valid bool
+	}{
+		{"", 0, true},
+		{"unlimited", 0, true},
+		{"Unlimited", 0, true},
+		{"1000", 1000, true},
+		{"20MB/s", 20e6, true},
+		{"20mb", 20e6, true},
+		{"512KiB/s", 512 << 10, true},
+		{"1.5GB/s", 1.5e9, true},
+		{"2 MiB/s", 2 << 20, true},
+		{"100B/s", 100, true},
+		{"-1MB/s", 0, false},
+		{"fast", 0, false},
+		{"20TB/s", 0, false},
+		{"MB/s", 0, false},
+	}
+	for _, test := range tests {
+		rate, err := ParseRate(test.rate)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseRate(%q) error = %v, want valid %v", test.rate, err, test.valid)
+			continue
+		}
+		if rate != test.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", test.rate, rate, test.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		schedule []string
+		want     []LimitWindow
+		valid    bool
+	}{
+		{nil, nil, true},
+		{[]string{"09:00-17:00 5MB/s"}, []LimitWindow{{Start: 9 * 60, End: 17 * 60, Rate: 5e6}}, true},
+		{[]string{"19:00-07:00 unlimited", "07:00-19:00 1MB/s"}, []LimitWindow{{Start: 19 * 60, End: 7 * 60}, {Start: 7 * 60, End: 19 * 60, Rate: 1e6}}, true},
+		{[]string{"09:00-17:00"}, nil, false},
+		{[]string{"09:00 5MB/s"}, nil, false},
+		{[]string{"9am-5pm 5MB/s"}, nil, false},
+		{[]string{"09:00-24:00 5MB/s"}, nil, false},
+		{[]string{"09:00-17:00 fast"}, nil, false},
+	}
+	for _, test := range tests {
+		windows, err := ParseSchedule(test.schedule)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseSchedule(%q) error = %v, want valid %v", test.schedule, err, test.valid)
+			continue
+		}
+		if len(windows) != len(test.want) {
+			t.Errorf("ParseSchedule(%q) = %v, want %v", test.schedule, windows, test.want)
+			continue
+		}
+		for index := range windows {
+			if windows[index] != test.want[index] {
+				t.Errorf("ParseSchedule(%q) = %v, want %v", test.schedule, windows, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLimiterRateAt(t *testing.T) {
+	schedule, err := ParseSchedule([]string{"19:00-07:00 unlimited", "12:00-13:00 1MB/s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewLimiter(20e6, schedule)
+	tests := []struct {
+		hour, minute int
+		want         int64
+	}{
+		{18, 59, 20e6},
+		{19, 0, 0},
+		{23, 59, 0},
+		{0, 0, 0},
+		{6, 59, 0},
+		{7, 0, 20e6},
+		{12, 30, 1e6},
+		{13, 0, 20e6},
+	}
+	for _, test := range tests {
+		at := time.Date(2021, 1, 1, test.hour, test.minute, 0, 0, time.Local)
+		if rate := limiter.RateAt(at); rate != test.want {
+			t.Errorf("RateAt(%02d:%02d) = %d, want %d", test.hour, test.minute, rate, test.want)
+		}
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	// Unlimited limiters never block
+	start := time.Now()
+	NewLimiter(0, nil).Wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited Wait() took %v", elapsed)
+	}
+	// Transferring half a second worth of bytes takes about half a second
+	limiter := NewLimiter(1<<20, nil)
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		limiter.Wait(128 << 10)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Wait() of 512KiB at 1MiB/s took %v, want about 500ms", elapsed)
+	}
+}
@@ -0,0 +1,534 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// Default average size of the chunks files are split into
+	DefaultChunkSize = 1 << 20
+	// Smallest average chunk size accepted, smaller chunks only add overhead
+	MinChunkSize = 4 << 10
+	// Largest average chunk size accepted, chunks are held in memory while encoded
+	MaxChunkSize = 256 << 20
+	// Largest chunk created by splitChunks, at the largest average chunk size
+	maxChunkBytes = MaxChunkSize * 4
+)
+
+// Get largest size a chunk of size bytes can have once encoded
+//
+// Covers Zstd frames of incompressible data, which grow by less than
+// 1/256 of their size plus headers, and the nonce and tag added by
+// encryption. Blobs are read into memory whole, so larger ones are
+// refused.
+func maxBlobSize(size int64) int64 {
+	return size + size/128 + 4096
+}
+
+// Size of each part of a file sampled to choose its codec
+const sampleSize = 64 << 10
+
+// Codec encoding chunks of files before they are sent
+type ChunkCodec interface {
+	// Choose name of codec for a file using a sample of its content
+	Choose(sample []byte) string
+	// Encode chunk of a file using named codec
+	Encode(data []byte, codec string) []byte
+	// Decode chunk of a file using named codec
+	Decode(data []byte, codec string) ([]byte, error)
+}
+
+// Manifest of the files offered by a sender
+//
+// The manifest is encrypted using the session key before being sent,
+// so that file names and sizes are only visible to the receiver.
+type Manifest struct {
+	Files []ManifestEntry
+}
+
+// File described in a manifest
+type ManifestEntry struct {
+	// Opaque ID the whole file is kept under for delta transfers
+	ID string
+	// Original slash-separated path of the file relative to the work directory
+	Name string
+	// Size of the file
+	Size int64
+	// Permission bits of the file
+	Mode uint32
+	// Modification time of the file in nanoseconds since the Unix epoch
+	ModTime int64
+	// Hex encoded SHA-256 hash of the file
+	Hash string
+	// Name of the codec the chunks of the file were encoded with
+	Codec string
+	// Chunks making up the file, empty if the file is only listed
+	Chunks []Chunk
+}
+
+// Chunk of a file, served as a separate blob
+type Chunk struct {
+	// Opaque ID the blob is served under
+	ID string
+	// Offset of the chunk within the file
+	Offset int64
+	// Size of the chunk within the file
+	Size int64
+	// Size of the encoded blob without padding
+	BlobSize int64
+	// Hex encoded SHA-256 hash of the chunk before encoding
+	Hash string
+}
+
+// Create manifest of all files in dir and its subdirectories, splitting
+// them into content-defined chunks of about chunkSize which are encoded
+// using codec and stored under opaque IDs
+//
+// Chunks with the same content are only encoded once per session, and
+// referenced by every file containing them.
+// The codec of each file is chosen from a sample of its content. Chunks
+// are encoded in parallel and the original files are kept under the ID
+// of their entry, so that deltas can be created from them.
+// If pad is true, random bytes are appended to every blob so that its
+// size only reveals its approximate magnitude (see paddedSize).
+//
+// If encode is not nil, files for which it returns false are only
+// listed in the manifest and kept under their names. They can be encoded
+// later using the returned encoder.
+func CreateManifest(dir string, chunkSize int64, pad bool, codec ChunkCodec, encode func(ManifestEntry) bool) (*Manifest, *ManifestEncoder) {
+	// Create encoder for files in dir
+	encoder := NewManifestEncoder(dir, chunkSize, pad, codec)
+	// List all files in dir before blobs are added to it
+	manifest := ListManifest(dir)
+	// Encode every file which should not only be listed
+	for index := range manifest.Files {
+		if encode == nil || encode(manifest.Files[index]) {
+			encoder.Encode(&manifest.Files[index])
+		}
+	}
+	encoder.Finish()
+	return manifest, encoder
+}
+
+// Encoder of listed files into blobs, deduplicating chunks across all
+// files it encodes
+type ManifestEncoder struct {
+	dir       string
+	chunkSize int64
+	pad       bool
+	codec     ChunkCodec
+	// Index of encoded chunks by codec and hash, and of their blob sizes
+	chunkIndex map[string]string
+	blobSizes  map[string]int64
+	// Counters for session summary
+	files, totalSize, uniqueSize, uniqueChunks int64
+}
+
+// Create encoder for files in dir (see CreateManifest)
+func NewManifestEncoder(dir string, chunkSize int64, pad bool, codec ChunkCodec) *ManifestEncoder {
+	// Make sure chunk size is within accepted range, as splitChunks
+	// computes its limits and mask from it
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		log.Fatal().Int64("chunkSize", chunkSize).Msg("Chunk size out of range")
+	}
+	return &ManifestEncoder{
+		dir:        dir,
+		chunkSize:  chunkSize,
+		pad:        pad,
+		codec:      codec,
+		chunkIndex: map[string]string{},
+		blobSizes:  map[string]int64{},
+	}
+}
+
+// Encode listed file of entry into blobs, filling in its codec and
+// chunks, and keep the original file under the ID of the entry
+func (encoder *ManifestEncoder) Encode(entry *ManifestEntry) {
+	path := filepath.Join(encoder.dir, filepath.FromSlash(entry.Name))
+	// Choose codec using a sample of the file
+	entry.Codec = encoder.codec.Choose(readSample(path, entry.Size))
+	// Split file into content-defined chunks
+	entry.Chunks = splitChunks(path, encoder.chunkSize)
+	// Create list of chunks which were not encoded yet
+	var newChunks []int
+	for index := range entry.Chunks {
+		chunk := &entry.Chunks[index]
+		// Chunks are only shared between files with the same codec
+		key := entry.Codec + ":" + chunk.Hash
+		if id, ok := encoder.chunkIndex[key]; ok {
+			// Reference existing blob
+			chunk.ID = id
+			continue
+		}
+		// Create new blob for chunk
+		chunk.ID = randomID()
+		encoder.chunkIndex[key] = chunk.ID
+		newChunks = append(newChunks, index)
+		encoder.uniqueSize += chunk.Size
+		encoder.uniqueChunks++
+	}
+	// Encode new chunks of file into blobs
+	encodeChunks(encoder.dir, path, entry, newChunks, encoder.pad, encoder.codec, encoder.blobSizes)
+	// Set blob size of all chunks, including those referencing existing blobs
+	for index := range entry.Chunks {
+		entry.Chunks[index].BlobSize = encoder.blobSizes[entry.Chunks[index].ID]
+	}
+	encoder.files++
+	encoder.totalSize += entry.Size
+	// Keep original file under the ID of the entry
+	err := os.Rename(path, filepath.Join(encoder.dir, entry.ID))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error renaming file")
+	}
+	// Log number of chunks created
+	log.Info().Str("file", entry.Name).Str("codec", entry.Codec).Int("chunks", len(entry.Chunks)).Int("new", len(newChunks)).Msg("Encoded file")
+}
+
+// Log session summary with deduplication savings and remove
+// subdirectories left empty by encoding files
+func (encoder *ManifestEncoder) Finish() {
+	log.Info().
+		Int64("files", encoder.files).
+		Int64("size", encoder.totalSize).
+		Int64("uniqueChunks", encoder.uniqueChunks).
+		Int64("uniqueSize", encoder.uniqueSize).
+		Int64("deduplicated", encoder.totalSize-encoder.uniqueSize).
+		Msg("Session summary")
+	removeEmptyDirs(encoder.dir)
+}
+
+// Remove empty subdirectories of dir, so that only blobs and files
+// which are only listed remain
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error reading directory")
+	}
+	// Remove deepest directories first, so that their parents become empty
+	for index := len(dirs) - 1; index >= 0; index-- {
+		dirListing, err := ioutil.ReadDir(dirs[index])
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error reading directory")
+		}
+		if len(dirListing) == 0 {
+			err = os.Remove(dirs[index])
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error removing directory")
+			}
+		}
+	}
+}
+
+// Create manifest listing the files in dir without encoding or moving them
+//
+// The files are kept under their names, so that they can be served as is.
+func ListManifest(dir string) *Manifest {
+	manifest := &Manifest{}
+	for _, path := range walkFiles(dir) {
+		manifest.Files = append(manifest.Files, newEntry(dir, path))
+	}
+	return manifest
+}
+
+// Get paths of all regular files in dir, recursively
+func walkFiles(dir string) []string {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error reading directory")
+	}
+	return paths
+}
+
+// Create manifest entry with a new ID for file at path in dir
+func newEntry(dir string, path string) ManifestEntry {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error getting file info")
+	}
+	// Get path relative to dir
+	relPath, err := filepath.Rel(dir, path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error getting relative path")
+	}
+	// Fail here rather than on the receiver, which refuses such names
+	if !isLocalPath(filepath.ToSlash(relPath)) {
+		log.Fatal().Str("file", path).Msg("File name cannot be sent, it contains control characters")
+	}
+	return ManifestEntry{
+		ID:      randomID(),
+		Name:    filepath.ToSlash(relPath),
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    HashFile(path),
+	}
+}
+
+// Get manifest containing only the files for which keep returns true
+func (manifest *Manifest) Filter(keep func(ManifestEntry) bool) *Manifest {
+	filtered := &Manifest{}
+	for _, entry := range manifest.Files {
+		if keep(entry) {
+			filtered.Files = append(filtered.Files, entry)
+		}
+	}
+	return filtered
+}
+
+// Find entry kept under ID in manifest
+func (manifest *Manifest) Entry(id string) (ManifestEntry, bool) {
+	for _, entry := range manifest.Files {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// Encode chunks of entry at given indices from file at path into dir
+// using one worker per CPU, storing the size of every blob in blobSizes
+func encodeChunks(dir string, path string, entry *ManifestEntry, indices []int, pad bool, codec ChunkCodec, blobSizes map[string]int64) {
+	// Open file to read chunks from
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening file")
+	}
+	// Close file at the end of this function
+	defer file.Close()
+	// Create channel of indices of chunks to encode
+	jobs := make(chan int)
+	// Create lock protecting blobSizes
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				chunk := &entry.Chunks[index]
+				// Read chunk from file
+				data := make([]byte, chunk.Size)
+				_, err := file.ReadAt(data, chunk.Offset)
+				if err != nil {
+					log.Fatal().Err(err).Msg("Error reading chunk")
+				}
+				// Encode chunk
+				blob := codec.Encode(data, entry.Codec)
+				blobSize := int64(len(blob))
+				lock.Lock()
+				blobSizes[chunk.ID] = blobSize
+				lock.Unlock()
+				// If padding requested, pad blob
+				if pad {
+					blob = append(blob, randomBytes(paddedSize(blobSize)-blobSize)...)
+				}
+				// Write blob under its ID
+				err = ioutil.WriteFile(filepath.Join(dir, chunk.ID), blob, 0644)
+				if err != nil {
+					log.Fatal().Err(err).Msg("Error writing blob")
+				}
+			}
+		}()
+	}
+	// Send chunks to the workers
+	for _, index := range indices {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Read sample of the start and middle of file at path of given size
+func readSample(path string, size int64) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening file")
+	}
+	defer file.Close()
+	var sample []byte
+	// For the start and the middle of the file
+	for _, offset := range []int64{0, size / 2} {
+		// Read up to sampleSize bytes at offset
+		part := make([]byte, sampleSize)
+		n, err := file.ReadAt(part, offset)
+		if err != nil && err != io.EOF {
+			log.Fatal().Err(err).Msg("Error sampling file")
+		}
+		sample = append(sample, part[:n]...)
+		// If the whole file fits in the sample, stop
+		if size <= sampleSize {
+			break
+		}
+	}
+	return sample
+}
+
+// Encode manifest as MessagePack
+func (manifest *Manifest) Marshal() []byte {
+	data, err := msgpack.Marshal(manifest)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error encoding manifest")
+	}
+	return data
+}
+
+// Decode manifest from MessagePack, validating its entries
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	err := msgpack.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	// For each entry
+	for _, entry := range manifest.Files {
+		// Make sure the name cannot be used to escape the work directory
+		if !isBlobID(entry.ID) || !isLocalPath(entry.Name) || entry.Size < 0 {
+			return nil, fmt.Errorf("invalid manifest entry %q", entry.Name)
+		}
+		// For each chunk
+		for _, chunk := range entry.Chunks {
+			// Make sure the ID is valid and the chunk lies within the file
+			if !isBlobID(chunk.ID) || chunk.Offset < 0 || chunk.Size < 0 || chunk.BlobSize < 0 || chunk.Offset+chunk.Size > entry.Size {
+				return nil, fmt.Errorf("invalid chunk in manifest entry %q", entry.Name)
+			}
+			// Make sure the chunk and its blob are small enough to be held in memory
+			if chunk.Size > maxChunkBytes || chunk.BlobSize > maxBlobSize(chunk.Size) {
+				return nil, fmt.Errorf("chunk of manifest entry %q is too large (blob of %d bytes)", entry.Name, chunk.BlobSize)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// Check whether slash-separated path stays within the directory it is relative to
+//
+// Paths containing control characters are refused as well, so that names
+// cannot add lines to the lists passed to hooks.
+func isLocalPath(name string) bool {
+	// Path must be clean, relative and not empty
+	if name == "" || name == "." || strings.HasPrefix(name, "/") || path.Clean(name) != name {
+		return false
+	}
+	// Path must not contain control characters, such as newlines
+	if strings.IndexFunc(name, unicode.IsControl) != -1 {
+		return false
+	}
+	// Path must not contain parent directory or backslash components
+	for _, component := range strings.Split(name, "/") {
+		if component == ".." || strings.Contains(component, "\\") {
+			return false
+		}
+	}
+	return true
+}
+
+// Generate random opaque blob ID
+func randomID() string {
+	id := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating blob ID")
+	}
+	return hex.EncodeToString(id)
+}
+
+// Check whether s is a valid blob ID
+func isBlobID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Get hex encoded SHA-256 hash of file at path
+func HashFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening file")
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error hashing file")
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Generate n random bytes
+func randomBytes(n int64) []byte {
+	data := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, data)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating padding")
+	}
+	return data
+}
+
+// Get size blob of given size is padded to
+//
+// Uses the Padmé scheme, which leaks O(log log n) bits of the size
+// with at most 12% overhead.
+func paddedSize(size int64) int64 {
+	if size < 2 {
+		return size
+	}
+	// Number of bits needed for the exponent of size
+	e := 63 - bits.LeadingZeros64(uint64(size))
+	s := 64 - bits.LeadingZeros64(uint64(e))
+	// Number of low bits to clear
+	lastBits := e - s
+	mask := int64(1)<<uint(lastBits) - 1
+	return (size + mask) &^ mask
+}
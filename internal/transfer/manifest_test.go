@@ -0,0 +1,87 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		local bool
+	}{
+		{"file.txt", true},
+		{"dir/file.txt", true},
+		{"dir/..file", true},
+		{"dir/fïle €.txt", true},
+		{"", false},
+		{".", false},
+		{"/etc/passwd", false},
+		{"../file.txt", false},
+		{"dir/../../file.txt", false},
+		{"dir//file.txt", false},
+		{"dir\\..\\file.txt", false},
+		{"file\n/etc/passwd", false},
+		{"file\r.txt", false},
+		{"file\x00.txt", false},
+		{"file\t.txt", false},
+		{"file\u0085.txt", false},
+	}
+	for _, test := range tests {
+		if local := isLocalPath(test.name); local != test.local {
+			t.Errorf("isLocalPath(%q) = %v, want %v", test.name, local, test.local)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	id := strings.Repeat("ab", 16)
+	chunk := Chunk{ID: id, Offset: 0, Size: 1024, BlobSize: 1100}
+	tests := []struct {
+		name  string
+		entry ManifestEntry
+		valid bool
+	}{
+		{"valid", ManifestEntry{ID: id, Name: "dir/file.txt", Size: 1024, Chunks: []Chunk{chunk}}, true},
+		{"listed", ManifestEntry{ID: id, Name: "file.txt", Size: 1024}, true},
+		{"empty", ManifestEntry{ID: id, Name: "file.txt", Chunks: []Chunk{{ID: id}}}, true},
+		{"invalid name", ManifestEntry{ID: id, Name: "../file.txt", Size: 1024, Chunks: []Chunk{chunk}}, false},
+		{"invalid ID", ManifestEntry{ID: "../file", Name: "file.txt", Size: 1024, Chunks: []Chunk{chunk}}, false},
+		{"negative size", ManifestEntry{ID: id, Name: "file.txt", Size: -1}, false},
+		{"chunk outside file", ManifestEntry{ID: id, Name: "file.txt", Size: 512, Chunks: []Chunk{chunk}}, false},
+		{"invalid chunk ID", ManifestEntry{ID: id, Name: "file.txt", Size: 1024, Chunks: []Chunk{{ID: "x", Size: 1024, BlobSize: 1024}}}, false},
+		{"oversized blob", ManifestEntry{ID: id, Name: "file.txt", Size: 1024, Chunks: []Chunk{{ID: id, Size: 1024, BlobSize: 1 << 40}}}, false},
+		{"oversized chunk", ManifestEntry{ID: id, Name: "file.txt", Size: 1 << 40, Chunks: []Chunk{{ID: id, Size: 1 << 40, BlobSize: 1 << 40}}}, false},
+	}
+	for _, test := range tests {
+		data, err := msgpack.Marshal(&Manifest{Files: []ManifestEntry{test.entry}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseManifest(data)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: ParseManifest() error = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+	if _, err := ParseManifest([]byte("not a manifest")); err == nil {
+		t.Error("ParseManifest() of invalid data succeeded")
+	}
+}
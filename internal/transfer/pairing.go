@@ -0,0 +1,98 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// Scheme of pairing payloads
+const PairingScheme = "opensend"
+
+// Everything a sender needs to reach a receiver, shown as a QR code
+type Pairing struct {
+	// Addresses of receiver, most preferred first, or of relay
+	Addrs []string
+	// Key exchange port of receiver, or port of relay
+	Port int
+	// Whether Addrs and Port are those of a relay
+	Relay bool
+	// Session code
+	Code string
+	// Fingerprint of receiver's identity key
+	Fingerprint string
+}
+
+// Encode pairing as an opensend:// URL, such as
+// opensend://192.168.1.2:9797?addr=10.0.0.2&code=2xz3-ukdb-ztzo-7lxa&fp=...
+func (pairing Pairing) String() string {
+	// Put first address in host, and the rest in query
+	host := ""
+	if len(pairing.Addrs) > 0 {
+		host = JoinHostPort(pairing.Addrs[0], pairing.Port)
+	}
+	query := url.Values{}
+	if len(pairing.Addrs) > 1 {
+		query["addr"] = pairing.Addrs[1:]
+	}
+	if pairing.Relay {
+		query.Set("relay", "1")
+	}
+	if pairing.Code != "" {
+		query.Set("code", pairing.Code)
+	}
+	if pairing.Fingerprint != "" {
+		query.Set("fp", pairing.Fingerprint)
+	}
+	return (&url.URL{Scheme: PairingScheme, Host: host, RawQuery: query.Encode()}).String()
+}
+
+// Parse pairing encoded by Pairing.String
+func ParsePairing(s string) (Pairing, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Pairing{}, err
+	}
+	if u.Scheme != PairingScheme {
+		return Pairing{}, errors.New("not an opensend pairing: " + s)
+	}
+	// Get first address and port, both are required
+	host, port := u.Hostname(), u.Port()
+	if host == "" || port == "" {
+		return Pairing{}, errors.New("pairing has no address and port: " + s)
+	}
+	pairing := Pairing{Addrs: []string{host}}
+	pairing.Port, err = strconv.Atoi(port)
+	if err != nil || pairing.Port < 1 || pairing.Port > 65535 {
+		return Pairing{}, errors.New("invalid port: " + port)
+	}
+	query := u.Query()
+	// Check remaining addresses the same way as --send-to
+	for _, addr := range query["addr"] {
+		host, _, err := ParseHost(addr)
+		if err != nil {
+			return Pairing{}, err
+		}
+		pairing.Addrs = append(pairing.Addrs, host)
+	}
+	pairing.Relay = query.Get("relay") == "1"
+	pairing.Code = query.Get("code")
+	pairing.Fingerprint = query.Get("fp")
+	return pairing, nil
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairingRoundTrip(t *testing.T) {
+	tests := []Pairing{
+		{Addrs: []string{"192.168.1.2"}, Port: 9797, Code: "2xz3-ukdb-ztzo-7lxa", Fingerprint: "AB:CD"},
+		{Addrs: []string{"192.168.1.2", "2001:db8::2", "laptop.local"}, Port: 9797, Code: "2xz3-ukdb-ztzo-7lxa"},
+		{Addrs: []string{"fe80::2%eth0", "fe80::3%wlan0"}, Port: 9797, Fingerprint: "AB:CD"},
+		{Addrs: []string{"relay.example.com"}, Port: 9900, Relay: true, Code: "2xz3 ukdb&ztzo=7lxa"},
+	}
+	for _, pairing := range tests {
+		s := pairing.String()
+		parsed, err := ParsePairing(s)
+		if err != nil {
+			t.Errorf("ParsePairing(%q) error = %v", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, pairing) {
+			t.Errorf("ParsePairing(%q) = %+v, want %+v", s, parsed, pairing)
+		}
+	}
+}
+
+func TestParsePairingInvalid(t *testing.T) {
+	tests := []string{
+		"https://192.168.1.2:9797",
+		"opensend://192.168.1.2",
+		"opensend://:9797",
+		"opensend://192.168.1.2:70000",
+		"opensend://192.168.1.2:9797?addr=laptop%25eth0",
+	}
+	for _, s := range tests {
+		if _, err := ParsePairing(s); err == nil {
+			t.Errorf("ParsePairing(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Default port of relay servers
+const DefaultRelayPort = 9900
+
+// Magic string starting every relay hello
+const relayMagic = "OSRELAY1"
+
+// Roles of relay clients, a listening client is paired with a dialing one
+const (
+	relayListen = "listen"
+	relayDial   = "dial"
+)
+
+// Maximum time a relay client may take to send its hello
+const relayHelloTimeout = 10 * time.Second
+
+// Maximum size of a relay hello, including its newline
+const maxRelayHello = 256
+
+// Generate random session code to find a peer on a relay
+//
+// Codes are regenerated in the rare case that they would be refused by
+// CheckCode.
+func GenerateCode() string {
+	for {
+		codeBytes := make([]byte, 10)
+		_, err := io.ReadFull(rand.Reader, codeBytes)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error generating session code")
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(codeBytes))
+		// Group code for readability
+		code = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		if CheckCode(code) == nil {
+			return code
+		}
+	}
+}
+
+// Minimum number of characters and of distinct characters of a session
+// code chosen by the user, ignoring separators
+const (
+	minCodeLength   = 16
+	minCodeDistinct = 8
+)
+
+// Check whether session code chosen by the user is long and varied enough
+//
+// Anyone who sees a relay channel ID can test guesses of the code
+// offline, so codes must be about as hard to guess as generated ones.
+func CheckCode(code string) error {
+	// Ignore separators and case, as in generated codes
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	distinct := map[rune]bool{}
+	for _, char := range code {
+		distinct[char] = true
+	}
+	if len(code) < minCodeLength || len(distinct) < minCodeDistinct {
+		return fmt.Errorf("session code must have at least %d characters, %d of them distinct", minCodeLength, minCodeDistinct)
+	}
+	return nil
+}
+
+// Get ID of a relay channel for session code and name
+//
+// The relay only sees this hash, so that it cannot learn the code.
+func RelayChannel(code string, name string) string {
+	hash := sha256.Sum256([]byte("opensend relay " + name + " " + code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Connect to relay at relayAddr, joining channel with role, and wait
+// until a peer with the opposite role joins it
+func joinRelay(ctx context.Context, relayAddr string, channel string, role string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Close connection if ctx is done while waiting for peer
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	// Send hello
+	_, err = io.WriteString(conn, relayMagic+" "+role+" "+channel+"\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Wait for relay to report that a peer joined
+	ack := make([]byte, 3)
+	_, err = io.ReadFull(conn, ack)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if string(ack) != "ok\n" {
+		conn.Close()
+		return nil, errors.New("unexpected reply from relay")
+	}
+	return conn, nil
+}
+
+// Connect to the peer listening on channel of relay at relayAddr
+func DialRelay(relayAddr string, channel string) (net.Conn, error) {
+	return joinRelay(context.Background(), relayAddr, channel, relayDial)
+}
+
+// Address of a relay channel
+type relayAddr string
+
+func (addr relayAddr) Network() string { return "relay" }
+func (addr relayAddr) String() string  { return string(addr) }
+
+// Listener accepting connections from peers dialing a relay channel
+type RelayListener struct {
+	relayAddr string
+	channel   string
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// Listen for peers dialing channel of relay at relayAddr
+func ListenRelay(relayAddr string, channel string) *RelayListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RelayListener{relayAddr: relayAddr, channel: channel, ctx: ctx, cancel: cancel}
+}
+
+// Wait for the next peer dialing the relay channel
+func (listener *RelayListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := joinRelay(listener.ctx, listener.relayAddr, listener.channel, relayListen)
+		if listener.ctx.Err() != nil {
+			return nil, errors.New("relay listener closed")
+		}
+		if err != nil {
+			// Retry after a short delay, as the relay may drop stale peers
+			log.Warn().Err(err).Msg("Error joining relay, retrying")
+			time.Sleep(time.Second)
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// Stop listening, closing any connection waiting for a peer
+func (listener *RelayListener) Close() error {
+	listener.cancel()
+	return nil
+}
+
+// Get address of relay
+func (listener *RelayListener) Addr() net.Addr {
+	return relayAddr(listener.relayAddr)
+}
+
+// Create new sender reached through channel of relay at relayAddr
+//
+// tlsConfig must verify that the server is part of this session.
+func NewRelaySender(relayAddr string, channel string, tlsConfig *tls.Config) *Sender {
+	// Create HTTP client dialing relay channel for every connection
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: maxStreams,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return joinRelay(ctx, relayAddr, channel, relayDial)
+		},
+	}}
+	return &Sender{RemoteAddr: "https://relay", client: client}
+}
+
+// Relay client waiting for a peer
+type relayWaiter struct {
+	conn net.Conn
+	role string
+	// Closed once the waiter is claimed by a peer
+	claimed chan struct{}
+	// Closed once the waiter stops watching its connection
+	done chan struct{}
+}
+
+// Relay server pairing clients which joined the same channel
+type relayServer struct {
+	lock    sync.Mutex
+	waiting map[string][]*relayWaiter
+}
+
+// Run relay server on listener until it is closed
+//
+// The relay only splices connections and never sees plaintext, as all
+// traffic between sender and receiver is end-to-end encrypted.
+func RunRelay(listener net.Listener) {
+	server := &relayServer{waiting: map[string][]*relayWaiter{}}
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Fatal().Err(err).Msg("Error accepting connections")
+		}
+		go server.handle(conn)
+	}
+}
+
+// Handle new relay client
+func (server *relayServer) handle(conn net.Conn) {
+	// Read hello
+	conn.SetReadDeadline(time.Now().Add(relayHelloTimeout))
+	line, err := readRelayHello(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != relayMagic || (fields[1] != relayListen && fields[1] != relayDial) {
+		conn.Close()
+		return
+	}
+	role, channel := fields[1], fields[2]
+	waiter := &relayWaiter{conn: conn, role: role, claimed: make(chan struct{}), done: make(chan struct{})}
+	// If a peer is waiting on the channel, pair with it, otherwise wait for one
+	if peer := server.claimOrWait(channel, waiter); peer != nil {
+		// Stop peer from watching its connection
+		peer.conn.SetReadDeadline(time.Now())
+		<-peer.done
+		peer.conn.SetReadDeadline(time.Time{})
+		splice(peer.conn, conn)
+		return
+	}
+	// Watch connection, so that clients which leave are removed
+	go func() {
+		defer close(waiter.done)
+		_, err := conn.Read(make([]byte, 1))
+		select {
+		case <-waiter.claimed:
+			// Read was interrupted by a peer claiming this waiter
+		default:
+			// Client left or sent data before being paired
+			_ = err
+			server.remove(channel, waiter)
+			conn.Close()
+		}
+	}()
+}
+
+// Read hello line from conn, refusing lines longer than maxRelayHello
+//
+// The line is read one byte at a time, so that data sent right after it
+// is left for the peer.
+func readRelayHello(conn net.Conn) (string, error) {
+	reader := io.LimitReader(conn, maxRelayHello)
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(reader, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+// Remove and return a waiter of the opposite role on channel, if any,
+// otherwise add waiter to channel
+//
+// Both happen under a single lock, so that two peers joining at the same
+// time cannot both miss each other and wait forever.
+func (server *relayServer) claimOrWait(channel string, newWaiter *relayWaiter) *relayWaiter {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for index, waiter := range server.waiting[channel] {
+		if waiter.role != newWaiter.role {
+			server.waiting[channel] = append(server.waiting[channel][:index], server.waiting[channel][index+1:]...)
+			if len(server.waiting[channel]) == 0 {
+				delete(server.waiting, channel)
+			}
+			close(waiter.claimed)
+			return waiter
+		}
+	}
+	server.waiting[channel] = append(server.waiting[channel], newWaiter)
+	return nil
+}
+
+// Remove waiter from channel if it was not claimed
+func (server *relayServer) remove(channel string, waiter *relayWaiter) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for index, other := range server.waiting[channel] {
+		if other == waiter {
+			server.waiting[channel] = append(server.waiting[channel][:index], server.waiting[channel][index+1:]...)
+			if len(server.waiting[channel]) == 0 {
+				delete(server.waiting, channel)
+			}
+			return
+		}
+	}
+}
+
+// Tell both clients they are paired, then copy data between them until both are done
+func splice(a net.Conn, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	for _, conn := range []net.Conn{a, b} {
+		if _, err := io.WriteString(conn, "ok\n"); err != nil {
+			return
+		}
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	// Copy data from src to dst, closing dst for writing once src is done
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tcpConn, ok := dst.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
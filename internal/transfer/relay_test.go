@@ -0,0 +1,200 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckCode(t *testing.T) {
+	tests := []struct {
+		code string
+		ok   bool
+	}{
+		{"2xz3-ukdb-ztzo-7lxa", true},
+		{"2XZ3 UKDB ZTZO 7LXA", true},
+		{"correct horse battery staple", true},
+		{"", false},
+		{"1234", false},
+		{"2xz3-ukdb-ztzo", false},
+		{"aaaa-aaaa-aaaa-aaaa", false},
+		{"abab-abab-abab-abab-abab", false},
+	}
+	for _, test := range tests {
+		if err := CheckCode(test.code); (err == nil) != test.ok {
+			t.Errorf("CheckCode(%q) = %v, want ok %v", test.code, err, test.ok)
+		}
+	}
+	// Generated codes must always be accepted
+	for i := 0; i < 100; i++ {
+		if code := GenerateCode(); CheckCode(code) != nil {
+			t.Errorf("CheckCode(%q) refused generated code", code)
+		}
+	}
+}
+
+// Start relay server on a loopback port, stopping it at the end of the test
+func startRelay(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunRelay(listener)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+func TestRelayPairsPeers(t *testing.T) {
+	relayAddr := startRelay(t)
+	// Peers of many channels join at the same time, in no particular order,
+	// and every pair must find each other
+	const pairs = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*pairs)
+	for i := 0; i < pairs; i++ {
+		channel := RelayChannel("code-"+strconv.Itoa(i), "key")
+		want := "hello " + strconv.Itoa(i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			listener := ListenRelay(relayAddr, channel)
+			defer listener.Close()
+			conn, err := listener.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, want); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			conn, err := DialRelay(relayAddr, channel)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				errs <- err
+			} else if string(got) != want {
+				t.Errorf("peer on channel %d received %q, want %q", i, got, want)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("peers were not paired")
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRelaySeparatesChannels(t *testing.T) {
+	relayAddr := startRelay(t)
+	listener := ListenRelay(relayAddr, RelayChannel("2xz3-ukdb-ztzo-7lxa", "key"))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	// Dialing another channel must not reach the listener
+	go DialRelay(relayAddr, RelayChannel("other-code-value", "key"))
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Fatal("peer on another channel was paired")
+	case <-time.After(500 * time.Millisecond):
+	}
+	listener.Close()
+}
+
+func TestReadRelayHello(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		hello string
+		valid bool
+	}{
+		{"hello", relayMagic + " listen channel\nrest", relayMagic + " listen channel", true},
+		{"longest", strings.Repeat("a", maxRelayHello-1) + "\n", strings.Repeat("a", maxRelayHello-1), true},
+		{"too long", strings.Repeat("a", maxRelayHello) + "\n", "", false},
+		{"unterminated", relayMagic + " listen", "", false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, test.data)
+			client.Close()
+		}()
+		hello, err := readRelayHello(server)
+		if (err == nil) != test.valid || hello != test.hello {
+			t.Errorf("%s: readRelayHello() = %q, %v, want %q, valid %v", test.name, hello, err, test.hello, test.valid)
+		}
+		// Data sent after the hello is left for the peer
+		if test.valid {
+			rest, _ := io.ReadAll(server)
+			if want := test.data[len(test.hello)+1:]; string(rest) != want {
+				t.Errorf("%s: data after hello = %q, want %q", test.name, rest, want)
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestRelayClosesLongHello(t *testing.T) {
+	relayAddr := startRelay(t)
+	conn, err := net.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send more than a hello without a newline, then wait for the relay to hang up
+	go io.WriteString(conn, strings.Repeat("a", 64<<10))
+	conn.SetReadDeadline(time.Now().Add(relayHelloTimeout / 2))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Errorf("Read() after long hello = %v, want connection closed", err)
+	}
+}
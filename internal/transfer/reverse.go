@@ -0,0 +1,173 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Byte sent by the receiver when it starts using a reverse connection
+const reverseGo = 1
+
+// Listener "accepting" connections by dialing a listening receiver, so
+// that the sender can serve files when only the receiver can be reached
+//
+// A connection is only returned once the receiver starts using it, so
+// that a single idle connection is open at any time.
+type DialListener struct {
+	addr string
+	lock sync.Mutex
+	// Connection waiting to be used by the receiver
+	pending net.Conn
+	closed  bool
+}
+
+// Create listener dialing addr for every connection
+func NewDialListener(addr string) *DialListener {
+	return &DialListener{addr: addr}
+}
+
+// Dial receiver and wait until it starts using the connection
+func (listener *DialListener) Accept() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", listener.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// Store connection so that Close can interrupt the wait
+	listener.lock.Lock()
+	if listener.closed {
+		listener.lock.Unlock()
+		conn.Close()
+		return nil, errors.New("dial listener closed")
+	}
+	listener.pending = conn
+	listener.lock.Unlock()
+	// Wait for receiver to start using the connection
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	listener.lock.Lock()
+	listener.pending = nil
+	listener.lock.Unlock()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if buf[0] != reverseGo {
+		conn.Close()
+		return nil, errors.New("unexpected data from receiver")
+	}
+	return conn, nil
+}
+
+// Stop dialing, closing any connection waiting to be used
+func (listener *DialListener) Close() error {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	listener.closed = true
+	if listener.pending != nil {
+		listener.pending.Close()
+	}
+	return nil
+}
+
+// Get address dialed by listener
+func (listener *DialListener) Addr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", listener.addr)
+	if err != nil {
+		return relayAddr(listener.addr)
+	}
+	return addr
+}
+
+// Create new sender which connects to listener to serve files
+//
+// Connections accepted on listener are used for requests to the
+// sender in turn. As anyone may connect to listener, tlsConfig must
+// verify that the server is part of this session, and connections
+// failing the TLS handshake are skipped instead of failing requests.
+func NewReverseSender(listener net.Listener, tlsConfig *tls.Config) *Sender {
+	// Accept connections in the background until listener is closed, so
+	// that waiting for one can be cancelled
+	conns := make(chan net.Conn)
+	var acceptErr error
+	go func() {
+		defer close(conns)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErr = err
+				return
+			}
+			conns <- conn
+		}
+	}()
+	// Create HTTP client using accepted connections
+	client := &http.Client{Transport: &http.Transport{
+		MaxIdleConnsPerHost: maxStreams,
+		DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			for {
+				// Wait for next connection from sender
+				var conn net.Conn
+				var ok bool
+				select {
+				case conn, ok = <-conns:
+					if !ok {
+						return nil, acceptErr
+					}
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				// Tell sender the connection is used, skipping it if it was closed
+				_, err := conn.Write([]byte{reverseGo})
+				if err != nil {
+					conn.Close()
+					continue
+				}
+				// Make sure connection comes from the sender of this session
+				tlsConn, err := reverseHandshake(ctx, conn, tlsConfig)
+				if err != nil {
+					log.Warn().Err(err).Str("addr", conn.RemoteAddr().String()).Msg("Skipping connection which is not part of this session")
+					continue
+				}
+				return tlsConn, nil
+			}
+		},
+	}}
+	return &Sender{RemoteAddr: "https://reverse", client: client}
+}
+
+// Perform TLS handshake on connection accepted from the sender, closing
+// it if the handshake fails or takes longer than dialTimeout
+func reverseHandshake(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfig)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Create TLS configs of a server with a self-signed certificate and of a
+// client trusting only that certificate
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "opensend"},
+		DNSNames:     []string{"opensend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}}}
+	client := &tls.Config{RootCAs: pool, ServerName: "opensend"}
+	return server, client
+}
+
+// Handler answering every request with "hello"
+var helloHandler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+	io.WriteString(res, "hello")
+})
+
+// Get endpoint from sender and make sure it answers "hello"
+func expectHello(t *testing.T, sender *Sender, endpoint string) {
+	t.Helper()
+	body, code, err := sender.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || string(data) != "hello" {
+		t.Errorf("GET %s = %d %q, want 200 \"hello\"", endpoint, code, data)
+	}
+}
+
+func TestReverseSenderSkipsForeignConnections(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	// Receiver listens for the sender
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Another host connects first and answers the handshake with garbage
+	rogue, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rogue.Close()
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := rogue.Read(buf); err == nil {
+			io.WriteString(rogue, "garbage, not a TLS server hello")
+		}
+	}()
+	sender := NewReverseSender(listener, clientTLS)
+	// Sender connects to receiver to serve files
+	transport := NewTCPTransport(NewDialListener(listener.Addr().String()))
+	defer transport.Close()
+	go transport.Serve(helloHandler, serverTLS)
+	expectHello(t, sender, "/hello")
+}
+
+func TestReverseSenderHonorsContext(t *testing.T) {
+	_, clientTLS := testTLSConfigs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sender := NewReverseSender(listener, clientTLS)
+	// No sender ever connects, so the request must end with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sender.RemoteAddr+"/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := sender.client.Do(req); err == nil {
+		t.Fatal("request succeeded without sender")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %v after its context expired", elapsed)
+	}
+}
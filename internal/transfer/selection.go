@@ -0,0 +1,97 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// Minimum length of a fingerprint prefix accepted when matching receivers
+const minFingerprintPrefix = 8
+
+// Check whether receiver matches pattern
+//
+// A pattern matches if it is equal to the receiver's name or host name
+// (ignoring case), is a prefix of at least 8 characters of its
+// fingerprint, or is a glob (see path.Match) matching its name.
+func (receiver Receiver) Matches(pattern string) bool {
+	name := strings.ToLower(receiver.Name)
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	// Host name without trailing .local.
+	hostName := strings.TrimSuffix(strings.ToLower(receiver.HostName), ".local.")
+	if pattern == name || pattern == hostName {
+		return true
+	}
+	// Remove separators commonly used when copying fingerprints
+	fpPattern := strings.NewReplacer(":", "", " ", "").Replace(pattern)
+	if receiver.Fingerprint != "" && len(fpPattern) >= minFingerprintPrefix &&
+		strings.HasPrefix(receiver.Fingerprint, fpPattern) {
+		return true
+	}
+	// Attempt to match pattern as a glob, ignoring malformed patterns
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// Get all receivers matching pattern, in discovery order
+func SelectReceivers(receivers []Receiver, pattern string) []Receiver {
+	var out []Receiver
+	for _, receiver := range receivers {
+		if receiver.Matches(pattern) {
+			out = append(out, receiver)
+		}
+	}
+	return out
+}
+
+// Browse using discoverer until a receiver matching pattern appears or timeout expires
+func WaitForReceiver(discoverer Discoverer, pattern string, timeout time.Duration) (Receiver, error) {
+	// Create context with given timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	// Cancel context at the end of this function
+	defer cancel()
+	// Create channel for matching receiver
+	match := make(chan Receiver, 1)
+	// Browse in the background
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		discoverer.Browse(ctx, func(receiver Receiver) {
+			if receiver.Matches(pattern) {
+				// Only keep first match
+				select {
+				case match <- receiver:
+				default:
+				}
+				// Stop browsing
+				cancel()
+			}
+		})
+	}()
+	// Wait for browsing to stop
+	<-done
+	select {
+	case receiver := <-match:
+		return receiver, nil
+	default:
+		return Receiver{}, errors.New("timed out waiting for receiver " + pattern)
+	}
+}
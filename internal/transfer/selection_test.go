@@ -0,0 +1,106 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReceiverMatches(t *testing.T) {
+	receiver := Receiver{Name: "Laptop", HostName: "laptop-1.local.", Fingerprint: "0123456789abcdef0123456789abcdef"}
+	tests := []struct {
+		pattern string
+		match   bool
+	}{
+		{"laptop", true},
+		{" LAPTOP ", true},
+		{"laptop-1", true},
+		{"laptop-1.local.", false},
+		{"lap", false},
+		{"lap*", true},
+		{"l?ptop", true},
+		{"desk*", false},
+		{"[", false},
+		{"01234567", true},
+		{"0123456789ABCDEF", true},
+		{"01:23:45:67:89", true},
+		{"0123456", false},
+		{"12345678", false},
+	}
+	for _, test := range tests {
+		if match := receiver.Matches(test.pattern); match != test.match {
+			t.Errorf("Matches(%q) = %v, want %v", test.pattern, match, test.match)
+		}
+	}
+	// Receivers without fingerprint never match fingerprint prefixes
+	if (Receiver{Name: "laptop"}).Matches("01234567") {
+		t.Error("Matches() of fingerprint prefix succeeded on receiver without fingerprint")
+	}
+}
+
+func TestSelectReceivers(t *testing.T) {
+	receivers := []Receiver{{Name: "laptop-1"}, {Name: "desktop"}, {Name: "laptop-2"}}
+	selected := SelectReceivers(receivers, "laptop-*")
+	if len(selected) != 2 || selected[0].Name != "laptop-1" || selected[1].Name != "laptop-2" {
+		t.Errorf("SelectReceivers() = %+v, want laptop-1 and laptop-2 in order", selected)
+	}
+	if selected := SelectReceivers(receivers, "phone"); len(selected) != 0 {
+		t.Errorf("SelectReceivers() = %+v, want none", selected)
+	}
+}
+
+// Discoverer finding receivers one after the other, then nothing until ctx is done
+type fakeDiscoverer []Receiver
+
+func (discoverer fakeDiscoverer) Browse(ctx context.Context, found func(Receiver)) {
+	for _, receiver := range discoverer {
+		if ctx.Err() != nil {
+			return
+		}
+		found(receiver)
+	}
+	<-ctx.Done()
+}
+
+func TestWaitForReceiver(t *testing.T) {
+	discoverer := fakeDiscoverer{{Name: "desktop"}, {Name: "laptop", Port: 1}, {Name: "laptop", Port: 2}}
+	start := time.Now()
+	receiver, err := WaitForReceiver(discoverer, "laptop", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// First match is returned as soon as it is found
+	if receiver.Port != 1 {
+		t.Errorf("WaitForReceiver() = %+v, want first matching receiver", receiver)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("WaitForReceiver() took %v, want it to return once a receiver matches", elapsed)
+	}
+}
+
+func TestWaitForReceiverTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := WaitForReceiver(fakeDiscoverer{{Name: "desktop"}}, "laptop", 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("WaitForReceiver() succeeded, want timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("WaitForReceiver() returned after %v, before the timeout", elapsed)
+	}
+}
@@ -17,6 +17,11 @@
 package transfer
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -25,162 +30,603 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
-// Save encrypted key to file
-func SaveEncryptedKey(encryptedKey []byte, filePath string) {
-	// Use ConsoleWriter logger
-	// Create file at given file path
-	keyFile, err := os.Create(filePath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating file")
-	}
-	// Close file at the end of this function
-	defer keyFile.Close()
-	// Write encrypted key to file
-	bytesWritten, err := keyFile.Write(encryptedKey)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error writing key to file")
-	}
-	// Log bytes written
-	log.Info().Str("file", filepath.Base(filePath)).Msg("Wrote " + strconv.Itoa(bytesWritten) + " bytes")
-}
-
-// Create HTTP server to transmit files
-func SendFiles(dir string) {
+// Create HTTPS server on transport to transmit the blobs in dir
+//
+// index is manifest encrypted for the receiver, and codec is used to
+// encode deltas of its files. tlsConfig must require and verify client
+// certificates so that only the receiver of this session can access the
+// server. Blobs and deltas are sent at the rate allowed by limiter.
+// Reports sent by the receiver are passed to report, and the data it
+// returns is sent back to the receiver.
+func SendFiles(transport Transport, dir string, manifest *Manifest, index []byte, codec ChunkCodec, tlsConfig *tls.Config, limiter *Limiter, report func([]byte) []byte) {
 	// Use ConsoleWriter logger with normal FatalHook
-	// Create TCP listener on port 9898
-	listener, err := net.Listen("tcp", ":9898")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error starting listener")
-	}
+	// Create new mux for this server
+	mux := http.NewServeMux()
 
-	http.HandleFunc("/key", func(res http.ResponseWriter, req *http.Request) {
-		// Inform user client has requested key
-		log.Info().Msg("Key requested")
-		// Read saved key
-		key, err := ioutil.ReadFile(dir + "/key.aes")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error reading key")
-		}
-		// Write saved key to ResponseWriter
-		_, err = res.Write(key)
+	mux.HandleFunc("/index", func(res http.ResponseWriter, req *http.Request) {
+		// Inform user a client has requested the file index
+		log.Info().Msg("Index requested")
+		// Write encrypted manifest to ResponseWriter
+		_, err := res.Write(index)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error writing response")
 		}
 	})
 
-	http.HandleFunc("/index", func(res http.ResponseWriter, req *http.Request) {
-		// Inform user a client has requested the file index
-		log.Info().Msg("Index requested")
-		// Get directory listing
-		dirListing, err := ioutil.ReadDir(dir)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error reading directory")
-		}
-		// Create new slice to house filenames for index
-		var indexSlice []string
-		// For each file in listing
-		for _, file := range dirListing {
-			// If the file is not the key
-			if !strings.Contains(file.Name(), "key.aes") {
-				// Append the file path to indexSlice
-				indexSlice = append(indexSlice, file.Name())
+	mux.HandleFunc("/blob/", func(res http.ResponseWriter, req *http.Request) {
+		// Get blob ID from path
+		id := strings.TrimPrefix(req.URL.Path, "/blob/")
+		// Make sure ID is valid, to avoid serving anything but blobs
+		if !isBlobID(id) {
+			http.NotFound(res, req)
+			return
+		}
+		log.Info().Str("blob", id).Msg("Blob requested")
+		// Serve blob, limiting rate of response body
+		http.ServeFile(limiter.ResponseWriter(res), req, filepath.Join(dir, id))
+	})
+
+	mux.HandleFunc("/delta/", func(res http.ResponseWriter, req *http.Request) {
+		// Get entry of file whose delta is requested, files which are only
+		// listed are not kept under their ID
+		entry, ok := manifest.Entry(strings.TrimPrefix(req.URL.Path, "/delta/"))
+		if !ok || len(entry.Chunks) == 0 || req.Method != http.MethodPost {
+			http.NotFound(res, req)
+			return
+		}
+		// Decode signature of receiver's existing file
+		signature := &Signature{}
+		err := msgpack.NewDecoder(req.Body).Decode(signature)
+		if err != nil || !signature.valid() {
+			http.Error(res, "invalid signature", http.StatusBadRequest)
+			return
+		}
+		log.Info().Str("file", entry.Name).Msg("Delta requested")
+		// Create writer limiting rate of response
+		writer := limiter.Writer(res)
+		// Create delta from receiver's file to the one kept under the entry's ID,
+		// writing each frame encoded using the file's codec as it is created
+		CreateDelta(signature, filepath.Join(dir, entry.ID), func(delta *Delta) {
+			frame, err := msgpack.Marshal(delta)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error encoding delta")
 			}
+			err = writeFrame(writer, codec.Encode(frame, entry.Codec))
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error writing response")
+			}
+		})
+	})
+
+	mux.HandleFunc("/report", func(res http.ResponseWriter, req *http.Request) {
+		// Read report from request body
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil || req.Method != http.MethodPost {
+			http.Error(res, "invalid report", http.StatusBadRequest)
+			return
 		}
-		// Join index slice into string
-		indexStr := strings.Join(indexSlice, "|")
-		// Write index to ResponseWriter
-		_, err = res.Write([]byte(indexStr))
+		// Pass report to caller and send back its reply
+		_, err = res.Write(report(data))
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error writing response")
 		}
 	})
 
-	http.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		log.Info().Str("file", filepath.Base(req.URL.Path)).Msg("File requested")
-		http.FileServer(http.Dir(dir)).ServeHTTP(res, req)
-	})
-
-	http.HandleFunc("/stop", func(res http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/stop", func(res http.ResponseWriter, req *http.Request) {
 		log.Info().Msg("Stop signal received")
 		res.WriteHeader(http.StatusOK)
-		listener.Close()
+		transport.Close()
 	})
 
-	http.Serve(listener, nil)
+	// Serve until the receiver sends the stop signal
+	err := transport.Serve(mux, tlsConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error serving files")
+	}
 }
 
 type Sender struct {
 	RemoteAddr string
+	client     *http.Client
 }
 
 func (c *Sender) Get(endpoint string) (io.ReadCloser, int, error) {
-	res, err := http.Get(c.RemoteAddr + endpoint)
+	res, err := c.client.Get(c.RemoteAddr + endpoint)
 	if err != nil {
 		return nil, 0, err
 	}
 	return res.Body, res.StatusCode, nil
 }
 
-func NewSender(senderAddr string) *Sender {
-	// Get server address by getting the IP without the port, and appending :9898
-	host, _, _ := net.SplitHostPort(senderAddr)
-	serverAddr := "http://" + net.JoinHostPort(host, "9898")
-	return &Sender{RemoteAddr: serverAddr}
+func (c *Sender) Post(endpoint string, contentType string, body io.Reader) (io.ReadCloser, int, error) {
+	res, err := c.client.Post(c.RemoteAddr+endpoint, contentType, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Body, res.StatusCode, nil
 }
 
-// Get files from sender
-func RecvFiles(sender *Sender, workDir string) {
-	// Use ConsoleWriter logger
+// Create new sender from address of its transfer server
+//
+// tlsConfig must verify that the server is part of this session.
+func NewSender(senderAddr string, tlsConfig *tls.Config) *Sender {
+	// Get server address by splitting the IP and port, and creating a URL from them
+	host, port, _ := net.SplitHostPort(senderAddr)
+	portNum, _ := strconv.Atoi(port)
+	serverAddr := "https://" + URLHost(host, portNum)
+	// Create HTTP client using TLS config, keeping a connection open for every stream
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, MaxIdleConnsPerHost: maxStreams}}
+	return &Sender{RemoteAddr: serverAddr, client: client}
+}
+
+// Get encrypted manifest from sender
+func GetIndex(sender *Sender) ([]byte, error) {
 	indexReader, code, err := sender.Get("/index")
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error getting index")
+		return nil, fmt.Errorf("getting index: %w", err)
 	}
-	// If non-ok code returned, fatally log
+	// Close response body at the end of this function
+	defer indexReader.Close()
+	// If non-ok code returned, return error
 	if code != http.StatusOK {
-		log.Fatal().Err(err).Msg("Sender reported error")
+		return nil, fmt.Errorf("sender reported error getting index: %s", http.StatusText(code))
 	}
 	indexBytes, err := ioutil.ReadAll(indexReader)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading index from response")
+		return nil, fmt.Errorf("reading index: %w", err)
 	}
-	// Get index from message
-	index := strings.Split(strings.TrimSpace(string(indexBytes)), "|")
-	for _, file := range index {
-		// Read received message
-		fileData, code, err := sender.Get("/" + file)
+	return indexBytes, nil
+}
+
+// Blob to be received, and the places its chunk is written to
+type chunkJob struct {
+	codec   string
+	chunk   Chunk
+	targets []chunkTarget
+	// If set, the whole file at path is created from a delta against this
+	// existing file
+	path  string
+	name  string
+	entry *ManifestEntry
+	basis string
+}
+
+// Place a received chunk is written to
+//
+// Files are only opened while a chunk is written, so that transfers of
+// many files do not run out of file descriptors.
+type chunkTarget struct {
+	path   string
+	name   string
+	offset int64
+	// Size of the whole file, for progress reports
+	fileSize int64
+}
+
+// Progress of a received file
+type FileProgress struct {
+	// Original slash-separated path of the file
+	Name string
+	// Size of the file
+	Size int64
+	// Number of bytes of the file written so far
+	Done int64
+	// Whether the hash of the whole file was checked against the manifest
+	Verified bool
+	// Hex encoded SHA-256 hash of the file, once verified
+	Hash string
+}
+
+// Summary of received files
+type RecvSummary struct {
+	// Number of received files
+	Files int
+	// Total size of received files
+	Size int64
+	// Number of bytes received from the sender
+	Received int64
+	// Number of bytes not received thanks to deduplication
+	Deduplicated int64
+}
+
+// Get files in manifest from sender, saving them under their original names
+//
+// Chunks are received over streams parallel connections, decoded using
+// codec and written in place. Chunks referenced by several files or
+// offsets are only received once. If streams is 0, the number of streams
+// is tuned automatically based on throughput. The combined rate of all
+// streams is limited by limiter.
+//
+// If basis is not nil, it is called with every entry to get the path of
+// an existing version of the file. If that file exists, only a delta
+// against it is received instead of the chunks of the file.
+//
+// Once received, every file is checked against the hash in the manifest.
+// If progress is not nil, it is called whenever data is written to a
+// file, and once more when the file is verified. If any chunk cannot be
+// received or verified, the remaining chunks are skipped and the first
+// error is returned.
+func RecvFiles(sender *Sender, manifest *Manifest, workDir string, streams int, codec ChunkCodec, limiter *Limiter, basis func(ManifestEntry) string, progress func(FileProgress)) (RecvSummary, error) {
+	// Create files and collect jobs receiving their chunks
+	var chunkJobs []chunkJob
+	// Create index of jobs by blob ID
+	jobIndex := map[string]int{}
+	// Create counters for session summary
+	var totalSize, deduplicated int64
+	for index := range manifest.Files {
+		entry := &manifest.Files[index]
+		// Get path of file in work directory
+		filePath := filepath.Join(workDir, filepath.FromSlash(entry.Name))
+		// Create parent directories of file
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error getting file")
-		}
-		// If non-ok code returned
-		if code != http.StatusOK {
-			// fatally log
-			log.Fatal().
-				Int("status", code).
-				Str("statusText", http.StatusText(code)).
-				Err(err).
-				Msg("Sender reported error")
-			// Otherwise
-		} else {
-			// Create new file at index filepath
-			newFile, err := os.Create(workDir + "/" + file)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Error creating file")
+			return RecvSummary{}, fmt.Errorf("creating directory: %w", err)
+		}
+		// Create new file with original name
+		newFile, err := os.Create(filePath)
+		if err != nil {
+			return RecvSummary{}, fmt.Errorf("creating file: %w", err)
+		}
+		// Allocate file so chunks can be written in place
+		err = newFile.Truncate(entry.Size)
+		newFile.Close()
+		if err != nil {
+			return RecvSummary{}, fmt.Errorf("allocating file: %w", err)
+		}
+		totalSize += entry.Size
+		// If an existing version of the file is available, receive a delta against it
+		if basisPath := existingFile(basis, *entry); basisPath != "" {
+			chunkJobs = append(chunkJobs, chunkJob{path: filePath, name: entry.Name, codec: entry.Codec, entry: entry, basis: basisPath})
+			continue
+		}
+		// Make sure file can be received
+		if len(entry.Chunks) == 0 {
+			return RecvSummary{}, fmt.Errorf("file %q was only listed by sender", entry.Name)
+		}
+		for _, chunk := range entry.Chunks {
+			target := chunkTarget{path: filePath, name: entry.Name, offset: chunk.Offset, fileSize: entry.Size}
+			// If blob is already received for another chunk, also write it here
+			if existing, ok := jobIndex[chunk.ID]; ok {
+				job := &chunkJobs[existing]
+				// Make sure both chunks have the same content
+				if job.codec != entry.Codec || job.chunk.Size != chunk.Size || job.chunk.Hash != chunk.Hash || job.chunk.BlobSize != chunk.BlobSize {
+					return RecvSummary{}, fmt.Errorf("inconsistent chunk in manifest entry %q", entry.Name)
+				}
+				job.targets = append(job.targets, target)
+				deduplicated += chunk.Size
+				continue
 			}
-			// Copy response body to new file
-			bytesWritten, err := io.Copy(newFile, fileData)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Error writing to file")
+			jobIndex[chunk.ID] = len(chunkJobs)
+			chunkJobs = append(chunkJobs, chunkJob{codec: entry.Codec, chunk: chunk, targets: []chunkTarget{target}})
+		}
+	}
+	// Create channel of chunks to receive
+	jobs := make(chan chunkJob)
+	// Create counter of received bytes used for tuning
+	var received int64
+	// Create counters of bytes written to each file, reported in order
+	written := map[string]int64{}
+	var progressMtx sync.Mutex
+	reportWritten := func(name string, size int64, n int64) {
+		if progress == nil {
+			return
+		}
+		progressMtx.Lock()
+		defer progressMtx.Unlock()
+		written[name] += n
+		progress(FileProgress{Name: name, Size: size, Done: written[name]})
+	}
+	// Keep first error of the workers, after which remaining jobs are skipped
+	var errMtx sync.Mutex
+	var recvErr error
+	setErr := func(err error) {
+		errMtx.Lock()
+		defer errMtx.Unlock()
+		if recvErr == nil {
+			recvErr = err
+		}
+	}
+	failed := func() bool {
+		errMtx.Lock()
+		defer errMtx.Unlock()
+		return recvErr != nil
+	}
+	wg := sync.WaitGroup{}
+	// Start worker receiving chunks from jobs
+	startWorker := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if failed() {
+					continue
+				}
+				if job.basis != "" {
+					n, err := recvDelta(sender, job, codec, limiter)
+					if err != nil {
+						setErr(err)
+						continue
+					}
+					atomic.AddInt64(&received, n)
+					reportWritten(job.name, job.entry.Size, job.entry.Size)
+					continue
+				}
+				if err := recvChunk(sender, job, codec, limiter); err != nil {
+					setErr(err)
+					continue
+				}
+				atomic.AddInt64(&received, job.chunk.BlobSize)
+				for _, target := range job.targets {
+					reportWritten(target.name, target.fileSize, job.chunk.Size)
+				}
 			}
-			// Log bytes written
-			log.Info().Str("file", filepath.Base(file)).Msg("Wrote " + strconv.Itoa(int(bytesWritten)) + " bytes")
-			// Close new file
-			newFile.Close()
+		}()
+	}
+	// Create channel to stop tuning once all chunks are handed out
+	stopTuning := make(chan struct{})
+	tuningDone := make(chan struct{})
+	if streams > 0 {
+		// Start fixed number of workers
+		for i := 0; i < streams; i++ {
+			startWorker()
+		}
+		close(tuningDone)
+	} else {
+		// Tune number of workers in the background
+		go func() {
+			defer close(tuningDone)
+			tuneStreams(startWorker, &received, stopTuning)
+		}()
+	}
+	// Send chunks to the workers
+	for _, job := range chunkJobs {
+		jobs <- job
+	}
+	close(jobs)
+	// Wait for tuning to stop so that no more workers are started
+	close(stopTuning)
+	<-tuningDone
+	// Wait for all chunks to be received
+	wg.Wait()
+	if recvErr != nil {
+		return RecvSummary{}, recvErr
+	}
+	for _, entry := range manifest.Files {
+		filePath := filepath.Join(workDir, filepath.FromSlash(entry.Name))
+		// Set permissions of file as on the sender
+		err := os.Chmod(filePath, os.FileMode(entry.Mode)&os.ModePerm)
+		if err != nil {
+			return RecvSummary{}, fmt.Errorf("setting file permissions: %w", err)
 		}
+		// Make sure the whole file matches the manifest
+		if HashFile(filePath) != entry.Hash {
+			return RecvSummary{}, fmt.Errorf("hash mismatch of file %q", entry.Name)
+		}
+		// Set modification time of file as on the sender
+		modTime := time.Unix(0, entry.ModTime)
+		err = os.Chtimes(filePath, modTime, modTime)
+		if err != nil {
+			return RecvSummary{}, fmt.Errorf("setting file modification time: %w", err)
+		}
+		// Log bytes written
+		log.Info().Str("file", entry.Name).Msg("Wrote " + strconv.Itoa(int(entry.Size)) + " bytes")
+		if progress != nil {
+			progress(FileProgress{Name: entry.Name, Size: entry.Size, Done: entry.Size, Verified: true, Hash: entry.Hash})
+		}
+	}
+	return RecvSummary{
+		Files:        len(manifest.Files),
+		Size:         totalSize,
+		Received:     atomic.LoadInt64(&received),
+		Deduplicated: deduplicated,
+	}, nil
+}
+
+// Get path of existing regular file returned by basis for entry, or an empty string
+func existingFile(basis func(ManifestEntry) string, entry ManifestEntry) string {
+	// If delta transfers are disabled or the file is empty, there is nothing to reuse
+	if basis == nil || entry.Size == 0 {
+		return ""
+	}
+	basisPath := basis(entry)
+	if basisPath == "" {
+		return ""
+	}
+	info, err := os.Stat(basisPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return basisPath
+}
+
+// Receive delta of a file against an existing version, then apply and verify it
+//
+// Returns the number of bytes received.
+func recvDelta(sender *Sender, job chunkJob, codec ChunkCodec, limiter *Limiter) (int64, error) {
+	// Create signature of existing file
+	signature, err := CreateSignature(job.basis)
+	if err != nil {
+		return 0, fmt.Errorf("creating signature: %w", err)
+	}
+	signatureData, err := msgpack.Marshal(signature)
+	if err != nil {
+		return 0, fmt.Errorf("encoding signature: %w", err)
+	}
+	// Send signature and read delta
+	deltaData, code, err := sender.Post("/delta/"+job.entry.ID, "application/msgpack", bytes.NewReader(signatureData))
+	if err != nil {
+		return 0, fmt.Errorf("getting delta: %w", err)
+	}
+	// Close response body at the end of this function
+	defer deltaData.Close()
+	// If non-ok code returned, return error
+	if code != http.StatusOK {
+		return 0, fmt.Errorf("sender reported error getting delta of %q: %s", job.name, http.StatusText(code))
+	}
+	// Create reader limiting rate of delta
+	reader := limiter.Reader(deltaData)
+	var received int64
+	// Read and decode next frame of delta, returning nil at the end
+	next := func() (*Delta, error) {
+		encoded, err := readFrame(reader)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading delta: %w", err)
+		}
+		received += int64(len(encoded)) + 4
+		// Decode frame using codec of file
+		frame, err := codec.Decode(encoded, job.codec)
+		if err != nil {
+			return nil, err
+		}
+		delta := &Delta{}
+		err = msgpack.Unmarshal(frame, delta)
+		if err != nil {
+			return nil, fmt.Errorf("decoding delta: %w", err)
+		}
+		return delta, nil
+	}
+	// Open file created for the result
+	file, err := os.OpenFile(job.path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	// Apply delta to existing file as it is received, hashing the result
+	hash := sha256.New()
+	literalBytes, err := ApplyDelta(job.basis, signature, next, io.MultiWriter(file, hash))
+	if err != nil {
+		return 0, fmt.Errorf("applying delta of %q: %w", job.name, err)
+	}
+	// Make sure file was rebuilt correctly
+	if hex.EncodeToString(hash.Sum(nil)) != job.entry.Hash {
+		return 0, fmt.Errorf("hash mismatch of %q after applying delta", job.name)
+	}
+	log.Info().Str("file", job.name).Int64("literal", literalBytes).Int64("size", job.entry.Size).Msg("Applied delta")
+	return received, nil
+}
+
+// Receive, verify and write a single chunk
+func recvChunk(sender *Sender, job chunkJob, codec ChunkCodec, limiter *Limiter) error {
+	// Read received message
+	blobData, code, err := sender.Get("/blob/" + job.chunk.ID)
+	if err != nil {
+		return fmt.Errorf("getting chunk: %w", err)
+	}
+	// Close response body at the end of this function, discarding padding
+	defer blobData.Close()
+	// If non-ok code returned, return error
+	if code != http.StatusOK {
+		return fmt.Errorf("sender reported error getting chunk of %q: %s", job.targets[0].name, http.StatusText(code))
+	}
+	// Read blob without padding at the allowed rate
+	blob := make([]byte, job.chunk.BlobSize)
+	_, err = io.ReadFull(limiter.Reader(blobData), blob)
+	if err != nil {
+		return fmt.Errorf("reading chunk: %w", err)
+	}
+	// Decode blob using codec of file
+	data, err := codec.Decode(blob, job.codec)
+	if err != nil {
+		return err
+	}
+	// Make sure chunk was not modified
+	hash := sha256.Sum256(data)
+	if int64(len(data)) != job.chunk.Size || hex.EncodeToString(hash[:]) != job.chunk.Hash {
+		return fmt.Errorf("hash mismatch of chunk of %q at offset %d", job.targets[0].name, job.chunk.Offset)
+	}
+	// Write chunk in place wherever it appears
+	for _, target := range job.targets {
+		err = writeChunk(target, data)
+		if err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Write data of chunk at its offset in the file of target
+func writeChunk(target chunkTarget, data []byte) error {
+	file, err := os.OpenFile(target.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, target.offset)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Maximum number of streams used when tuning automatically
+const maxStreams = 16
+
+// Interval between throughput measurements when tuning
+const tuneInterval = 500 * time.Millisecond
+
+// Start streams, doubling their number as long as it improves throughput
+//
+// received must count the bytes received by all streams. Tuning stops
+// at maxStreams, when throughput stops improving or when stop is closed.
+func tuneStreams(startWorker func(), received *int64, stop <-chan struct{}) {
+	// Start with two streams
+	streams := 2
+	for i := 0; i < streams; i++ {
+		startWorker()
+	}
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	var lastReceived, lastRate int64
+	for streams < maxStreams {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// Get bytes received since last measurement
+		total := atomic.LoadInt64(received)
+		rate := total - lastReceived
+		lastReceived = total
+		// If throughput improved by less than 10%, keep current number of streams
+		if lastRate > 0 && rate*10 < lastRate*11 {
+			break
+		}
+		lastRate = rate
+		// Double number of streams
+		for i := 0; i < streams; i++ {
+			startWorker()
+		}
+		streams *= 2
+	}
+	log.Info().Int("streams", streams).Msg("Tuned number of streams")
+}
+
+// Send report to sender, returning its reply
+func SendReport(sender *Sender, report []byte) ([]byte, error) {
+	res, code, err := sender.Post("/report", "application/msgpack", bytes.NewReader(report))
+	if err != nil {
+		return nil, fmt.Errorf("sending report: %w", err)
+	}
+	// Close response body at the end of this function
+	defer res.Close()
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("sender reported error receiving report: %s", http.StatusText(code))
+	}
+	reply, err := ioutil.ReadAll(res)
+	if err != nil {
+		return nil, fmt.Errorf("reading reply to report: %w", err)
 	}
+	return reply, nil
 }
 
 // Send stop signal to sender
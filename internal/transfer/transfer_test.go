@@ -0,0 +1,182 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Codec leaving chunks unchanged, as the real codecs live in the crypto package
+type identityCodec struct{}
+
+func (identityCodec) Choose(sample []byte) string                      { return "none" }
+func (identityCodec) Encode(data []byte, codec string) []byte          { return data }
+func (identityCodec) Decode(data []byte, codec string) ([]byte, error) { return data, nil }
+
+// Write files to a new directory, encode them and serve them over a local
+// TCP transport, returning the sender and the manifest of the files
+func serveTestFiles(t *testing.T, files map[string][]byte) (*Sender, *Manifest) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, _ := CreateManifest(dir, MinChunkSize, false, identityCodec{}, nil)
+	serverTLS, clientTLS := testTLSConfigs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewTCPTransport(listener)
+	limiter := NewLimiter(0, nil)
+	go SendFiles(transport, dir, manifest, nil, identityCodec{}, serverTLS, limiter, func(data []byte) []byte { return nil })
+	t.Cleanup(func() { transport.Close() })
+	return NewSender(transport.Addr().String(), clientTLS), manifest
+}
+
+// Make sure every file was received into dir with its original content
+func checkReceived(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("content of %s differs from sent file", name)
+		}
+	}
+}
+
+func TestRecvFilesManyFiles(t *testing.T) {
+	files := map[string][]byte{}
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("dir%d/file%d.txt", i%10, i)] = randomData(int64(i), 1000+i*37)
+	}
+	sender, manifest := serveTestFiles(t, files)
+	// Allow fewer open files than are received, so that opening them all
+	// at once fails
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	lowered := limit
+	lowered.Cur = 100
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	workDir := t.TempDir()
+	summary, err := RecvFiles(sender, manifest, workDir, 4, identityCodec{}, NewLimiter(0, nil), nil, nil)
+	if err != nil {
+		t.Fatalf("RecvFiles() = %v", err)
+	}
+	if summary.Files != len(files) {
+		t.Errorf("RecvFiles() received %d files, want %d", summary.Files, len(files))
+	}
+	checkReceived(t, workDir, files)
+}
+
+func TestRecvFilesDeduplicates(t *testing.T) {
+	shared := randomData(20, 100<<10)
+	files := map[string][]byte{
+		"a.bin":     shared,
+		"dir/b.bin": shared,
+		"c.bin":     append(append([]byte{}, shared...), randomData(21, 50<<10)...),
+		"empty":     nil,
+	}
+	sender, manifest := serveTestFiles(t, files)
+	// Identical files reference the same blobs
+	entries := map[string]ManifestEntry{}
+	blobs := map[string]int64{}
+	for _, entry := range manifest.Files {
+		entries[entry.Name] = entry
+		for _, chunk := range entry.Chunks {
+			blobs[chunk.ID] = chunk.BlobSize
+		}
+	}
+	a, b := entries["a.bin"].Chunks, entries["dir/b.bin"].Chunks
+	if len(a) != len(b) {
+		t.Fatalf("identical files have %d and %d chunks", len(a), len(b))
+	}
+	for index := range a {
+		if a[index].ID != b[index].ID {
+			t.Errorf("chunk %d of identical files has different blobs", index)
+		}
+	}
+	// Every blob is only received once and written to every file containing it
+	var unique int64
+	for _, size := range blobs {
+		unique += size
+	}
+	workDir := t.TempDir()
+	summary, err := RecvFiles(sender, manifest, workDir, 2, identityCodec{}, NewLimiter(0, nil), nil, nil)
+	if err != nil {
+		t.Fatalf("RecvFiles() = %v", err)
+	}
+	if summary.Received != unique {
+		t.Errorf("received %d bytes, want %d bytes of unique blobs", summary.Received, unique)
+	}
+	if summary.Deduplicated < int64(len(shared)) {
+		t.Errorf("deduplicated %d bytes, want at least %d", summary.Deduplicated, len(shared))
+	}
+	checkReceived(t, workDir, files)
+}
+
+// Codec failing to decode every chunk, as if it was sealed with another key
+type failingCodec struct{ identityCodec }
+
+func (failingCodec) Decode(data []byte, codec string) ([]byte, error) {
+	return nil, errors.New("chunk sealed with another key")
+}
+
+func TestRecvFilesReportsErrors(t *testing.T) {
+	files := map[string][]byte{"a.bin": randomData(22, 50<<10), "b.bin": randomData(23, 50<<10)}
+	tests := []struct {
+		name   string
+		codec  ChunkCodec
+		modify func(manifest *Manifest)
+	}{
+		{"undecodable chunk", failingCodec{}, func(manifest *Manifest) {}},
+		{"modified chunk", identityCodec{}, func(manifest *Manifest) { manifest.Files[1].Chunks[0].Hash = manifest.Files[0].Hash }},
+		{"modified file", identityCodec{}, func(manifest *Manifest) { manifest.Files[0].Hash = manifest.Files[1].Hash }},
+		{"missing blob", identityCodec{}, func(manifest *Manifest) { manifest.Files[0].Chunks[0].ID = randomID() }},
+		{"listed file", identityCodec{}, func(manifest *Manifest) { manifest.Files[0].Chunks = nil }},
+	}
+	for _, test := range tests {
+		sender, manifest := serveTestFiles(t, files)
+		test.modify(manifest)
+		_, err := RecvFiles(sender, manifest, t.TempDir(), 2, test.codec, NewLimiter(0, nil), nil, nil)
+		if err == nil {
+			t.Errorf("%s: RecvFiles() succeeded", test.name)
+		}
+	}
+}
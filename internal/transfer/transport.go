@@ -0,0 +1,302 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+// Names of transports, as announced by the sender during key exchange
+const (
+	TransportTCP  = "tcp"
+	TransportQUIC = "quic"
+)
+
+// Maximum time to wait for pending requests when a QUIC transport is closed
+const quicShutdownTimeout = 5 * time.Second
+
+// Maximum time to wait for the sender to start serving over QUIC, as it
+// only does so once its files are encoded
+var quicReadyTimeout = 5 * time.Minute
+
+const (
+	// Interval at which the receiver checks whether its route to the sender changed
+	migrationInterval = 2 * time.Second
+	// Maximum time to wait for the sender to validate a new path
+	migrationProbeTimeout = 5 * time.Second
+)
+
+// Transport serving the transfer channel from sender to receivers
+type Transport interface {
+	// Serve handler until Close is called, authenticating connections
+	// using tlsConfig. Returns nil once Close is called, or the error
+	// which stopped serving before.
+	Serve(handler http.Handler, tlsConfig *tls.Config) error
+	// Stop accepting connections
+	Close() error
+	// Get address the transport is listening on
+	Addr() net.Addr
+}
+
+// Transport serving HTTPS over TCP connections accepted by a listener
+type TCPTransport struct {
+	listener net.Listener
+	closed   atomic.Bool
+}
+
+// Create transport serving HTTPS to connections accepted by listener
+func NewTCPTransport(listener net.Listener) *TCPTransport {
+	return &TCPTransport{listener: listener}
+}
+
+func (transport *TCPTransport) Serve(handler http.Handler, tlsConfig *tls.Config) error {
+	err := http.Serve(tls.NewListener(transport.listener, tlsConfig), handler)
+	// Serving always ends with an error, which is expected after Close
+	if transport.closed.Load() {
+		return nil
+	}
+	return err
+}
+
+func (transport *TCPTransport) Close() error {
+	transport.closed.Store(true)
+	return transport.listener.Close()
+}
+
+func (transport *TCPTransport) Addr() net.Addr {
+	return transport.listener.Addr()
+}
+
+// Transport serving HTTP/3 over QUIC
+//
+// Every request is sent on its own QUIC stream, so that packet loss
+// on one stream does not stall the others. QUIC also provides its own
+// congestion control and keeps connections alive when the receiver's
+// address changes, such as after NAT rebinding. Receivers also migrate
+// their connections to a new local address when they switch networks
+// (see watchRoute).
+type QUICTransport struct {
+	conn   net.PacketConn
+	server *http3.Server
+	// Closed when Close is called
+	closing chan struct{}
+	// Closed once pending requests are done after Close
+	done chan struct{}
+}
+
+// Create QUIC transport listening on bind and UDP port
+func NewQUICTransport(bind string, port int) *QUICTransport {
+	// Remove brackets from IPv6 bind address, if any
+	bind = strings.TrimSuffix(strings.TrimPrefix(bind, "["), "]")
+	// Create UDP socket
+	conn, err := net.ListenPacket("udp", JoinHostPort(bind, port))
+	if err != nil {
+		log.Fatal().Err(err).Str("bind", bind).Int("port", port).Msg("Error listening for QUIC")
+	}
+	return &QUICTransport{conn: conn, closing: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (transport *QUICTransport) Serve(handler http.Handler, tlsConfig *tls.Config) error {
+	transport.server = &http3.Server{
+		Handler:    handler,
+		TLSConfig:  http3.ConfigureTLSConfig(tlsConfig),
+		QUICConfig: quicConfig(),
+	}
+	err := transport.server.Serve(transport.conn)
+	select {
+	case <-transport.closing:
+		// Wait for pending requests, such as the one which closed the transport
+		<-transport.done
+		return nil
+	default:
+		// Serving failed before Close was called
+		return err
+	}
+}
+
+// Stop accepting connections, finishing pending requests in the background
+func (transport *QUICTransport) Close() error {
+	close(transport.closing)
+	go func() {
+		defer close(transport.done)
+		ctx, cancel := context.WithTimeout(context.Background(), quicShutdownTimeout)
+		defer cancel()
+		transport.server.Shutdown(ctx)
+		transport.conn.Close()
+	}()
+	return nil
+}
+
+func (transport *QUICTransport) Addr() net.Addr {
+	return transport.conn.LocalAddr()
+}
+
+// Create new sender reached over QUIC at senderAddr
+//
+// tlsConfig must verify that the server is part of this session.
+func NewQUICSender(senderAddr string, tlsConfig *tls.Config) *Sender {
+	// Get server address by splitting the IP and port, and creating a URL from them
+	host, port, _ := net.SplitHostPort(senderAddr)
+	portNum, _ := strconv.Atoi(port)
+	serverAddr := "https://" + URLHost(host, portNum)
+	// Create HTTP/3 client using TLS config
+	client := &http.Client{Transport: &http3.Transport{TLSClientConfig: tlsConfig, QUICConfig: quicConfig(), Dial: dialQUIC}}
+	return &Sender{RemoteAddr: serverAddr, client: client}
+}
+
+// Dial QUIC connection to addr, retrying while the handshake times out
+// for up to quicReadyTimeout
+//
+// The sender only starts serving once its files are encoded, which can
+// take longer than a QUIC handshake. Over TCP, such connections wait in
+// the listen backlog instead. Connections are migrated when the route
+// to the sender changes.
+func dialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	// Give up if the sender does not start serving, e.g. because it died
+	ctx, cancel := context.WithTimeout(ctx, quicReadyTimeout)
+	defer cancel()
+	for {
+		conn, err := quic.DialAddr(ctx, addr, tlsConfig, config)
+		if err == nil {
+			go watchRoute(conn)
+			return conn, nil
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Debug().Err(err).Str("addr", addr).Msg("Sender not ready, retrying")
+	}
+}
+
+// Migrate conn to a new local address whenever the route to the sender
+// changes, such as when a laptop switches from Wi-Fi to Ethernet, until
+// conn is closed
+//
+// If migration fails, for example because the sender cannot be reached
+// from the new address yet, it is retried at the next check.
+func watchRoute(conn *quic.Conn) {
+	current, err := routeAddr(conn.RemoteAddr())
+	if err != nil {
+		return
+	}
+	// Transports created for new paths, which can only be closed along
+	// with conn, as closing a transport closes its connections
+	var transports []*quic.Transport
+	// Active path, if migrated
+	var active *quic.Path
+	ticker := time.NewTicker(migrationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.Context().Done():
+			for _, transport := range transports {
+				transport.Close()
+				transport.Conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+		// Get local address currently used to reach sender, skipping
+		// checks while there is no route
+		local, err := routeAddr(conn.RemoteAddr())
+		if err != nil || local.IP.Equal(current.IP) && local.Zone == current.Zone {
+			continue
+		}
+		log.Info().Str("from", current.String()).Str("to", local.String()).Msg("Route to sender changed, migrating connection")
+		path, transport, err := migrateConn(conn, &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+		if err != nil {
+			log.Warn().Err(err).Msg("Error migrating connection")
+			continue
+		}
+		// Abandon previous path, if it was created here
+		if active != nil {
+			active.Close()
+		}
+		transports = append(transports, transport)
+		active, current = path, local
+	}
+}
+
+// Get local address used to send packets to remote
+//
+// No packets are sent, connecting a UDP socket only selects a route.
+func routeAddr(remote net.Addr) (*net.UDPAddr, error) {
+	probe, err := net.Dial("udp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr), nil
+}
+
+// Move conn to a new UDP socket bound to local, once the sender has
+// validated the new path
+//
+// Returns the new path and its transport, which must be closed along
+// with conn.
+func migrateConn(conn *quic.Conn, local *net.UDPAddr) (*quic.Path, *quic.Transport, error) {
+	udpConn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := &quic.Transport{Conn: udpConn}
+	// Fail if a new path cannot be created
+	fail := func(err error) (*quic.Path, *quic.Transport, error) {
+		transport.Close()
+		udpConn.Close()
+		return nil, nil, err
+	}
+	path, err := conn.AddPath(transport)
+	if err != nil {
+		return fail(err)
+	}
+	// Make sure sender can be reached on the new path before switching
+	ctx, cancel := context.WithTimeout(conn.Context(), migrationProbeTimeout)
+	defer cancel()
+	err = path.Probe(ctx)
+	if err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		path.Close()
+		return fail(err)
+	}
+	return path, transport, nil
+}
+
+// Get QUIC config used by both sides
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		// Keep connection alive while the receiver processes files
+		KeepAlivePeriod: 10 * time.Second,
+		// Allow one stream per parallel download, plus control requests
+		MaxIncomingStreams: maxStreams * 2,
+	}
+}
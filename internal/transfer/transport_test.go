@@ -0,0 +1,173 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Wait for Serve of a transport to return, failing if it takes too long
+func waitServe(t *testing.T, served <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-served:
+		return err
+	case <-time.After(quicShutdownTimeout + 5*time.Second):
+		t.Fatal("Serve did not return")
+		return nil
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewTCPTransport(listener)
+	served := make(chan error, 1)
+	go func() { served <- transport.Serve(helloHandler, serverTLS) }()
+	expectHello(t, NewSender(transport.Addr().String(), clientTLS), "/hello")
+	transport.Close()
+	if err := waitServe(t, served); err != nil {
+		t.Errorf("Serve() after Close = %v, want nil", err)
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	transport := NewQUICTransport("127.0.0.1", 0)
+	served := make(chan error, 1)
+	go func() { served <- transport.Serve(helloHandler, serverTLS) }()
+	sender := NewQUICSender(transport.Addr().String(), clientTLS)
+	// Several requests share the connection, each on its own stream
+	for i := 0; i < 3; i++ {
+		expectHello(t, sender, "/hello")
+	}
+	transport.Close()
+	if err := waitServe(t, served); err != nil {
+		t.Errorf("Serve() after Close = %v, want nil", err)
+	}
+}
+
+func TestQUICTransportServeError(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	transport := NewQUICTransport("127.0.0.1", 0)
+	// Break socket before serving, without calling Close
+	transport.conn.Close()
+	served := make(chan error, 1)
+	go func() { served <- transport.Serve(helloHandler, serverTLS) }()
+	if err := waitServe(t, served); err == nil {
+		t.Error("Serve() on closed socket = nil, want error")
+	}
+}
+
+func TestDialQUICGivesUp(t *testing.T) {
+	_, clientTLS := testTLSConfigs(t)
+	// Socket which never answers, like a dead sender
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	defer func(timeout time.Duration) { quicReadyTimeout = timeout }(quicReadyTimeout)
+	quicReadyTimeout = 500 * time.Millisecond
+	start := time.Now()
+	_, err = dialQUIC(context.Background(), silent.LocalAddr().String(), clientTLS, quicConfig())
+	if err == nil {
+		t.Fatal("dialQUIC() to silent socket succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dialQUIC() gave up after %v, want about %v", elapsed, quicReadyTimeout)
+	}
+}
+
+func TestMigrateConn(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverTLS.NextProtos = []string{"opensend-test"}
+	clientTLS.NextProtos = []string{"opensend-test"}
+	// Start QUIC server echoing every stream and reporting the address
+	// of the client
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverTLS, quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		for {
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, stream)
+				io.WriteString(stream, conn.RemoteAddr().String())
+				stream.Close()
+			}()
+		}
+	}()
+	// Dial from a socket owned by the test, so that it can be closed after migrating
+	oldConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTransport := &quic.Transport{Conn: oldConn}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := oldTransport.Dial(ctx, listener.Addr(), clientTLS, quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	// Get address of the client as seen by the server
+	clientAddr := func() string {
+		t.Helper()
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Close()
+		addr, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(addr)
+	}
+	if addr := clientAddr(); addr != oldConn.LocalAddr().String() {
+		t.Fatalf("server sees client at %s, want %s", addr, oldConn.LocalAddr())
+	}
+	_, newTransport, err := migrateConn(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newTransport.Conn.Close()
+	defer newTransport.Close()
+	// Requests now reach the server from the new socket
+	if addr := clientAddr(); addr != newTransport.Conn.LocalAddr().String() {
+		t.Errorf("server sees client at %s after migration, want %s", addr, newTransport.Conn.LocalAddr())
+	}
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// Duration of a single browse round while watching
+	watchRound = 5 * time.Second
+	// Number of rounds a receiver may go unseen before it is considered gone
+	watchExpiryRounds = 2
+)
+
+// Type of a watch event
+type WatchEventType string
+
+const (
+	// Receiver appeared
+	ReceiverUp WatchEventType = "up"
+	// Details (e.g. addresses) of a known receiver changed
+	ReceiverUpdated WatchEventType = "update"
+	// Receiver disappeared
+	ReceiverDown WatchEventType = "down"
+)
+
+// Event emitted while watching for receivers
+type WatchEvent struct {
+	Type     WatchEventType `json:"event"`
+	Time     time.Time      `json:"time"`
+	Receiver Receiver       `json:"receiver"`
+}
+
+// Continuously browse using discoverer until ctx is done, calling event
+// whenever a receiver appears, changes or disappears
+//
+// Browsing happens in rounds, as zeroconf only reports each service once
+// per browse. A receiver which has not been seen for two rounds is
+// reported as down, and addresses of a receiver which have not been seen
+// for two rounds are removed from it.
+func Watch(ctx context.Context, discoverer Discoverer, event func(WatchEvent)) {
+	// Create set of known receivers, accumulating their details
+	known := newReceiverSet()
+	// Create map of times receivers were last seen
+	lastSeen := map[string]time.Time{}
+	// Create map of times each address of a receiver was last seen
+	addrSeen := map[string]map[string]time.Time{}
+	// Create mutex to protect lastSeen, addrSeen and ordering of events
+	var mtx sync.Mutex
+	for ctx.Err() == nil {
+		// Create context for this round
+		roundCtx, cancel := context.WithTimeout(ctx, watchRound)
+		// Browse for the duration of the round
+		discoverer.Browse(roundCtx, func(receiver Receiver) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			key := receiverKey(receiver)
+			lastSeen[key] = time.Now()
+			if addrSeen[key] == nil {
+				addrSeen[key] = map[string]time.Time{}
+			}
+			for _, addr := range receiver.Addrs {
+				addrSeen[key][addr] = time.Now()
+			}
+			// Get details known before this sighting
+			previous, ok := known.get(key)
+			// Merge new details into known receiver
+			merged := known.merge(receiver)
+			if !ok {
+				event(WatchEvent{Type: ReceiverUp, Time: time.Now(), Receiver: merged})
+			} else if !reflect.DeepEqual(previous, merged) {
+				event(WatchEvent{Type: ReceiverUpdated, Time: time.Now(), Receiver: merged})
+			}
+		})
+		cancel()
+		// Remove receivers which have not been seen recently
+		mtx.Lock()
+		for key, seen := range lastSeen {
+			if time.Since(seen) > watchExpiryRounds*watchRound {
+				receiver, _ := known.get(key)
+				known.remove(key)
+				delete(lastSeen, key)
+				delete(addrSeen, key)
+				event(WatchEvent{Type: ReceiverDown, Time: time.Now(), Receiver: receiver})
+				continue
+			}
+			// Remove addresses which have not been seen recently
+			var stale []string
+			for addr, seen := range addrSeen[key] {
+				if time.Since(seen) > watchExpiryRounds*watchRound {
+					stale = append(stale, addr)
+					delete(addrSeen[key], addr)
+				}
+			}
+			if len(stale) > 0 {
+				receiver := known.removeAddrs(key, stale...)
+				event(WatchEvent{Type: ReceiverUpdated, Time: time.Now(), Receiver: receiver})
+			}
+		}
+		mtx.Unlock()
+	}
+}
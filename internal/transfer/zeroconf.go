@@ -0,0 +1,119 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/rs/zerolog/log"
+)
+
+// Discoverer browsing for _opensend._tcp mDNS services
+type ZeroconfDiscoverer struct{}
+
+// Browse for opensend mDNS services until ctx is done
+func (ZeroconfDiscoverer) Browse(ctx context.Context, found func(Receiver)) {
+	// Use ConsoleWriter logger
+	// Create wait group for all resolvers
+	var wg sync.WaitGroup
+	// For each interface capable of multicast
+	for _, iface := range multicastInterfaces() {
+		// Create zeroconf resolver bound to this interface so that the
+		// zone of link-local IPv6 addresses is known
+		resolver, err := zeroconf.NewResolver(zeroconf.SelectIfaces([]net.Interface{iface}))
+		if err != nil {
+			log.Warn().Err(err).Str("iface", iface.Name).Msg("Error creating zeroconf resolver")
+			continue
+		}
+		// Create channel for zeroconf entries
+		entries := make(chan *zeroconf.ServiceEntry)
+		wg.Add(1)
+		// Concurrently collect entries
+		go func(zone string, results <-chan *zeroconf.ServiceEntry) {
+			defer wg.Done()
+			// For each entry
+			for entry := range results {
+				// Notify caller of receiver described by entry
+				found(Receiver{
+					Name:        entry.Instance,
+					HostName:    entry.HostName,
+					Fingerprint: txtValue(entry.Text, "fp"),
+					Version:     atoi(txtValue(entry.Text, "v")),
+					Port:        entry.Port,
+					Addrs:       entryAddrs(entry, zone),
+				})
+			}
+		}(iface.Name, entries)
+		// Browse for mDNS entries (entries is closed by zeroconf once browsing stops)
+		err = resolver.Browse(ctx, "_opensend._tcp", "local.", entries)
+		if err != nil {
+			log.Warn().Err(err).Str("iface", iface.Name).Msg("Error browsing zeroconf services")
+		}
+	}
+	// Wait for context to be done
+	<-ctx.Done()
+	// Wait for all entries to be collected
+	wg.Wait()
+}
+
+// Get value of key from zeroconf TXT record
+func txtValue(text []string, key string) string {
+	for _, field := range text {
+		if strings.HasPrefix(field, key+"=") {
+			return strings.TrimPrefix(field, key+"=")
+		}
+	}
+	return ""
+}
+
+// Convert string to int, returning 0 if it is invalid
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+// Get string addresses of zeroconf entry, adding zone to link-local IPv6 addresses
+func entryAddrs(entry *zeroconf.ServiceEntry, zone string) []string {
+	var addrs []string
+	for _, ip := range entry.AddrIPv4 {
+		addrs = append(addrs, ip.String())
+	}
+	for _, ip := range entry.AddrIPv6 {
+		addrs = append(addrs, ipString(ip, zone))
+	}
+	return addrs
+}
+
+// Register opensend zeroconf service on the network, advertising the given
+// fingerprint and key exchange port on ifaces (all interfaces if nil)
+func RegisterService(fingerprint string, port int, ifaces []net.Interface) func() {
+	// Get computer hostname
+	hostname, _ := os.Hostname()
+	// Register zeroconf service {hostname}._opensend._tcp.local.
+	server, err := zeroconf.Register(hostname, "_opensend._tcp", "local.", port, []string{"txtv=0", "lo=1", "la=2", "fp=" + fingerprint, "v=" + strconv.Itoa(ProtocolVersion)}, ifaces)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error registering zeroconf service")
+	}
+	// Return server.Shutdown() function to allow for shutdown in main()
+	return server.Shutdown
+}
@@ -0,0 +1,151 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Name of cookie holding the session of a browser
+const sessionCookie = "opensend_session"
+
+// Number of wrong codes after which the code is disabled
+const maxFailures = 10
+
+// Authentication of browsers using a one-time code
+//
+// The code is exchanged for a session cookie the first time it is
+// used, so that a leaked link cannot be used by anyone else later.
+type auth struct {
+	lock     sync.Mutex
+	code     string
+	used     bool
+	failures int
+	sessions map[string]bool
+}
+
+// Create authentication for one-time code
+func newAuth(code string) *auth {
+	return &auth{code: normalizeCode(code), sessions: map[string]bool{}}
+}
+
+// Remove separators and case from code, so that it can be typed loosely
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+// Exchange code for a new session, if it is valid and unused
+func (a *auth) redeem(code string) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// Reject code if it was used already or guessed too often
+	if a.used || a.failures >= maxFailures {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(normalizeCode(code)), []byte(a.code)) != 1 {
+		a.failures++
+		if a.failures == maxFailures {
+			log.Warn().Msg("Too many wrong codes, code disabled")
+		}
+		return "", false
+	}
+	// Create session for browser
+	a.used = true
+	session := randomToken()
+	a.sessions[session] = true
+	return session, true
+}
+
+// Check whether request belongs to a session
+func (a *auth) valid(req *http.Request) bool {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.sessions[cookie.Value]
+}
+
+// Wrap handler so that it is only reachable by browsers which used the code
+//
+// The code is accepted in the code query parameter, so that it can be
+// part of a link, or entered in a login form.
+func (a *auth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		setSecurityHeaders(res)
+		// If browser has a session, pass request on
+		if a.valid(req) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		// Get code from link or login form
+		code := req.URL.Query().Get("code")
+		if req.Method == http.MethodPost && req.URL.Path == "/login" {
+			code = req.PostFormValue("code")
+		}
+		// If no code is given, ask for it
+		if code == "" {
+			renderLogin(res, http.StatusUnauthorized, "")
+			return
+		}
+		// Exchange code for session
+		session, ok := a.redeem(code)
+		if !ok {
+			log.Warn().Str("addr", req.RemoteAddr).Msg("Invalid or used code")
+			renderLogin(res, http.StatusForbidden, "Invalid or already used code")
+			return
+		}
+		log.Info().Str("addr", req.RemoteAddr).Msg("Browser logged in")
+		http.SetCookie(res, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		// Redirect to page without code, so that it does not stay in the history
+		http.Redirect(res, req, "/", http.StatusSeeOther)
+	})
+}
+
+// Set headers keeping pages from leaking the code or loading other content
+func setSecurityHeaders(res http.ResponseWriter) {
+	res.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; script-src 'self'; connect-src 'self'; form-action 'self'")
+	res.Header().Set("Referrer-Policy", "no-referrer")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.Header().Set("X-Frame-Options", "DENY")
+}
+
+// Create random session token
+func randomToken() string {
+	token := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, token)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating session token")
+	}
+	return hex.EncodeToString(token)
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Code used by tests
+const testCode = "2xz3-ukdb-ztzo-7lxa"
+
+// Handler answering every request with "ok"
+var okHandler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+	res.Write([]byte("ok"))
+})
+
+// Send request to handler, adding cookies
+func serve(handler http.Handler, req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+// Log in to handler using code in a link, returning the session cookie
+func login(t *testing.T, handler http.Handler) *http.Cookie {
+	t.Helper()
+	res := serve(handler, httptest.NewRequest(http.MethodGet, "/?code="+testCode, nil))
+	if res.Code != http.StatusSeeOther {
+		t.Fatalf("login returned status %d, want %d", res.Code, http.StatusSeeOther)
+	}
+	for _, cookie := range res.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	t.Fatal("login did not set session cookie")
+	return nil
+}
+
+func TestNormalizeCode(t *testing.T) {
+	for _, code := range []string{"2xz3-ukdb-ztzo-7lxa", "2XZ3 UKDB ZTZO 7LXA", " 2xz3ukdbztzo7lxa\n"} {
+		if got := normalizeCode(code); got != "2xz3ukdbztzo7lxa" {
+			t.Errorf("normalizeCode(%q) = %q, want %q", code, got, "2xz3ukdbztzo7lxa")
+		}
+	}
+}
+
+func TestAuthRedeemOnce(t *testing.T) {
+	a := newAuth(testCode)
+	session, ok := a.redeem("2XZ3 UKDB ZTZO 7LXA")
+	if !ok || session == "" {
+		t.Fatal("redeem() of valid code failed")
+	}
+	if _, ok := a.redeem(testCode); ok {
+		t.Error("redeem() of used code succeeded")
+	}
+}
+
+func TestAuthDisablesGuessedCode(t *testing.T) {
+	a := newAuth(testCode)
+	for i := 0; i < maxFailures; i++ {
+		if _, ok := a.redeem("wrong"); ok {
+			t.Fatal("redeem() of wrong code succeeded")
+		}
+	}
+	if _, ok := a.redeem(testCode); ok {
+		t.Error("redeem() succeeded after too many wrong codes")
+	}
+}
+
+func TestAuthWrap(t *testing.T) {
+	handler := newAuth(testCode).wrap(okHandler)
+	// Browsers without session are asked for the code
+	res := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != http.StatusUnauthorized || strings.Contains(res.Body.String(), "ok") {
+		t.Errorf("request without session returned status %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+	if res.Header().Get("Content-Security-Policy") == "" || res.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Error("security headers not set")
+	}
+	// Wrong codes are refused
+	res = serve(handler, httptest.NewRequest(http.MethodGet, "/?code=wrong", nil))
+	if res.Code != http.StatusForbidden {
+		t.Errorf("request with wrong code returned status %d, want %d", res.Code, http.StatusForbidden)
+	}
+	// The code is exchanged for a session cookie, redirecting to the page without code
+	cookie := login(t, handler)
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie = %+v, want HttpOnly, Secure and SameSite=Strict", cookie)
+	}
+	// The session gives access to the page
+	res = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil), cookie)
+	if res.Code != http.StatusOK || res.Body.String() != "ok" {
+		t.Errorf("request with session returned status %d, body %q", res.Code, res.Body.String())
+	}
+	// The code cannot be used by another browser
+	res = serve(handler, httptest.NewRequest(http.MethodGet, "/?code="+testCode, nil))
+	if res.Code != http.StatusForbidden {
+		t.Errorf("request with used code returned status %d, want %d", res.Code, http.StatusForbidden)
+	}
+	// Unknown sessions are refused
+	res = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil), &http.Cookie{Name: sessionCookie, Value: randomToken()})
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("request with unknown session returned status %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthLoginForm(t *testing.T) {
+	handler := newAuth(testCode).wrap(okHandler)
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"code": {testCode}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := serve(handler, req)
+	if res.Code != http.StatusSeeOther || len(res.Result().Cookies()) == 0 {
+		t.Errorf("login form returned status %d, want %d with session cookie", res.Code, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"archive/zip"
+	"crypto/tls"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Files or link offered to browsers
+type Offer struct {
+	// Name of the offered file, directory or link
+	Name string
+	// Link offered instead of files, if any
+	Link string
+	// Directory containing the offered files
+	Dir string
+	// Files offered for download, kept under their names in Dir
+	Manifest *transfer.Manifest
+}
+
+// Serve page offering files to browsers on listener until killed
+//
+// Browsers must use code once to access the page. Downloads are sent
+// at the rate allowed by limiter.
+func ServeDownloads(listener net.Listener, tlsConfig *tls.Config, code string, offer Offer, limiter *transfer.Limiter) {
+	// Serve page using TLS, only to browsers which used the code
+	err := http.Serve(tls.NewListener(listener, tlsConfig), newAuth(code).wrap(downloadHandler(offer, limiter)))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error serving web page")
+	}
+}
+
+// Create handler of the page offering files and of their downloads
+func downloadHandler(offer Offer, limiter *transfer.Limiter) http.Handler {
+	// Create new mux for this server
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(res, req)
+			return
+		}
+		render(res, downloadTemplate, http.StatusOK, offer)
+	})
+
+	mux.HandleFunc("/file/", func(res http.ResponseWriter, req *http.Request) {
+		// Get entry of requested file
+		entry, ok := offer.Manifest.Entry(strings.TrimPrefix(req.URL.Path, "/file/"))
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		// Open file under its name in dir
+		file, err := os.Open(filepath.Join(offer.Dir, filepath.FromSlash(entry.Name)))
+		if err != nil {
+			log.Warn().Err(err).Str("file", entry.Name).Msg("Error opening file")
+			http.Error(res, "file not available", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		log.Info().Str("file", entry.Name).Str("addr", req.RemoteAddr).Msg("File downloaded")
+		// Save file under its base name
+		name := path.Base(entry.Name)
+		res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		// Serve file, supporting resumed downloads, limiting rate of response body
+		http.ServeContent(limiter.ResponseWriter(res), req, name, time.Unix(0, entry.ModTime), file)
+	})
+
+	mux.HandleFunc("/zip", func(res http.ResponseWriter, req *http.Request) {
+		log.Info().Str("addr", req.RemoteAddr).Msg("ZIP downloaded")
+		res.Header().Set("Content-Type", "application/zip")
+		res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": offer.Name + ".zip"}))
+		// Stream files into ZIP archive, limiting its rate
+		zipWriter := zip.NewWriter(limiter.Writer(res))
+		for _, entry := range offer.Manifest.Files {
+			err := addToZip(zipWriter, offer.Dir, entry)
+			if err != nil {
+				log.Warn().Err(err).Str("file", entry.Name).Msg("Error writing ZIP")
+				return
+			}
+		}
+		err := zipWriter.Close()
+		if err != nil {
+			log.Warn().Err(err).Msg("Error writing ZIP")
+		}
+	})
+	return mux
+}
+
+// Add file of entry in dir to ZIP archive
+func addToZip(zipWriter *zip.Writer, dir string, entry transfer.ManifestEntry) error {
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(entry.Name)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Store files as is, as many are compressed already
+	header := &zip.FileHeader{Name: entry.Name, Method: zip.Store, Modified: time.Unix(0, entry.ModTime)}
+	header.SetMode(os.FileMode(entry.Mode))
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Create handler offering files, behind authentication
+func newDownloadHandler(t *testing.T, files map[string]string) (http.Handler, *transfer.Manifest) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := transfer.ListManifest(dir)
+	offer := Offer{Name: "files", Dir: dir, Manifest: manifest}
+	return newAuth(testCode).wrap(downloadHandler(offer, transfer.NewLimiter(0, nil))), manifest
+}
+
+func TestDownloadRequiresSession(t *testing.T) {
+	handler, manifest := newDownloadHandler(t, map[string]string{"file.txt": "secret"})
+	for _, target := range []string{"/", "/file/" + manifest.Files[0].ID, "/zip"} {
+		res := serve(handler, httptest.NewRequest(http.MethodGet, target, nil))
+		if res.Code != http.StatusUnauthorized || strings.Contains(res.Body.String(), "secret") {
+			t.Errorf("%s without session returned status %d, want %d", target, res.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	handler, manifest := newDownloadHandler(t, map[string]string{"dir/file.txt": "content"})
+	cookie := login(t, handler)
+	// The page lists the offered files
+	res := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil), cookie)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), manifest.Files[0].ID) {
+		t.Errorf("page returned status %d without link to file", res.Code)
+	}
+	// Files are downloaded under their base name
+	res = serve(handler, httptest.NewRequest(http.MethodGet, "/file/"+manifest.Files[0].ID, nil), cookie)
+	if res.Code != http.StatusOK || res.Body.String() != "content" {
+		t.Errorf("download returned status %d, body %q", res.Code, res.Body.String())
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `attachment; filename=file.txt` {
+		t.Errorf("Content-Disposition = %q", disposition)
+	}
+	// Files are only served by ID
+	for _, target := range []string{"/file/dir/file.txt", "/file/" + strings.Repeat("0", 32)} {
+		res = serve(handler, httptest.NewRequest(http.MethodGet, target, nil), cookie)
+		if res.Code != http.StatusNotFound {
+			t.Errorf("%s returned status %d, want %d", target, res.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestDownloadZip(t *testing.T) {
+	files := map[string]string{"a.txt": "first", "dir/b.txt": "second"}
+	handler, _ := newDownloadHandler(t, files)
+	res := serve(handler, httptest.NewRequest(http.MethodGet, "/zip", nil), login(t, handler))
+	if res.Code != http.StatusOK {
+		t.Fatalf("ZIP download returned status %d", res.Code)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.File) != len(files) {
+		t.Errorf("ZIP contains %d files, want %d", len(archive.File), len(files))
+	}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != files[file.Name] {
+			t.Errorf("%s in ZIP = %q, want %q", file.Name, data, files[file.Name])
+		}
+	}
+}
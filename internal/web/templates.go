@@ -0,0 +1,298 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Layout shared by all pages
+const layout = `{{define "layout"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>OpenSend</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.4em 0.2em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.hash { font-family: monospace; font-size: 0.7em; color: #666; word-break: break-all; }
+.error { color: #b00; }
+.size { white-space: nowrap; text-align: right; }
+input, button { font-size: 1em; padding: 0.4em; }
+</style>
+</head>
+<body>
+<h1>OpenSend</h1>
+{{template "content" .}}
+</body>
+</html>{{end}}`
+
+// Page asking for the one-time code
+const loginPage = `{{define "content"}}
+<p>Enter the code shown by opensend.</p>
+{{if .}}<p class="error">{{.}}</p>{{end}}
+<form method="post" action="/login">
+<input name="code" autocomplete="off" autofocus required>
+<button type="submit">Continue</button>
+</form>
+{{end}}`
+
+// Page listing offered files
+const downloadPage = `{{define "content"}}
+<h2>{{.Name}}</h2>
+{{if .Link}}
+<p><a href="{{.Link}}" rel="noreferrer noopener">{{.Link}}</a></p>
+{{else}}
+<table>
+{{range .Manifest.Files}}
+<tr>
+<td><a href="/file/{{.ID}}" download>{{.Name}}</a><div class="hash">SHA-256 {{.Hash}}</div></td>
+<td class="size">{{size .Size}}</td>
+</tr>
+{{end}}
+</table>
+{{if gt (len .Manifest.Files) 1}}<p><a href="/zip" download>Download all as ZIP</a></p>{{end}}
+{{end}}
+{{end}}`
+
+// Page letting browsers upload files
+const uploadPage = `{{define "content"}}
+<h2>Send files to this device</h2>
+<form id="form" method="post" action="/upload" enctype="multipart/form-data">
+<p><input id="files" type="file" name="file" multiple required></p>
+<p id="drop" hidden>Or drop files here</p>
+<button id="submit" type="submit">Upload</button>
+</form>
+<ul id="list">
+{{range .}}<li>{{.Name}}: done ({{size .Size}})</li>{{end}}
+</ul>
+<script src="/upload.js"></script>
+{{end}}`
+
+// Script uploading files one by one with their hash and showing progress
+const uploadScript = `"use strict";
+const form = document.getElementById("form");
+const input = document.getElementById("files");
+const drop = document.getElementById("drop");
+const list = document.getElementById("list");
+// Size of the slices files are hashed in, so that they are never loaded into memory whole
+const hashSliceSize = 4 * 1024 * 1024;
+
+// Round constants of SHA-256
+const roundConstants = new Uint32Array([
+	0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+	0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+	0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+	0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+	0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+	0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+	0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+	0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+]);
+
+// Rotate 32-bit x right by n bits
+function rotr(x, n) {
+	return (x >>> n) | (x << (32 - n));
+}
+
+// Incremental SHA-256 hasher, as Web Crypto can only hash whole buffers
+class SHA256 {
+	constructor() {
+		this.state = new Uint32Array([0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19]);
+		this.block = new Uint8Array(64);
+		this.blockLen = 0;
+		this.length = 0;
+		this.words = new Uint32Array(64);
+	}
+
+	// Add bytes to the hashed data
+	update(data) {
+		this.length += data.length;
+		for (let i = 0; i < data.length;) {
+			const n = Math.min(64 - this.blockLen, data.length - i);
+			this.block.set(data.subarray(i, i + n), this.blockLen);
+			this.blockLen += n;
+			i += n;
+			if (this.blockLen === 64) {
+				this.compress();
+				this.blockLen = 0;
+			}
+		}
+	}
+
+	// Process the full block
+	compress() {
+		const w = this.words;
+		const block = this.block;
+		for (let t = 0; t < 16; t++) {
+			w[t] = (block[4 * t] << 24) | (block[4 * t + 1] << 16) | (block[4 * t + 2] << 8) | block[4 * t + 3];
+		}
+		for (let t = 16; t < 64; t++) {
+			const s0 = rotr(w[t - 15], 7) ^ rotr(w[t - 15], 18) ^ (w[t - 15] >>> 3);
+			const s1 = rotr(w[t - 2], 17) ^ rotr(w[t - 2], 19) ^ (w[t - 2] >>> 10);
+			w[t] = w[t - 16] + s0 + w[t - 7] + s1;
+		}
+		let [a, b, c, d, e, f, g, h] = this.state;
+		for (let t = 0; t < 64; t++) {
+			const t1 = h + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + roundConstants[t] + w[t];
+			const t2 = (rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c));
+			h = g;
+			g = f;
+			f = e;
+			e = (d + t1) >>> 0;
+			d = c;
+			c = b;
+			b = a;
+			a = (t1 + t2) >>> 0;
+		}
+		const state = this.state;
+		state[0] += a;
+		state[1] += b;
+		state[2] += c;
+		state[3] += d;
+		state[4] += e;
+		state[5] += f;
+		state[6] += g;
+		state[7] += h;
+	}
+
+	// Get hex-encoded hash of the data added so far
+	hex() {
+		const bits = this.length * 8;
+		// Pad to a multiple of 64 bytes, ending with the length in bits
+		const padding = new Uint8Array((this.blockLen < 56 ? 64 : 128) - this.blockLen);
+		padding[0] = 0x80;
+		const view = new DataView(padding.buffer);
+		view.setUint32(padding.length - 8, Math.floor(bits / 0x100000000));
+		view.setUint32(padding.length - 4, bits >>> 0);
+		this.update(padding);
+		return Array.from(this.state, (x) => x.toString(16).padStart(8, "0")).join("");
+	}
+}
+
+// Get hex-encoded SHA-256 hash of file, or an empty string if it cannot be computed
+async function sha256(file) {
+	try {
+		const hasher = new SHA256();
+		for (let offset = 0; offset < file.size; offset += hashSliceSize) {
+			hasher.update(new Uint8Array(await file.slice(offset, offset + hashSliceSize).arrayBuffer()));
+		}
+		return hasher.hex();
+	} catch (e) {
+		return "";
+	}
+}
+
+// Upload file, showing its progress in the list
+async function upload(file) {
+	const item = document.createElement("li");
+	item.textContent = file.name + ": hashing";
+	list.appendChild(item);
+	const hash = await sha256(file);
+	const data = new FormData();
+	if (hash) {
+		data.append("sha256", hash);
+	}
+	data.append("file", file);
+	await new Promise((resolve) => {
+		const req = new XMLHttpRequest();
+		req.open("POST", "/upload");
+		req.setRequestHeader("Accept", "application/json");
+		req.upload.onprogress = (e) => {
+			item.textContent = file.name + ": " + Math.floor(e.loaded * 100 / e.total) + "%";
+		};
+		req.onload = () => {
+			item.textContent = file.name + ": " + (req.status === 200 ? "done" : "failed (" + req.responseText.trim() + ")");
+			resolve();
+		};
+		req.onerror = () => {
+			item.textContent = file.name + ": failed";
+			resolve();
+		};
+		req.send(data);
+	});
+}
+
+// Upload files one after another
+async function uploadAll(files) {
+	for (const file of Array.from(files)) {
+		await upload(file);
+	}
+	form.reset();
+}
+
+// Upload files as soon as they are chosen or dropped
+document.getElementById("submit").hidden = true;
+drop.hidden = false;
+input.required = false;
+input.addEventListener("change", () => uploadAll(input.files));
+form.addEventListener("submit", (e) => {
+	e.preventDefault();
+	uploadAll(input.files);
+});
+document.addEventListener("dragover", (e) => e.preventDefault());
+document.addEventListener("drop", (e) => {
+	e.preventDefault();
+	uploadAll(e.dataTransfer.files);
+});
+`
+
+// Functions available in templates
+var templateFuncs = template.FuncMap{"size": formatSize}
+
+// Parsed templates of pages
+var (
+	loginTemplate    = template.Must(template.Must(template.New("login").Parse(layout)).Parse(loginPage))
+	downloadTemplate = template.Must(template.Must(template.New("download").Funcs(templateFuncs).Parse(layout)).Parse(downloadPage))
+	uploadTemplate   = template.Must(template.Must(template.New("upload").Funcs(templateFuncs).Parse(layout)).Parse(uploadPage))
+)
+
+// Render page using template with data
+func render(res http.ResponseWriter, tmpl *template.Template, status int, data interface{}) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	err := tmpl.ExecuteTemplate(res, "layout", data)
+	if err != nil {
+		log.Warn().Err(err).Msg("Error rendering page")
+	}
+}
+
+// Render login page with error message, if any
+func renderLogin(res http.ResponseWriter, status int, message string) {
+	render(res, loginTemplate, status, message)
+}
+
+// Format size in bytes for humans
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,188 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// Errors returned for rejected uploads
+var (
+	errInvalidName  = errors.New("invalid file name")
+	errHashMismatch = errors.New("hash mismatch, file was corrupted during upload")
+)
+
+// File uploaded by a browser
+type Upload struct {
+	// Directory the file was saved in
+	Dir string `json:"-"`
+	// Name of the file in Dir
+	Name string `json:"name"`
+	// Size of the file
+	Size int64 `json:"size"`
+	// Hex-encoded SHA-256 hash of the file
+	Hash string `json:"sha256"`
+	// Address of the browser which uploaded the file
+	Addr string `json:"-"`
+}
+
+// Serve page letting browsers upload files on listener until killed
+//
+// Browsers must use code once to access the page. Uploads are saved in
+// workDir at the rate allowed by limiter and checked against the hash
+// computed by the browser, if any, then passed to deliver, which may
+// change the name the file is saved under. Browsers are told that an
+// upload failed if deliver returns an error.
+func ServeUploads(listener net.Listener, tlsConfig *tls.Config, code string, workDir string, limiter *transfer.Limiter, deliver func(*Upload) error) {
+	// Serve page using TLS, only to browsers which used the code
+	err := http.Serve(tls.NewListener(listener, tlsConfig), newAuth(code).wrap(uploadHandler(workDir, limiter, deliver)))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error serving web page")
+	}
+}
+
+// Create handler of the upload page and of uploads (see ServeUploads)
+func uploadHandler(workDir string, limiter *transfer.Limiter, deliver func(*Upload) error) http.Handler {
+	// Create new mux for this server
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(res, req)
+			return
+		}
+		render(res, uploadTemplate, http.StatusOK, nil)
+	})
+
+	mux.HandleFunc("/upload.js", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		_, _ = io.WriteString(res, uploadScript)
+	})
+
+	mux.HandleFunc("/upload", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Read multipart body, limiting its rate
+		req.Body = ioutil.NopCloser(limiter.Reader(req.Body))
+		reader, err := req.MultipartReader()
+		if err != nil {
+			http.Error(res, "invalid upload", http.StatusBadRequest)
+			return
+		}
+		var uploads []Upload
+		// Hash sent by browser for the next file
+		var expectedHash string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(res, "invalid upload", http.StatusBadRequest)
+				return
+			}
+			switch part.FormName() {
+			case "sha256":
+				// Remember hash of the following file
+				hash, _ := ioutil.ReadAll(io.LimitReader(part, 64))
+				expectedHash = strings.ToLower(strings.TrimSpace(string(hash)))
+			case "file":
+				// Skip empty file inputs
+				if part.FileName() == "" {
+					continue
+				}
+				upload, err := saveUpload(workDir, part.FileName(), part, expectedHash)
+				expectedHash = ""
+				if err != nil {
+					log.Warn().Err(err).Str("file", part.FileName()).Str("addr", req.RemoteAddr).Msg("Upload rejected")
+					http.Error(res, err.Error(), http.StatusUnprocessableEntity)
+					return
+				}
+				upload.Addr = req.RemoteAddr
+				log.Info().Str("file", upload.Name).Int64("size", upload.Size).Str("sha256", upload.Hash).Str("addr", req.RemoteAddr).Msg("File uploaded")
+				// Deliver file, then remove its copy in workDir
+				err = deliver(&upload)
+				_ = os.RemoveAll(upload.Dir)
+				if err != nil {
+					log.Error().Err(err).Str("file", upload.Name).Str("addr", req.RemoteAddr).Msg("Error delivering upload")
+					http.Error(res, "error saving file", http.StatusInternalServerError)
+					return
+				}
+				uploads = append(uploads, upload)
+			}
+		}
+		// Reply with JSON to scripts, and with page to forms
+		if strings.Contains(req.Header.Get("Accept"), "application/json") {
+			res.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(res).Encode(uploads)
+			return
+		}
+		render(res, uploadTemplate, http.StatusOK, uploads)
+	})
+	return mux
+}
+
+// Save uploaded file named name from src into a new directory in
+// workDir, checking its hash against expectedHash, if not empty
+func saveUpload(workDir string, name string, src io.Reader, expectedHash string) (Upload, error) {
+	// Only keep base name, so that files cannot be written elsewhere
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return Upload{}, errInvalidName
+	}
+	// Create directory for upload, so that concurrent uploads do not collide
+	dir, err := ioutil.TempDir(workDir, "upload-")
+	if err != nil {
+		return Upload{}, err
+	}
+	upload := Upload{Dir: dir, Name: name}
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		os.RemoveAll(dir)
+		return Upload{}, err
+	}
+	defer file.Close()
+	// Copy file while hashing it
+	hasher := sha256.New()
+	upload.Size, err = io.Copy(io.MultiWriter(file, hasher), src)
+	if err != nil {
+		os.RemoveAll(dir)
+		return Upload{}, err
+	}
+	upload.Hash = hex.EncodeToString(hasher.Sum(nil))
+	// Make sure file arrived intact
+	if expectedHash != "" && expectedHash != upload.Hash {
+		os.RemoveAll(dir)
+		return Upload{}, errHashMismatch
+	}
+	return upload, nil
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright © 2021 Arsen Musayelyan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.arsenm.dev/opensend/internal/transfer"
+)
+
+// File uploaded by tests
+type testUpload struct {
+	name    string
+	content string
+	hash    string
+}
+
+// Create upload request of files, with the hash computed by the browser before each
+func newUploadRequest(t *testing.T, files ...testUpload) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, file := range files {
+		if file.hash != "" {
+			writer.WriteField("sha256", file.hash)
+		}
+		part, err := writer.CreateFormFile("file", file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file.content))
+	}
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+// Get hex encoded SHA-256 hash of content
+func hashOf(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+// Create handler accepting uploads, behind authentication, passing them to deliver
+func newUploadHandler(t *testing.T, deliver func(*Upload) error) http.Handler {
+	t.Helper()
+	return newAuth(testCode).wrap(uploadHandler(t.TempDir(), transfer.NewLimiter(0, nil), deliver))
+}
+
+func TestUploadRequiresSession(t *testing.T) {
+	delivered := false
+	handler := newUploadHandler(t, func(upload *Upload) error {
+		delivered = true
+		return nil
+	})
+	res := serve(handler, newUploadRequest(t, testUpload{name: "file.txt", content: "content"}))
+	if res.Code != http.StatusUnauthorized || delivered {
+		t.Errorf("upload without session returned status %d, delivered %v", res.Code, delivered)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	var delivered []Upload
+	handler := newUploadHandler(t, func(upload *Upload) error {
+		// Make sure file is saved in its directory when delivered
+		data, err := os.ReadFile(filepath.Join(upload.Dir, upload.Name))
+		if err != nil || hashOf(string(data)) != upload.Hash {
+			t.Errorf("delivered file %s = %q, %v", upload.Name, data, err)
+		}
+		// Deliver second file under another name
+		if len(delivered) == 1 {
+			upload.Name = "renamed.txt"
+		}
+		delivered = append(delivered, *upload)
+		return nil
+	})
+	cookie := login(t, handler)
+	res := serve(handler, newUploadRequest(t,
+		testUpload{name: "a.txt", content: "first", hash: hashOf("first")},
+		testUpload{name: "../../b.txt", content: "second"},
+	), cookie)
+	if res.Code != http.StatusOK {
+		t.Fatalf("upload returned status %d: %s", res.Code, res.Body.String())
+	}
+	var uploads []Upload
+	if err := json.NewDecoder(res.Body).Decode(&uploads); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 2 || len(delivered) != 2 {
+		t.Fatalf("uploaded %v, delivered %v, want 2 files", uploads, delivered)
+	}
+	// Names are reduced to their base name, and renames are reported to the browser
+	if delivered[1].Name != "renamed.txt" || uploads[1].Name != "renamed.txt" {
+		t.Errorf("second upload delivered as %q, reported as %q, want renamed.txt", delivered[1].Name, uploads[1].Name)
+	}
+	if uploads[0].Name != "a.txt" || uploads[0].Size != 5 || uploads[0].Hash != hashOf("first") {
+		t.Errorf("first upload = %+v", uploads[0])
+	}
+	if delivered[0].Addr == "" {
+		t.Error("address of browser not passed to deliver")
+	}
+	// Copies in the work directory are removed once delivered
+	for _, upload := range delivered {
+		if _, err := os.Stat(upload.Dir); !os.IsNotExist(err) {
+			t.Errorf("upload directory %s was not removed", upload.Dir)
+		}
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		upload  testUpload
+		deliver error
+		status  int
+	}{
+		{"hash mismatch", testUpload{name: "file.txt", content: "corrupted", hash: hashOf("content")}, nil, http.StatusUnprocessableEntity},
+		{"invalid name", testUpload{name: "..", content: "content"}, nil, http.StatusUnprocessableEntity},
+		{"delivery failed", testUpload{name: "file.txt", content: "content"}, errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		delivered := false
+		handler := newUploadHandler(t, func(upload *Upload) error {
+			delivered = true
+			return test.deliver
+		})
+		res := serve(handler, newUploadRequest(t, test.upload), login(t, handler))
+		if res.Code != test.status {
+			t.Errorf("%s: upload returned status %d, want %d", test.name, res.Code, test.status)
+		}
+		if delivered != (test.deliver != nil) {
+			t.Errorf("%s: delivered = %v", test.name, delivered)
+		}
+	}
+}